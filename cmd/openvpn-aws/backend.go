@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/pborman/getopt/v2"
+)
+
+// sourceOptions are the command line options naming the source of each concern of the backend
+type sourceOptions struct {
+	bootstrap *string
+	files     *string
+	network   *string
+	groups    *string
+	keys      *string
+	dns       *string
+	awsRate   *int
+	awsBurst  *int
+	awsRetry  *int
+	awsBudget *int
+}
+
+func addSourceOptions(set *getopt.Set) *sourceOptions {
+	return &sourceOptions{
+		bootstrap: set.StringLong("backend", 'b', "", "Bootstrap file naming the source of files, network info, groups, keys and DNS", "path"),
+		files:     set.StringLong("files", 0, "", "Source of vpn.conf and the server certificate, instead of --s3 or --local", "source"),
+		network:   set.StringLong("network", 0, "", "Source of network information", "source"),
+		groups:    set.StringLong("groups", 0, "", "Source of group membership", "source"),
+		keys:      set.StringLong("keys", 0, "", "Source of user keys", "source"),
+		dns:       set.StringLong("dns", 0, "", "Source of DNS registration", "source"),
+		awsRate:   set.IntLong("aws-rate", 0, config.DefaultAWSLimits.Rate, "AWS requests per second, 0 for no limit", "count"),
+		awsBurst:  set.IntLong("aws-burst", 0, config.DefaultAWSLimits.Burst, "AWS requests sent without waiting after a quiet period", "count"),
+		awsRetry:  set.IntLong("aws-retries", 0, config.DefaultAWSLimits.Retries, "Retries of a failed or throttled AWS request", "count"),
+		awsBudget: set.IntLong("aws-budget", 0, config.DefaultAWSLimits.Budget, "IAM lookups per reload, 0 for no limit", "count"),
+	}
+}
+
+func (options *sourceOptions) awsLimits() config.AWSLimits {
+	limits := config.AWSLimits{
+		Rate:    *options.awsRate,
+		Burst:   *options.awsBurst,
+		Retries: *options.awsRetry,
+		Budget:  *options.awsBudget,
+	}
+
+	if limits.Rate < 0 || limits.Burst < 0 || limits.Retries < 0 || limits.Budget < 0 {
+		errorf("AWS limits must not be negative")
+	}
+
+	if limits.Burst == 0 {
+		limits.Burst = 1
+	}
+
+	return limits
+}
+
+// openBackend creates the configuration backend selected by the command line, or returns nil if none was selected. The
+// files come from S3 or the local path unless another source is given, and each concern without a source is read from the
+// source of the files. With --ldap, groups and keys are read from the directory.
+func openBackend(s3path, localPath string, options *sourceOptions, ldap *ldapOptions) config.ConfigurationBackend {
+	sources := &config.BackendSources{}
+
+	if *options.bootstrap != "" {
+		file, err := os.Open(*options.bootstrap)
+
+		if err != nil {
+			errorf("Error opening %s: %s", *options.bootstrap, err)
+		}
+
+		sources, err = config.ParseBackendSources(*options.bootstrap, file)
+		file.Close()
+
+		if err != nil {
+			errorf("Error reading %s: %s", *options.bootstrap, err)
+		}
+	}
+
+	// Options override the bootstrap file
+	for _, source := range []struct {
+		value  *string
+		option string
+	}{
+		{&sources.Files, *options.files},
+		{&sources.Network, *options.network},
+		{&sources.Groups, *options.groups},
+		{&sources.Keys, *options.keys},
+		{&sources.DNS, *options.dns},
+		{&sources.Groups, *ldap.url},
+		{&sources.Keys, *ldap.url},
+	} {
+		if *source.value == "" {
+			*source.value = source.option
+		}
+	}
+
+	if sources.Files == "" {
+		if s3path != "" {
+			sources.Files = s3path
+
+			if !strings.HasPrefix(s3path, "s3://") {
+				sources.Files = "s3://" + s3path
+			}
+		} else if localPath != "" {
+			sources.Files = localPath
+		} else {
+			return nil
+		}
+	}
+
+	opened := make(map[string]config.ConfigurationBackend)
+	limits := options.awsLimits()
+	files := openSource(sources.Files, nil, sources, ldap, limits, opened)
+
+	if sources.Network == "" && sources.Groups == "" && sources.Keys == "" && sources.DNS == "" {
+		return files
+	}
+
+	open := func(source string) config.ConfigurationBackend {
+		if source == "" {
+			return files
+		}
+
+		return openSource(source, files, sources, ldap, limits, opened)
+	}
+
+	return &config.CompositeConfig{
+		Files:   files,
+		Network: open(sources.Network),
+		Groups:  open(sources.Groups),
+		Keys:    open(sources.Keys),
+		DNS:     open(sources.DNS),
+	}
+}
+
+// openSource creates the backend of a source, or returns the backend already opened for it. files is the backend holding
+// the files, which an LDAP directory relies on.
+func openSource(source string, files config.ConfigurationBackend, sources *config.BackendSources, ldap *ldapOptions, limits config.AWSLimits, opened map[string]config.ConfigurationBackend) config.ConfigurationBackend {
+	if backend, exists := opened[source]; exists {
+		return backend
+	}
+
+	var backend config.ConfigurationBackend
+	var err error
+
+	if source == "aws" {
+		for _, existing := range opened {
+			if _, ok := existing.(*config.AWSConfig); ok {
+				return existing
+			}
+		}
+
+		backend, err = config.NewAWSConfig("", "", limits)
+	} else if strings.HasPrefix(source, "s3://") {
+		s3url, err := url.Parse(source)
+
+		if err != nil {
+			errorf("Error parsing S3 URL %s: %s", source, err)
+		}
+
+		bucket := s3url.Host
+		path := strings.TrimPrefix(s3url.Path, "/")
+
+		backend, err = config.NewAWSConfig(bucket, path, limits)
+
+		if err != nil {
+			errorf("Error initializing AWS config with S3 path %s/%s: %s", bucket, path, err)
+		}
+	} else if strings.HasPrefix(source, "ldap://") || strings.HasPrefix(source, "ldaps://") {
+		if files == nil {
+			errorf("Files cannot be read from LDAP directory %s", source)
+		}
+
+		settings, exists := sources.LDAP[source]
+
+		if !exists {
+			settings = ldap.settings()
+			settings.URL = source
+		}
+
+		backend, err = config.NewLDAPConfig(settings, files)
+	} else {
+		backend = &config.LocalConfig{Root: source}
+	}
+
+	if err != nil {
+		errorf("Error initializing backend %s: %s", source, err)
+	}
+
+	opened[source] = backend
+
+	return backend
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/pborman/getopt/v2"
+)
+
+const diffContext = 3
+
+func handleFormat(args []string) int {
+	set := getopt.New()
+	set.SetProgram(os.Args[0] + " fmt")
+	set.SetParameters("[file ...]")
+	write := set.BoolLong("write", 'w', "Write the result to the file instead of standard output")
+	diff := set.BoolLong("diff", 'd', "Print a diff instead of the formatted file")
+	showHelp := set.BoolLong("help", 'h', "Show help")
+
+	set.Parse(args)
+
+	if *showHelp {
+		set.PrintUsage(os.Stdout)
+		return 0
+	}
+
+	files := set.Args()
+	status := 0
+
+	if len(files) == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "Cannot use --write with standard input")
+			return 1
+		}
+
+		files = []string{"-"}
+	}
+
+	for _, file := range files {
+		var data []byte
+		var err error
+
+		if file == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(file)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", file, err)
+			status = 1
+			continue
+		}
+
+		formatted, err := config.FormatConfig(file, bytes.NewReader(data))
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+
+		if *diff {
+			if formatted != string(data) {
+				fmt.Printf("--- %s\n+++ %s\n", file, file)
+				fmt.Print(unifiedDiff(splitLines(string(data)), splitLines(formatted)))
+			}
+		} else if *write {
+			if formatted != string(data) {
+				info, err := os.Stat(file)
+
+				if err == nil {
+					err = ioutil.WriteFile(file, []byte(formatted), info.Mode())
+				}
+
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", file, err)
+					status = 1
+				}
+			}
+		} else {
+			fmt.Print(formatted)
+		}
+	}
+
+	return status
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// unifiedDiff returns the hunks of a unified diff turning a into b
+func unifiedDiff(a, b []string) string {
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte
+		line string
+		a, b int // Line numbers before the edit
+	}
+
+	var edits []edit
+
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		} else if j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]) {
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		} else {
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var rv strings.Builder
+
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// Extend the hunk until the changes are separated by more than twice the context
+		end := start
+
+		for next := start; next < len(edits); next++ {
+			if edits[next].op != ' ' {
+				if next-end > 2*diffContext {
+					break
+				}
+
+				end = next + 1
+			}
+		}
+
+		first := start - diffContext
+
+		if first < 0 {
+			first = 0
+		}
+
+		last := end + diffContext
+
+		if last > len(edits) {
+			last = len(edits)
+		}
+
+		var aCount, bCount int
+
+		for _, e := range edits[first:last] {
+			if e.op != '+' {
+				aCount++
+			}
+
+			if e.op != '-' {
+				bCount++
+			}
+		}
+
+		fmt.Fprintf(&rv, "@@ -%d,%d +%d,%d @@\n", edits[first].a+1, aCount, edits[first].b+1, bCount)
+
+		for _, e := range edits[first:last] {
+			rv.WriteByte(e.op)
+			rv.WriteString(e.line)
+
+			if !strings.HasSuffix(e.line, "\n") {
+				rv.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		start = last
+	}
+
+	return rv.String()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/pborman/getopt/v2"
+)
+
+// ldapOptions are the command line options selecting users, groups and keys from an LDAP directory
+type ldapOptions struct {
+	url             *string
+	startTLS        *bool
+	bindDN          *string
+	userBase        *string
+	userFilter      *string
+	userAttribute   *string
+	keyAttribute    *string
+	groupBase       *string
+	groupFilter     *string
+	groupAttribute  *string
+	memberAttribute *string
+}
+
+func addLDAPOptions(set *getopt.Set) *ldapOptions {
+	defaults := config.DefaultLDAPSettings
+
+	return &ldapOptions{
+		url:             set.StringLong("ldap", 0, "", "LDAP server for users, groups and keys, vpn.conf is read from --s3 or --local", "url"),
+		startTLS:        set.BoolLong("ldap-starttls", 0, "Use StartTLS with an ldap:// server"),
+		bindDN:          set.StringLong("ldap-bind-dn", 0, "", "DN to bind as, the password is read from LDAP_BIND_PASSWORD", "dn"),
+		userBase:        set.StringLong("ldap-user-base", 0, "", "Base DN of users", "dn"),
+		userFilter:      set.StringLong("ldap-user-filter", 0, defaults.UserFilter, "Filter matching users", "filter"),
+		userAttribute:   set.StringLong("ldap-user-attribute", 0, defaults.UserAttribute, "Attribute holding the user name", "attribute"),
+		keyAttribute:    set.StringLong("ldap-key-attribute", 0, defaults.KeyAttribute, "Attribute holding the public keys of users", "attribute"),
+		groupBase:       set.StringLong("ldap-group-base", 0, "", "Base DN of groups", "dn"),
+		groupFilter:     set.StringLong("ldap-group-filter", 0, defaults.GroupFilter, "Filter matching groups", "filter"),
+		groupAttribute:  set.StringLong("ldap-group-attribute", 0, defaults.GroupAttribute, "Attribute holding the group name", "attribute"),
+		memberAttribute: set.StringLong("ldap-member-attribute", 0, defaults.MemberAttribute, "Attribute holding the DNs of group members", "attribute"),
+	}
+}
+
+func (options *ldapOptions) settings() config.LDAPSettings {
+	return config.LDAPSettings{
+		URL:             *options.url,
+		StartTLS:        *options.startTLS,
+		BindDN:          *options.bindDN,
+		BindPassword:    os.Getenv("LDAP_BIND_PASSWORD"),
+		UserBase:        *options.userBase,
+		UserFilter:      *options.userFilter,
+		UserAttribute:   *options.userAttribute,
+		KeyAttribute:    *options.keyAttribute,
+		GroupBase:       *options.groupBase,
+		GroupFilter:     *options.groupFilter,
+		GroupAttribute:  *options.groupAttribute,
+		MemberAttribute: *options.memberAttribute,
+	}
+}
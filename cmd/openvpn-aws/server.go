@@ -7,12 +7,11 @@ import (
 	"github.com/amadigan/openvpn-aws/internal/log"
 	"github.com/amadigan/openvpn-aws/internal/vpn"
 	"github.com/pborman/getopt/v2"
-	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -25,6 +24,14 @@ func main() {
 		}
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(handleCheck(os.Args[1:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(handleFormat(os.Args[1:]))
+	}
+
 	handleStart()
 }
 
@@ -44,7 +51,10 @@ func handleStart() {
 	getopt.SetParameters("")
 	s3path = getopt.StringLong("s3", 's', *s3path, "S3 directory containing vpn.conf. May be an s3:// URL or bucket/path", "url")
 	localPath = getopt.StringLong("local", 'l', *localPath, "Filesystem path containing vpn.conf", "path")
+	sources := addSourceOptions(getopt.CommandLine)
+	ldap := addLDAPOptions(getopt.CommandLine)
 	root := getopt.StringLong("root", 'r', ".", "Root path for VPN", "path")
+	cacheGrace := getopt.DurationLong("cache-grace", 0, time.Hour, "How long cached keys, groups and network info are used while the backend fails, 0 to disable the cache", "duration")
 	logLevel := getopt.EnumLong("loglevel", 0, []string{"debug", "info", "warn", "error"}, "debug", "Log verbosity", "level")
 	showHelp := getopt.BoolLong("help", 'h', "Show help")
 
@@ -75,56 +85,101 @@ func handleStart() {
 		errorf("Unable to parse root path %s: %s", *root, err)
 	}
 
-	var backend config.ConfigurationBackend
+	backend := openBackend(*s3path, *localPath, sources, ldap)
 
-	if *s3path != "" {
-		s3 := *s3path
-		var bucket string
-		var path string
+	if backend == nil {
+		help(1)
+	}
 
-		if strings.HasPrefix(s3, "s3://") {
+	if *cacheGrace > 0 {
+		backend = config.NewCachedConfig(backend, filepath.Join(absRoot, "backend.cache"), *cacheGrace)
+	}
 
-			s3url, err := url.Parse(s3)
+	vpn, err := vpn.BootVPN(backend, absRoot)
 
-			if err != nil {
-				errorf("Error parsing S3 URL %s: %s", s3, err)
-			}
+	if err != nil {
+		errorf("Error starting VPN: %s", err)
+	}
 
-			bucket = s3url.Host
-			path = strings.TrimPrefix(s3url.Path, "/")
-		} else {
-			slash := strings.IndexRune(*s3path, '/')
+	defer vpn.Shutdown()
 
-			if slash > 0 {
-				bucket = s3[:slash]
-				path = s3[slash+1:]
-			}
-		}
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+
+	// SIGUSR1 logs the recent access changes, any other signal stops the server
+	for sig := <-sigChannel; sig == syscall.SIGUSR1; sig = <-sigChannel {
+		logAccessHistory(vpn)
+	}
+}
+
+func logAccessHistory(vpn *vpn.VPNManager) {
+	logger := log.New("access")
+	changes := vpn.AccessHistory()
+
+	logger.Infof("%d access changes recorded", len(changes))
+
+	for _, change := range changes {
+		logger.Infof("%s %s", change.Time.Format(time.RFC3339), change)
+	}
+}
+
+func handleCheck(args []string) int {
+	log.LogLevel = log.WARN
+
+	set := getopt.New()
+	set.SetProgram(os.Args[0] + " check")
+	set.SetParameters("")
+	s3path := set.StringLong("s3", 's', os.Getenv("S3_PATH"), "S3 directory containing vpn.conf. May be an s3:// URL or bucket/path", "url")
+	localPath := set.StringLong("local", 'l', "", "Filesystem path containing vpn.conf", "path")
+	file := set.StringLong("file", 'f', "vpn.conf", "Configuration file to check, relative to the S3 directory or filesystem path", "path")
+	sources := addSourceOptions(set)
+	ldap := addLDAPOptions(set)
+	skipNetwork := set.BoolLong("skip-network", 0, "Do not check subnets against the network information")
+	showHelp := set.BoolLong("help", 'h', "Show help")
+
+	set.Parse(args)
+
+	if *showHelp {
+		set.PrintUsage(os.Stdout)
+		return 0
+	}
+
+	backend := openBackend(*s3path, *localPath, sources, ldap)
+
+	if backend == nil {
+		set.PrintUsage(os.Stdout)
+		return 1
+	}
+
+	var netinfo *config.NetworkInfo
 
-		backend, err = config.NewAWSConfig(bucket, path)
+	if !*skipNetwork {
+		var err error
+		netinfo, err = backend.FetchNetworkInfo()
 
 		if err != nil {
-			errorf("Error initializing AWS config with S3 path %s/%s: %s", bucket, path, err)
+			fmt.Printf("Unable to fetch network information: %s\n", err)
+			return 1
 		}
 
-	} else if *localPath != "" {
-		backend = &config.LocalConfig{Root: *localPath}
-	} else {
-		help(1)
+		if netinfo == nil {
+			fmt.Println("No network information available, subnets will not be checked")
+		}
 	}
 
-	vpn, err := vpn.BootVPN(backend, absRoot)
+	_, problems := config.LoadConfigStrict(backend, *file, netinfo)
 
-	if err != nil {
-		errorf("Error starting VPN: %s", err)
+	for _, problem := range problems {
+		fmt.Println(problem)
 	}
 
-	defer vpn.Shutdown()
-
-	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
+	if len(problems) != 0 {
+		fmt.Printf("%s: %d problem(s) found\n", *file, len(problems))
+		return 1
+	}
 
-	<-sigChannel
+	fmt.Printf("%s: OK\n", *file)
+	return 0
 }
 
 func errorf(format string, v ...interface{}) {
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// DefaultNetwork is the tunnel network used when the global section does not have a net statement
+var DefaultNetwork = net.IPNet{IP: net.IPv4(169, 254, 120, 0).To4(), Mask: net.CIDRMask(24, 32)}
+
+type addressReference struct {
+	section *SectionConfig
+	stmt    *ConfigStatement
+}
+
+// TunnelNetwork returns the network of the tunnel
+func (config *ConfigFile) TunnelNetwork() net.IPNet {
+	if config.Network != nil {
+		return *config.Network
+	}
+
+	return DefaultNetwork
+}
+
+// StaticAddress6 returns the IPv6 address of a client with the static IPv4 address ip, at the same offset in the upper half
+// of network6. OpenVPN only assigns IPv6 addresses to clients that get their IPv4 address from its pool.
+func StaticAddress6(network net.IPNet, network6 net.IPNet, ip net.IP) net.IP {
+	start, _ := addressRange(network)
+	ones, bits := network6.Mask.Size()
+	half := uint(bits - ones - 1)
+
+	rv := make(net.IP, net.IPv6len)
+	copy(rv, network6.IP.To16())
+	rv[15-half/8] |= 1 << (half % 8)
+
+	low := binary.BigEndian.Uint32(rv[12:]) | (ipToUint32(ip) - start)
+	binary.BigEndian.PutUint32(rv[12:], low)
+
+	return rv
+}
+
+// DynamicRange returns the first and last addresses handed out by OpenVPN, which start after the server's own address.
+// With reserveStatic, the upper half of the network is reserved for static addresses and only the lower half is handed
+// out, otherwise the pool ends before the broadcast address.
+func DynamicRange(network net.IPNet, reserveStatic bool) (first, last net.IP) {
+	start, size := addressRange(network)
+
+	if !reserveStatic {
+		return uint32ToIP(start + 2), uint32ToIP(start + size - 2)
+	}
+
+	return uint32ToIP(start + 2), uint32ToIP(start + size/2 - 1)
+}
+
+// HasStaticAddresses checks whether any user has an ip statement or any group has an ip-pool
+func (config *ConfigFile) HasStaticAddresses() bool {
+	for _, user := range config.Users {
+		if user.IP != nil || user.IPPool != nil {
+			return true
+		}
+	}
+
+	for _, group := range config.Groups {
+		if group.IPPool != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staticRange returns the upper half of the network, excluding the broadcast address
+func staticRange(network net.IPNet) (first, last uint32) {
+	start, size := addressRange(network)
+
+	return start + size/2, start + size - 2
+}
+
+func addressRange(network net.IPNet) (start uint32, size uint32) {
+	ones, bits := network.Mask.Size()
+
+	return ipToUint32(network.IP), uint32(1) << uint(bits-ones)
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(value uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, value)
+	return ip
+}
+
+// resolveAddresses checks that static addresses and pools are in the static half of the tunnel network, and that no
+// address is assigned to more than one user
+func (configFile *ConfigFile) resolveAddresses() error {
+	network := configFile.TunnelNetwork()
+	first, last := staticRange(network)
+	owners := make(map[uint32]*ConfigStatement)
+
+	for _, ref := range configFile.addressRefs {
+		if ref.section.IP != nil {
+			if !network.Contains(ref.section.IP) {
+				return ref.stmt.Errorf("ip %s is outside of net %s", ref.section.IP, network.String())
+			}
+
+			address := ipToUint32(ref.section.IP)
+
+			if address < first || address > last {
+				return ref.stmt.Errorf("ip %s must be between %s and %s, the lower half of net %s is assigned dynamically", ref.section.IP, uint32ToIP(first), uint32ToIP(last), network.String())
+			}
+
+			if owner := owners[address]; owner != nil {
+				return ref.stmt.Errorf("ip %s is already assigned to user %s at %s:%d", ref.section.IP, owner.SectionName, owner.File, owner.Line)
+			}
+
+			owners[address] = ref.stmt
+		} else if ref.section.IPPool != nil {
+			pool := *ref.section.IPPool
+			start, size := addressRange(pool)
+
+			if !network.Contains(pool.IP) || start < first || start+size-1 > last+1 {
+				return ref.stmt.Errorf("ip-pool %s must be within %s-%s, the lower half of net %s is assigned dynamically", pool.String(), uint32ToIP(first), uint32ToIP(last), network.String())
+			}
+		}
+	}
+
+	configFile.addressRefs = nil
+
+	return nil
+}
+
+// PoolAddress returns the first address in pool that is not in use and not assigned to a user with an ip statement, or nil
+// if there is none. The broadcast address of the tunnel network is never returned.
+func (config *ConfigFile) PoolAddress(pool net.IPNet, inUse func(ip net.IP) bool) net.IP {
+	start, size := addressRange(pool)
+	_, last := staticRange(config.TunnelNetwork())
+	reserved := make(map[uint32]bool)
+
+	for _, user := range config.Users {
+		if user.IP != nil {
+			reserved[ipToUint32(user.IP)] = true
+		}
+	}
+
+	for address := start; address < start+size && address <= last; address++ {
+		ip := uint32ToIP(address)
+
+		if !reserved[address] && !inUse(ip) {
+			return ip
+		}
+	}
+
+	return nil
+}
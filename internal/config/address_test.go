@@ -0,0 +1,71 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDynamicRange(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.8.0.0/24")
+
+	for _, test := range []struct {
+		reserveStatic bool
+		first         string
+		last          string
+	}{
+		{false, "10.8.0.2", "10.8.0.254"},
+		{true, "10.8.0.2", "10.8.0.127"},
+	} {
+		first, last := DynamicRange(*network, test.reserveStatic)
+
+		if first.String() != test.first || last.String() != test.last {
+			t.Errorf("DynamicRange(%s, %t) = %s-%s, expected %s-%s", network, test.reserveStatic, first, last, test.first, test.last)
+		}
+	}
+}
+
+func TestHasStaticAddresses(t *testing.T) {
+	for _, test := range []struct {
+		conf   string
+		static bool
+	}{
+		{"global\n  net 10.8.0.0/24\n\ngroup devs\n\nuser joe\n", false},
+		{"global\n  net 10.8.0.0/24\n\nuser joe\n  ip 10.8.0.130\n", true},
+		{"global\n  net 10.8.0.0/24\n\ngroup devs\n  ip-pool 10.8.0.192/27\n", true},
+	} {
+		conf, err := ParseConfig(strings.NewReader(test.conf))
+
+		if err != nil {
+			t.Fatalf("Error parsing %q: %s", test.conf, err)
+		}
+
+		if static := conf.HasStaticAddresses(); static != test.static {
+			t.Errorf("HasStaticAddresses() = %t for %q", static, test.conf)
+		}
+
+		if settings := conf.ServerOptions(); settings.StaticAddresses != test.static {
+			t.Errorf("ServerOptions().StaticAddresses = %t for %q", settings.StaticAddresses, test.conf)
+		}
+	}
+}
+
+func TestStaticAddress6(t *testing.T) {
+	_, network, _ := net.ParseCIDR("169.254.121.0/24")
+
+	for _, test := range []struct {
+		network6 string
+		ip       string
+		expected string
+	}{
+		{"fd00:4f56:5041::/64", "169.254.121.130", "fd00:4f56:5041:0:8000::82"},
+		{"fd00:4f56:5041::/64", "169.254.121.2", "fd00:4f56:5041:0:8000::2"},
+		{"fd00:4f56:5041:7::/112", "169.254.121.200", "fd00:4f56:5041:7::80c8"},
+	} {
+		_, network6, _ := net.ParseCIDR(test.network6)
+
+		if static6 := StaticAddress6(*network, *network6, net.ParseIP(test.ip)); static6.String() != test.expected {
+			t.Errorf("StaticAddress6(%s, %s, %s) = %s, expected %s", network, test.network6, test.ip, static6, test.expected)
+		}
+	}
+}
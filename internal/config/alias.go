@@ -0,0 +1,199 @@
+package config
+
+import (
+	"net"
+	"strings"
+)
+
+// NetworkAlias is a named set of networks and subnets that may be referenced by route, nat and deny statements
+type NetworkAlias struct {
+	Name            string
+	Order           int
+	Routes          []Route
+	Subnets         []Subnet
+	SubnetSelectors []SubnetSelector
+}
+
+type aliasReference struct {
+	name string
+	stmt *ConfigStatement
+}
+
+func (alias *NetworkAlias) String() string {
+	rv := alias.header() + "\n"
+
+	for _, line := range alias.lines() {
+		rv += "\t" + line + "\n"
+	}
+
+	return rv
+}
+
+func (alias *NetworkAlias) header() string {
+	return "network " + alias.Name
+}
+
+// lines returns the entries of the alias in canonical order, without indentation
+func (alias *NetworkAlias) lines() []string {
+	rv := make([]string, 0, len(alias.Subnets)+len(alias.SubnetSelectors)+len(alias.Routes))
+
+	for _, subnet := range alias.Subnets {
+		rv = append(rv, subnet.String())
+	}
+
+	for _, selector := range alias.SubnetSelectors {
+		rv = append(rv, selector.String())
+	}
+
+	for _, route := range alias.Routes {
+		rv = append(rv, route.String())
+	}
+
+	return rv
+}
+
+// expand returns the networks and ports of the alias, subnets missing from netinfo are skipped
+func (alias *NetworkAlias) expand(netinfo *NetworkInfo) []networkPorts {
+	rv := make([]networkPorts, 0, len(alias.Routes)+len(alias.Subnets))
+
+	for _, route := range alias.Routes {
+		rv = append(rv, networkPorts{network: route.Network, ports: route.Ports})
+	}
+
+	for _, subnet := range alias.Subnets {
+		for _, network := range netinfo.subnetNetworks(subnet.Name) {
+			rv = append(rv, networkPorts{network: network, ports: subnet.Ports})
+		}
+	}
+
+	for _, selector := range alias.SubnetSelectors {
+		rv = append(rv, selector.expand(netinfo)...)
+	}
+
+	return rv
+}
+
+// expandRoute resolves a route that may refer to a network alias into networks and ports
+func (config *ConfigFile) expandRoute(route Route, netinfo *NetworkInfo) []networkPorts {
+	if route.Alias == "" {
+		return []networkPorts{{network: route.Network, ports: route.Ports}}
+	}
+
+	alias := config.Networks[route.Alias]
+
+	if alias == nil {
+		return nil
+	}
+
+	return alias.expand(netinfo)
+}
+
+// hasSubnets checks whether any route in routes refers to an alias containing subnets
+func (config *ConfigFile) hasSubnets(routes []Route) bool {
+	for _, route := range routes {
+		if alias := config.Networks[route.Alias]; alias != nil && (len(alias.Subnets) != 0 || len(alias.SubnetSelectors) != 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseNetworkSection(alias *NetworkAlias, stmt *ConfigStatement) (err error) {
+	if stmt.Word == "" {
+		return nil
+	}
+
+	if isSubnetId(stmt.Word) {
+		subnet := Subnet{Name: stmt.Word}
+
+		subnet.Ports, err = parsePorts(stmt, stmt.Fields)
+
+		if err != nil {
+			return err
+		}
+
+		alias.Subnets = append(alias.Subnets, subnet)
+		return nil
+	} else if stmt.Word == "subnets" {
+		selector, err := parseSelector(stmt, stmt.Fields)
+
+		if err != nil {
+			return err
+		}
+
+		alias.SubnetSelectors = append(alias.SubnetSelectors, selector)
+		return nil
+	}
+
+	route, err := parseRouteFields(stmt, append([]string{stmt.Word}, stmt.Fields...))
+
+	if err != nil {
+		return err
+	}
+
+	if route.Alias != "" {
+		return stmt.Errorf("cannot parse net %s", route.Alias)
+	}
+
+	alias.Routes = append(alias.Routes, route)
+	return nil
+}
+
+func isSubnetId(word string) bool {
+	return strings.HasPrefix(word, "subnet-") || strings.HasPrefix(word, "pcx-")
+}
+
+// isAliasName checks whether name can be used as a network alias, it must not be mistaken for an address, subnet or keyword
+func isAliasName(name string) bool {
+	if name == "" || isSubnetId(name) || net.ParseIP(name) != nil {
+		return false
+	}
+
+	switch name {
+	case "on", "off", "all", "subnets":
+		return false
+	}
+
+	for index, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' {
+			continue
+		}
+
+		if index > 0 && ((c >= '0' && c <= '9') || c == '-' || c == '.') {
+			continue
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// resolve checks the references between sections once every file has been parsed
+func (configFile *ConfigFile) resolve() error {
+	err := configFile.resolveAliases()
+
+	if err == nil {
+		err = configFile.resolveInherits()
+	}
+
+	if err == nil {
+		err = configFile.resolveAddresses()
+	}
+
+	return err
+}
+
+// resolveAliases checks that every referenced network alias is defined
+func (configFile *ConfigFile) resolveAliases() error {
+	for _, ref := range configFile.aliasRefs {
+		if _, exists := configFile.Networks[ref.name]; !exists {
+			return ref.stmt.Errorf("undefined network %s", ref.name)
+		}
+	}
+
+	configFile.aliasRefs = nil
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const aliasConf = `network databases
+  10.20.0.0/16 5432 3306
+  subnet-db 5432
+
+network partner
+  172.16.0.0/12
+
+group analysts
+  route databases
+
+group vendors
+  nat partner
+
+user contractor
+  deny databases
+`
+
+func aliasNetinfo(t *testing.T) *NetworkInfo {
+	return &NetworkInfo{
+		Subnets: map[string]net.IPNet{
+			"subnet-db":  parseNetwork(t, "10.30.1.0/24"),
+			"subnet-app": parseNetwork(t, "10.30.2.0/24"),
+		},
+		NAT: []net.IPNet{parseNetwork(t, "192.0.2.0/24")},
+	}
+}
+
+func TestNetworkAliases(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(aliasConf))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	netinfo := aliasNetinfo(t)
+
+	for _, test := range []struct {
+		name     string
+		user     string
+		groups   []string
+		routes   string
+		denies   string
+		natAlias bool
+	}{
+		// The alias refers to a subnet, so the other subnets are not routed
+		{"route", "ann", []string{"analysts"}, "10.20.0.0/16 3306 5432, 10.30.1.0/24 5432, 192.0.2.0/24", "", false},
+		{"nat", "bob", []string{"vendors"}, "10.30.1.0/24, 10.30.2.0/24, 172.16.0.0/12", "", true},
+		{"deny", "contractor", []string{"analysts"}, "192.0.2.0/24", "", false},
+	} {
+		userConf, err := conf.GetUserConfig(test.user, test.groups, netinfo, time.Now())
+
+		if err != nil {
+			t.Errorf("%s: error getting config: %s", test.name, err)
+			continue
+		}
+
+		if routes := routesString(userConf.Routes); routes != test.routes {
+			t.Errorf("%s: routes %q, expected %q", test.name, routes, test.routes)
+		}
+
+		if denies := routesString(userConf.Denies); denies != test.denies {
+			t.Errorf("%s: denies %q, expected %q", test.name, denies, test.denies)
+		}
+
+		if (userConf.NATSetting == ON) != test.natAlias {
+			t.Errorf("%s: unexpected nat setting %s", test.name, userConf.NATSetting)
+		}
+	}
+}
+
+func TestNetworkAliasErrors(t *testing.T) {
+	for _, test := range []struct {
+		conf     string
+		expected string
+	}{
+		{"group devs\n  route missing\n", "config:2 undefined network missing"},
+		{"group devs\n  nat missing\n", "config:2 undefined network missing"},
+		{"group devs\n  deny missing\n", "config:2 undefined network missing"},
+		{"network db\n  10.0.0.0/16\n\ngroup devs\n  route db 22\n", "config:5 network db cannot be given ports"},
+		{"network db\n  other\n", "config:2 cannot parse net other"},
+		{"network 10db\n", "config:1 invalid network name 10db"},
+	} {
+		_, err := ParseConfig(strings.NewReader(test.conf))
+
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected an error containing %q parsing %q, got %v", test.expected, test.conf, err)
+		}
+	}
+}
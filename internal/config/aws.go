@@ -8,10 +8,14 @@ import (
 	"io"
 	"net"
 	"path"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/iam"
@@ -30,15 +34,21 @@ type AWSConfig struct {
 	route53     *route53.Route53
 	kmsKeyId    *string
 	encryption  *string
+	region      string
 	vpcId       string
+	vpcCidr     string     // Fetched when first used as a variable
+	vpcLock     sync.Mutex // Guards vpcCidr
 	subnetId    string
 	publicIP    net.IP
 	route53Id   *string
 	route53Zone string
 	route53Name string
+	limiter     *awsLimiter
 }
 
-func NewAWSConfig(s3bucket, prefix string) (*AWSConfig, error) {
+// NewAWSConfig creates a backend using the AWS services of the instance, with files in s3bucket under prefix. Requests
+// are sent within limits, and retried with backoff when they fail or are throttled.
+func NewAWSConfig(s3bucket, prefix string, limits AWSLimits) (*AWSConfig, error) {
 	metric := log.StartMetric()
 	sess, err := session.NewSession()
 
@@ -54,12 +64,21 @@ func NewAWSConfig(s3bucket, prefix string) (*AWSConfig, error) {
 		return nil, fmt.Errorf("Error determining AWS region: %w", err)
 	}
 
-	sess, err = session.NewSession(&aws.Config{Region: aws.String(region)})
+	limiter := newAWSLimiter(limits)
+	retryer := awsRetryer{DefaultRetryer: client.DefaultRetryer{NumMaxRetries: limits.Retries}, limiter: limiter}
+	sess, err = session.NewSession(request.WithRetryer(&aws.Config{Region: aws.String(region)}, retryer))
 
 	if err != nil {
 		return nil, fmt.Errorf("Error creating AWS Session for region %s: %w", region, err)
 	}
 
+	sess.Handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: "openvpn-aws.RateLimit",
+		Fn: func(r *request.Request) {
+			limiter.wait()
+		},
+	})
+
 	config := &AWSConfig{
 		s3bucket:    s3bucket,
 		s3path:      prefix,
@@ -69,6 +88,8 @@ func NewAWSConfig(s3bucket, prefix string) (*AWSConfig, error) {
 		iam:         iam.New(sess),
 		s3:          s3.New(sess),
 		route53:     route53.New(sess),
+		region:      region,
+		limiter:     limiter,
 	}
 
 	mac, err := metaclient.GetMetadata("mac")
@@ -106,6 +127,23 @@ func NewAWSConfig(s3bucket, prefix string) (*AWSConfig, error) {
 	return config, nil
 }
 
+// BeginReload restores the request budget
+func (c *AWSConfig) BeginReload() {
+	c.limiter.reset()
+}
+
+// EndReload has nothing to do, the budget only applies to the lookups of the view returned by ReloadBackend
+func (c *AWSConfig) EndReload() {}
+
+// ReloadBackend returns a view of the backend that counts IAM lookups against the budget of the current reload
+func (c *AWSConfig) ReloadBackend() ConfigurationBackend {
+	if c.limiter.limits.Budget == 0 {
+		return c
+	}
+
+	return &awsReloadView{c}
+}
+
 func isError(err error, code string) bool {
 	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == code {
 		return true
@@ -133,7 +171,7 @@ func (c *AWSConfig) FetchFile(key string, ifNotTag string) (io.ReadCloser, strin
 		} else if isError(err, "NotModified") {
 			return nil, ifNotTag, nil
 		}
-		return nil, "", fmt.Errorf("Error retrieving %s/%s: %w", c.s3bucket, keyPath, err)
+		return nil, "", fmt.Errorf("Error retrieving %s/%s: %w", c.s3bucket, keyPath, throttled(err))
 	}
 
 	var tag string
@@ -145,6 +183,51 @@ func (c *AWSConfig) FetchFile(key string, ifNotTag string) (io.ReadCloser, strin
 	return out.Body, tag, nil
 }
 
+func (c *AWSConfig) ListFiles(pattern string) ([]string, error) {
+	prefix := pattern
+
+	if meta := strings.IndexAny(pattern, "*?[\\"); meta != -1 {
+		prefix = pattern[:meta]
+	}
+
+	prefix = path.Join(c.s3path, prefix)
+
+	var paths []string
+	var matchError error
+
+	err := c.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(c.s3bucket),
+		Prefix: aws.String(prefix),
+	}, func(out *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range out.Contents {
+			key := strings.TrimPrefix(strings.TrimPrefix(*object.Key, c.s3path), "/")
+
+			var matched bool
+			matched, matchError = path.Match(pattern, key)
+
+			if matchError != nil {
+				return false
+			}
+
+			if matched {
+				paths = append(paths, key)
+			}
+		}
+
+		return true
+	})
+
+	if matchError != nil {
+		return nil, matchError
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Error listing %s/%s: %w", c.s3bucket, prefix, throttled(err))
+	}
+
+	return paths, nil
+}
+
 func (c *AWSConfig) PutFile(key string, data []byte) error {
 	keyPath := path.Join(c.s3path, key)
 
@@ -168,7 +251,9 @@ func (c *AWSConfig) PutFile(key string, data []byte) error {
 
 func (c *AWSConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 	netinfo := NetworkInfo{
-		Subnets: make(map[string]net.IPNet),
+		Subnets:     make(map[string]net.IPNet),
+		SubnetsIPv6: make(map[string][]net.IPNet),
+		SubnetTags:  make(map[string]map[string]string),
 	}
 
 	var handlerError error
@@ -187,6 +272,31 @@ func (c *AWSConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 			}
 
 			netinfo.Subnets[*subnet.SubnetId] = *network
+
+			for _, block := range subnet.Ipv6CidrBlockAssociationSet {
+				if block.Ipv6CidrBlock == nil || block.Ipv6CidrBlockState == nil || aws.StringValue(block.Ipv6CidrBlockState.State) != ec2.SubnetCidrBlockStateCodeAssociated {
+					continue
+				}
+
+				_, network, err := net.ParseCIDR(*block.Ipv6CidrBlock)
+
+				if err != nil {
+					handlerError = fmt.Errorf("Error parsing IPv6 CIDR %s on subnet %s: %w", *block.Ipv6CidrBlock, *subnet.SubnetId, err)
+					return false
+				}
+
+				netinfo.SubnetsIPv6[*subnet.SubnetId] = append(netinfo.SubnetsIPv6[*subnet.SubnetId], *network)
+			}
+
+			tags := make(map[string]string, len(subnet.Tags))
+
+			for _, tag := range subnet.Tags {
+				if tag.Key != nil && tag.Value != nil {
+					tags[*tag.Key] = *tag.Value
+				}
+			}
+
+			netinfo.SubnetTags[*subnet.SubnetId] = tags
 		}
 
 		return true
@@ -197,7 +307,7 @@ func (c *AWSConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("Error describing subnets on VPC %s: %w", c.vpcId, err)
+		return nil, fmt.Errorf("Error describing subnets on VPC %s: %w", c.vpcId, throttled(err))
 	}
 
 	tables, err := c.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
@@ -208,7 +318,7 @@ func (c *AWSConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("Error describing route table for subnet %s on VPC %s: %w", c.subnetId, c.vpcId, err)
+		return nil, fmt.Errorf("Error describing route table for subnet %s on VPC %s: %w", c.subnetId, c.vpcId, throttled(err))
 	}
 
 	if len(tables.RouteTables) == 0 {
@@ -220,7 +330,7 @@ func (c *AWSConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 		})
 
 		if err != nil {
-			return nil, fmt.Errorf("Error describing main route table for VPC %s: %w", c.vpcId, err)
+			return nil, fmt.Errorf("Error describing main route table for VPC %s: %w", c.vpcId, throttled(err))
 		}
 	}
 
@@ -242,6 +352,30 @@ func (c *AWSConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 				}
 
 				netinfo.NAT = append(netinfo.NAT, *network)
+			} else if aws.StringValue(route.GatewayId) == "local" {
+				_, network, err := net.ParseCIDR(*route.DestinationCidrBlock)
+
+				if err != nil {
+					return nil, fmt.Errorf("Error parsing CIDR block %s on route table %s: %w", *route.DestinationCidrBlock, *tables.RouteTables[0].RouteTableId, err)
+				}
+
+				// Every CIDR block of the VPC has a local route
+				netinfo.VPC = append(netinfo.VPC, *network)
+			}
+		} else if route.DestinationIpv6CidrBlock != nil {
+			_, network, err := net.ParseCIDR(*route.DestinationIpv6CidrBlock)
+
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing IPv6 CIDR block %s on route table %s: %w", *route.DestinationIpv6CidrBlock, *tables.RouteTables[0].RouteTableId, err)
+			}
+
+			if route.VpcPeeringConnectionId != nil {
+				netinfo.SubnetsIPv6[*route.VpcPeeringConnectionId] = append(netinfo.SubnetsIPv6[*route.VpcPeeringConnectionId], *network)
+			} else if route.NatGatewayId != nil {
+				// NAT64 through a NAT gateway
+				netinfo.NAT = append(netinfo.NAT, *network)
+			} else if aws.StringValue(route.GatewayId) == "local" {
+				netinfo.VPC = append(netinfo.VPC, *network)
 			}
 		}
 
@@ -250,6 +384,39 @@ func (c *AWSConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 	return &netinfo, nil
 }
 
+// LookupVariable provides the aws:region, aws:vpc-id, aws:vpc-cidr and aws:subnet-id variables
+func (c *AWSConfig) LookupVariable(name string) (string, bool, error) {
+	switch name {
+	case "aws:region":
+		return c.region, true, nil
+	case "aws:vpc-id":
+		return c.vpcId, true, nil
+	case "aws:subnet-id":
+		return c.subnetId, true, nil
+	case "aws:vpc-cidr":
+		c.vpcLock.Lock()
+		defer c.vpcLock.Unlock()
+
+		if c.vpcCidr == "" {
+			out, err := c.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{VpcIds: []*string{aws.String(c.vpcId)}})
+
+			if err != nil {
+				return "", false, fmt.Errorf("Error describing VPC %s: %w", c.vpcId, throttled(err))
+			}
+
+			if len(out.Vpcs) == 0 || out.Vpcs[0].CidrBlock == nil {
+				return "", false, fmt.Errorf("VPC %s not found", c.vpcId)
+			}
+
+			c.vpcCidr = *out.Vpcs[0].CidrBlock
+		}
+
+		return c.vpcCidr, true, nil
+	}
+
+	return "", false, nil
+}
+
 func (c *AWSConfig) FetchGroup(name string) ([]string, error) {
 	var users []string
 
@@ -276,7 +443,7 @@ func (c *AWSConfig) FetchGroup(name string) ([]string, error) {
 		if isError(err, iam.ErrCodeNoSuchEntityException) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("Error retrieving group %s: %w", name, err)
+		return nil, fmt.Errorf("Error retrieving group %s: %w", name, throttled(err))
 	}
 
 	return users, nil
@@ -307,7 +474,7 @@ func (c *AWSConfig) FetchGroupsForUser(user string) ([]string, error) {
 		if isError(err, iam.ErrCodeNoSuchEntityException) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("Error retrieving groups for user %s: %w", user, err)
+		return nil, fmt.Errorf("Error retrieving groups for user %s: %w", user, throttled(err))
 	}
 
 	return groups, nil
@@ -339,7 +506,7 @@ func (c *AWSConfig) FetchKeys(user string) ([]string, error) {
 		if isError(err, iam.ErrCodeNoSuchEntityException) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("Error retrieving keys for user %s: %w", user, err)
+		return nil, fmt.Errorf("Error retrieving keys for user %s: %w", user, throttled(err))
 	}
 
 	return keys, err
@@ -352,7 +519,7 @@ func (c *AWSConfig) FetchKey(user, alias string) ([]byte, error) {
 		if isError(err, iam.ErrCodeNoSuchEntityException) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("Error retrieving key %s for user %s: %w", user, alias, err)
+		return nil, fmt.Errorf("Error retrieving key %s for user %s: %w", alias, user, throttled(err))
 	}
 
 	return []byte(*out.SSHPublicKey.SSHPublicKeyBody), err
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// AWSLimits control the rate of requests to AWS
+type AWSLimits struct {
+	Rate    int // Requests per second, 0 for no limit
+	Burst   int // Requests sent without waiting after a quiet period
+	Retries int // Retries of a failed or throttled request
+	Budget  int // IAM lookups per reload, 0 for no limit. Lookups outside of reloads are only rate limited.
+}
+
+// DefaultAWSLimits keep well below the IAM request quota
+var DefaultAWSLimits = AWSLimits{Rate: 10, Burst: 20, Retries: 8}
+
+const (
+	awsRetryDelay    = 100 * time.Millisecond // Initial backoff of a failed request
+	awsThrottleDelay = time.Second            // Initial backoff of a throttled request
+	awsMaxDelay      = 20 * time.Second       // Maximum backoff
+)
+
+// awsLimiter is shared by the requests of an AWSConfig. It is a token bucket, paused for all requests while one backs
+// off from throttling, and counts IAM lookups against the budget of the current reload.
+type awsLimiter struct {
+	limits AWSLimits
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+	paused time.Time // No request is sent before paused
+	spent  int
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newAWSLimiter(limits AWSLimits) *awsLimiter {
+	return &awsLimiter{limits: limits, tokens: float64(limits.Burst), last: time.Now(), now: time.Now, sleep: time.Sleep}
+}
+
+// wait blocks until a request may be sent
+func (l *awsLimiter) wait() {
+	l.lock.Lock()
+	now := l.now()
+	var delay time.Duration
+
+	if l.limits.Rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limits.Rate)
+
+		if burst := float64(l.limits.Burst); l.tokens > burst {
+			l.tokens = burst
+		}
+
+		l.last = now
+		l.tokens--
+
+		// A negative balance is the queue of requests waiting for a token
+		if l.tokens < 0 {
+			delay = time.Duration(-l.tokens / float64(l.limits.Rate) * float64(time.Second))
+		}
+	}
+
+	if pause := l.paused.Sub(now); pause > delay {
+		delay = pause
+	}
+
+	l.lock.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// pause holds back all requests for delay
+func (l *awsLimiter) pause(delay time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if until := l.now().Add(delay); until.After(l.paused) {
+		l.paused = until
+	}
+}
+
+// spend counts a lookup of a reload against the budget, returning an error wrapping ErrThrottled if the budget is spent
+func (l *awsLimiter) spend() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limits.Budget == 0 {
+		return nil
+	}
+
+	if l.spent == l.limits.Budget {
+		return fmt.Errorf("%w: budget of %d requests for this reload is spent", ErrThrottled, l.limits.Budget)
+	}
+
+	l.spent++
+
+	if l.spent == l.limits.Budget {
+		logger.Warnf("Request budget of %d spent, further IAM lookups wait for the next reload", l.limits.Budget)
+	}
+
+	return nil
+}
+
+// reset restores the budget at the start of a reload
+func (l *awsLimiter) reset() {
+	l.lock.Lock()
+	l.spent = 0
+	l.lock.Unlock()
+}
+
+// awsReloadView is the view of an AWSConfig used by reloads, its IAM lookups are counted against the budget
+type awsReloadView struct {
+	*AWSConfig
+}
+
+func (c *awsReloadView) FetchGroup(name string) ([]string, error) {
+	if err := c.limiter.spend(); err != nil {
+		return nil, fmt.Errorf("Error retrieving group %s: %w", name, err)
+	}
+
+	return c.AWSConfig.FetchGroup(name)
+}
+
+func (c *awsReloadView) FetchGroupsForUser(user string) ([]string, error) {
+	if err := c.limiter.spend(); err != nil {
+		return nil, fmt.Errorf("Error retrieving groups for user %s: %w", user, err)
+	}
+
+	return c.AWSConfig.FetchGroupsForUser(user)
+}
+
+func (c *awsReloadView) FetchKeys(user string) ([]string, error) {
+	if err := c.limiter.spend(); err != nil {
+		return nil, fmt.Errorf("Error retrieving keys for user %s: %w", user, err)
+	}
+
+	return c.AWSConfig.FetchKeys(user)
+}
+
+func (c *awsReloadView) FetchKey(user, alias string) ([]byte, error) {
+	if err := c.limiter.spend(); err != nil {
+		return nil, fmt.Errorf("Error retrieving key %s for user %s: %w", alias, user, err)
+	}
+
+	return c.AWSConfig.FetchKey(user, alias)
+}
+
+// throttled wraps ErrThrottled around an error caused by throttling
+func throttled(err error) error {
+	if request.IsErrorThrottle(err) {
+		return fmt.Errorf("%w: %s", ErrThrottled, err)
+	}
+
+	return err
+}
+
+// awsRetryer retries requests with jittered exponential backoff, pausing the limiter when a request is throttled
+type awsRetryer struct {
+	client.DefaultRetryer
+	limiter *awsLimiter
+}
+
+func (r awsRetryer) RetryRules(req *request.Request) time.Duration {
+	if req.IsErrorThrottle() {
+		delay := backoff(awsThrottleDelay, req.RetryCount)
+		r.limiter.pause(delay)
+		return delay
+	}
+
+	return backoff(awsRetryDelay, req.RetryCount)
+}
+
+// backoff returns a random delay of up to initial doubled for each retry, and at most awsMaxDelay
+func backoff(initial time.Duration, retry int) time.Duration {
+	ceiling := awsMaxDelay
+
+	if retry < 16 && initial<<uint(retry) < ceiling {
+		ceiling = initial << uint(retry)
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling))) + 1
+}
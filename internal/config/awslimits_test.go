@@ -0,0 +1,199 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// newTestLimiter returns a limiter whose clock only moves when it sleeps, recording each delay
+func newTestLimiter(limits AWSLimits, delays *[]time.Duration) *awsLimiter {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	limiter := newAWSLimiter(limits)
+	limiter.last = now
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(delay time.Duration) {
+		*delays = append(*delays, delay)
+	}
+
+	return limiter
+}
+
+func TestLimiterWait(t *testing.T) {
+	var delays []time.Duration
+	limiter := newTestLimiter(AWSLimits{Rate: 10, Burst: 2}, &delays)
+	start := limiter.now()
+
+	// The burst is sent without waiting, then requests queue for a token each
+	for i := 0; i < 4; i++ {
+		limiter.wait()
+	}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+
+	if len(delays) != len(expected) || delays[0] != expected[0] || delays[1] != expected[1] {
+		t.Errorf("Delays = %v, expected %v", delays, expected)
+	}
+
+	// Tokens are earned back at the rate, up to the burst
+	delays = nil
+	limiter.now = func() time.Time { return start.Add(time.Minute) }
+
+	for i := 0; i < 3; i++ {
+		limiter.wait()
+	}
+
+	if len(delays) != 1 || delays[0] != 100*time.Millisecond {
+		t.Errorf("Delays after a quiet period = %v, expected [100ms]", delays)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	var delays []time.Duration
+	limiter := newTestLimiter(AWSLimits{}, &delays)
+
+	for i := 0; i < 100; i++ {
+		limiter.wait()
+	}
+
+	if len(delays) != 0 {
+		t.Errorf("Expected no delays without a rate, got %v", delays)
+	}
+}
+
+func TestLimiterPause(t *testing.T) {
+	var delays []time.Duration
+	limiter := newTestLimiter(AWSLimits{Rate: 10, Burst: 20}, &delays)
+
+	limiter.pause(3 * time.Second)
+	limiter.pause(time.Second)
+	limiter.wait()
+
+	// A shorter pause does not end a longer one
+	if len(delays) != 1 || delays[0] != 3*time.Second {
+		t.Errorf("Delays = %v, expected [3s]", delays)
+	}
+}
+
+func TestLimiterBudget(t *testing.T) {
+	var delays []time.Duration
+	limiter := newTestLimiter(AWSLimits{Budget: 2}, &delays)
+
+	limiter.reset()
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.spend(); err != nil {
+			t.Fatalf("Error spending lookup %d: %s", i+1, err)
+		}
+	}
+
+	if err := limiter.spend(); !errors.Is(err, ErrThrottled) {
+		t.Errorf("Expected the spent budget to throttle, got %v", err)
+	}
+
+	limiter.reset()
+
+	if err := limiter.spend(); err != nil {
+		t.Errorf("Expected the budget to be restored by a reload, got %s", err)
+	}
+}
+
+func TestAWSConfigReloadBudget(t *testing.T) {
+	var delays []time.Duration
+	config := &AWSConfig{limiter: newTestLimiter(AWSLimits{Budget: 1}, &delays)}
+	view := ReloadBackend(config)
+
+	if view == ConfigurationBackend(config) {
+		t.Fatalf("Expected a reload view with a budget")
+	}
+
+	BeginReload(config)
+	config.limiter.spend()
+
+	// The budget is checked before IAM is called
+	if _, err := view.FetchKeys("joe"); !errors.Is(err, ErrThrottled) {
+		t.Errorf("Expected the budget to be spent, got %v", err)
+	}
+
+	EndReload(config)
+	BeginReload(config)
+
+	if err := config.limiter.spend(); err != nil {
+		t.Errorf("Expected BeginReload to restore the budget, got %s", err)
+	}
+
+	// Without a budget, reloads use the backend itself
+	unlimited := &AWSConfig{limiter: newTestLimiter(AWSLimits{}, &delays)}
+
+	if ReloadBackend(unlimited) != ConfigurationBackend(unlimited) {
+		t.Errorf("Expected no reload view without a budget")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, test := range []struct {
+		initial time.Duration
+		retry   int
+		ceiling time.Duration
+	}{
+		{100 * time.Millisecond, 0, 100 * time.Millisecond},
+		{100 * time.Millisecond, 3, 800 * time.Millisecond},
+		{time.Second, 4, 16 * time.Second},
+		{time.Second, 5, awsMaxDelay},
+		{time.Second, 40, awsMaxDelay},
+	} {
+		var max time.Duration
+
+		for i := 0; i < 1000; i++ {
+			delay := backoff(test.initial, test.retry)
+
+			if delay < 1 || delay > test.ceiling {
+				t.Fatalf("backoff(%s, %d) = %s, expected up to %s", test.initial, test.retry, delay, test.ceiling)
+			}
+
+			if delay > max {
+				max = delay
+			}
+		}
+
+		// The delays are spread up to the ceiling
+		if max < test.ceiling/2 {
+			t.Errorf("backoff(%s, %d) never exceeded %s, expected delays up to %s", test.initial, test.retry, max, test.ceiling)
+		}
+	}
+}
+
+func TestRetryRules(t *testing.T) {
+	var delays []time.Duration
+	limiter := newTestLimiter(AWSLimits{Rate: 10, Burst: 20}, &delays)
+	retryer := awsRetryer{limiter: limiter}
+
+	failed := &request.Request{Error: awserr.New("InternalFailure", "Internal error", nil), RetryCount: 2}
+
+	if delay := retryer.RetryRules(failed); delay < 1 || delay > 4*awsRetryDelay {
+		t.Errorf("Retry delay of a failed request = %s, expected up to %s", delay, 4*awsRetryDelay)
+	}
+
+	limiter.wait()
+
+	if len(delays) != 0 {
+		t.Errorf("Expected a failed request not to hold back others, got %v", delays)
+	}
+
+	throttledReq := &request.Request{Error: awserr.New("Throttling", "Rate exceeded", nil), RetryCount: 2}
+	delay := retryer.RetryRules(throttledReq)
+
+	if delay < 1 || delay > 4*awsThrottleDelay {
+		t.Errorf("Retry delay of a throttled request = %s, expected up to %s", delay, 4*awsThrottleDelay)
+	}
+
+	// Other requests are held back until the throttled request is retried
+	limiter.wait()
+
+	if len(delays) != 1 || delays[0] != delay {
+		t.Errorf("Delays = %v, expected [%s]", delays, delay)
+	}
+}
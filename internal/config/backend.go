@@ -1,23 +1,132 @@
 package config
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sort"
 )
 
+// ErrThrottled is wrapped by the errors of requests that a backend did not make because of rate limits. The request may
+// succeed in a later reload, so the previous result can be kept meanwhile.
+var ErrThrottled = errors.New("Request throttled")
+
 type NetworkInfo struct {
-	Subnets map[string]net.IPNet
-	NAT     []net.IPNet
+	VPC         []net.IPNet // CIDR blocks of the VPC
+	Subnets     map[string]net.IPNet
+	SubnetsIPv6 map[string][]net.IPNet       // IPv6 CIDR blocks of each subnet, by subnet id
+	SubnetTags  map[string]map[string]string // Tags of each subnet, by subnet id
+	NAT         []net.IPNet
+}
+
+// subnetNetworks returns the IPv4 and IPv6 networks of a subnet or peering connection, or nil if it does not exist
+func (netinfo *NetworkInfo) subnetNetworks(id string) []net.IPNet {
+	var rv []net.IPNet
+
+	if network, exists := netinfo.Subnets[id]; exists {
+		rv = append(rv, network)
+	}
+
+	return append(rv, netinfo.SubnetsIPv6[id]...)
+}
+
+// privateNetworks are the IPv4 private, IPv4 link-local and IPv6 unique local ranges, the link-local range includes the
+// instance metadata service
+var privateNetworks = []net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(172, 16, 0, 0).To4(), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+	{IP: net.IPv4(169, 254, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+	{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)},
 }
 
+// PrivateNetworks returns the networks that a full tunnel must not reach unless a route allows them: the VPC, its subnets
+// and peering connections, the networks behind NAT gateways and the private ranges. The order is the same on every call.
+func (netinfo *NetworkInfo) PrivateNetworks() []net.IPNet {
+	rv := append([]net.IPNet{}, netinfo.VPC...)
+
+	ids := make([]string, 0, len(netinfo.Subnets)+len(netinfo.SubnetsIPv6))
+
+	for id := range netinfo.Subnets {
+		ids = append(ids, id)
+	}
+
+	for id := range netinfo.SubnetsIPv6 {
+		if _, exists := netinfo.Subnets[id]; !exists {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		rv = append(rv, netinfo.subnetNetworks(id)...)
+	}
+
+	rv = append(rv, netinfo.NAT...)
+
+	return append(rv, privateNetworks...)
+}
+
+// ConfigurationBackend provides the configuration files, users, groups and keys. Something that does not exist is not an
+// error, the methods return nil values instead. The conformance package checks that a backend follows these rules.
 type ConfigurationBackend interface {
+	// FetchFile returns the file and its tag, which changes whenever the file changes. If the tag is ifNotTag, the reader
+	// is nil. If the file does not exist, the reader and the tag are empty.
 	FetchFile(path string, ifNotTag string) (reader io.ReadCloser, tag string, err error)
+	// ListFiles returns the paths of the files matching a pattern, as in path.Match
+	ListFiles(pattern string) ([]string, error)
+	// PutFile creates or replaces a file along with any parent directories, the file then has exactly data and a new tag
 	PutFile(path string, data []byte) error
+	// FetchNetworkInfo never returns nil without an error
 	FetchNetworkInfo() (*NetworkInfo, error)
+	// FetchGroup returns the members of a group, or nil if it does not exist
 	FetchGroup(name string) ([]string, error)
+	// FetchGroupsForUser returns the groups a user is a member of
 	FetchGroupsForUser(user string) ([]string, error)
+	// FetchKeys returns the key ids of a user, or nil if the user does not exist. A user without keys has an empty list.
 	FetchKeys(user string) ([]string, error)
+	// FetchKey returns a public key of a user, or nil if it does not exist
 	FetchKey(user, key string) ([]byte, error)
 	RegisterDNS(zone, name string, weighted bool) error
 	UnregisterDNS() error
 }
+
+// ReloadListener is implemented by backends that track each reload of the users, groups and keys
+type ReloadListener interface {
+	// BeginReload is called before the users, groups and keys of a reload are fetched
+	BeginReload()
+	// EndReload is called once the users, groups and keys of a reload have been fetched, whether or not it succeeded
+	EndReload()
+}
+
+// BeginReload notifies backend that a reload begins, if it is a ReloadListener
+func BeginReload(backend ConfigurationBackend) {
+	if listener, ok := backend.(ReloadListener); ok {
+		listener.BeginReload()
+	}
+}
+
+// EndReload notifies backend that a reload has ended, if it is a ReloadListener
+func EndReload(backend ConfigurationBackend) {
+	if listener, ok := backend.(ReloadListener); ok {
+		listener.EndReload()
+	}
+}
+
+// BudgetedBackend is implemented by backends that cap the lookups of a reload. Only the lookups made through the view
+// returned by ReloadBackend count against the budget, so that other lookups, such as those of connecting users, are not
+// refused because a reload spent it.
+type BudgetedBackend interface {
+	// ReloadBackend returns the view of the backend used to fetch the users, groups and keys of a reload
+	ReloadBackend() ConfigurationBackend
+}
+
+// ReloadBackend returns the view of backend used by reloads if it is a BudgetedBackend, otherwise backend itself
+func ReloadBackend(backend ConfigurationBackend) ConfigurationBackend {
+	if budgeted, ok := backend.(BudgetedBackend); ok {
+		return budgeted.ReloadBackend()
+	}
+
+	return backend
+}
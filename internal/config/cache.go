@@ -0,0 +1,307 @@
+package config
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amadigan/openvpn-aws/internal/log"
+)
+
+var cacheLogger = log.New("cache")
+
+// CachedConfig wraps a backend, keeping the last known keys, groups and network info in a file. While the backend fails,
+// they are served from the file for a grace period after they were last fetched, so that users can still connect.
+type CachedConfig struct {
+	backend ConfigurationBackend
+	*cacheFile
+}
+
+// cacheFile holds the entries of a CachedConfig, which are shared with its view for reloads
+type cacheFile struct {
+	path    string
+	grace   time.Duration
+	now     func() time.Time
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+	dirty   bool // The entries changed since the cache was written
+}
+
+// cacheEntry is the result of a successful request to the backend
+type cacheEntry struct {
+	Fetched time.Time
+	Value   json.RawMessage
+}
+
+// NewCachedConfig wraps backend with a cache kept in path. A cache that cannot be read, or fails its integrity check, is
+// logged and discarded.
+func NewCachedConfig(backend ConfigurationBackend, path string, grace time.Duration) *CachedConfig {
+	c := &CachedConfig{
+		backend: backend,
+		cacheFile: &cacheFile{
+			path:    path,
+			grace:   grace,
+			now:     time.Now,
+			entries: make(map[string]cacheEntry),
+		},
+	}
+
+	entries, err := readCache(path)
+
+	if err != nil {
+		cacheLogger.Errorf("Discarding cache %s: %s", path, err)
+	} else if entries != nil {
+		c.entries = entries
+		cacheLogger.Infof("Loaded %d cached entries from %s", len(entries), path)
+	}
+
+	return c
+}
+
+// readCache reads a cache file, which is the SHA-256 of the entries followed by the entries as JSON. It returns nil if
+// the file does not exist.
+func readCache(path string) (map[string]cacheEntry, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	checksum, err := reader.ReadString('\n')
+
+	if err != nil {
+		return nil, fmt.Errorf("Missing checksum: %w", err)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+
+	if strings.TrimSpace(checksum) != "sha256 "+hex.EncodeToString(hash[:]) {
+		return nil, errors.New("Checksum does not match")
+	}
+
+	var entries map[string]cacheEntry
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// save writes the cache if it changed since it was last written. It must be called with the lock held.
+func (c *CachedConfig) save() {
+	if !c.dirty {
+		return
+	}
+
+	data, err := json.Marshal(c.entries)
+
+	if err == nil {
+		hash := sha256.Sum256(data)
+		data = append([]byte("sha256 "+hex.EncodeToString(hash[:])+"\n"), data...)
+		err = WriteFileAtomic(c.path, data)
+	}
+
+	if err != nil {
+		cacheLogger.Warnf("Unable to save cache: %s", err)
+		return
+	}
+
+	c.dirty = false
+}
+
+// store caches the result of a successful request, a result that does not exist removes the entry. The cache is written
+// when the reload ends.
+func (c *CachedConfig) store(key string, value interface{}, exists bool) {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		cacheLogger.Warnf("Error caching %s: %s", key, err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, cached := c.entries[key]; !exists {
+		if cached {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+
+		return
+	}
+
+	// The fetch time changes even when the value does not
+	c.entries[key] = cacheEntry{Fetched: c.now(), Value: data}
+	c.dirty = true
+}
+
+// load decodes the cached result of a request that failed with err into value. It returns false if there is no result,
+// the result is older than the grace period, or the request was throttled. A throttled request is not an outage, its
+// error is returned unchanged so that the previous results of the running server are kept.
+func (c *CachedConfig) load(key string, value interface{}, err error) bool {
+	if errors.Is(err, ErrThrottled) {
+		return false
+	}
+
+	c.lock.Lock()
+	entry, cached := c.entries[key]
+	now := c.now()
+	c.lock.Unlock()
+
+	if !cached {
+		cacheLogger.Errorf("Backend failed and %s is not cached: %s", key, err)
+		return false
+	}
+
+	age := now.Sub(entry.Fetched).Truncate(time.Second)
+
+	if age > c.grace {
+		cacheLogger.Errorf("Backend failed and cached %s is %s old, older than the grace period of %s: %s", key, age, c.grace, err)
+		return false
+	}
+
+	if decodeErr := json.Unmarshal(entry.Value, value); decodeErr != nil {
+		cacheLogger.Errorf("Error decoding cached %s: %s", key, decodeErr)
+		return false
+	}
+
+	cacheLogger.Warnf("Backend failed, using STALE %s fetched %s ago: %s", key, age, err)
+
+	return true
+}
+
+func (c *CachedConfig) FetchNetworkInfo() (*NetworkInfo, error) {
+	netinfo, err := c.backend.FetchNetworkInfo()
+
+	if err == nil {
+		c.store("netinfo", netinfo, netinfo != nil)
+	} else if cached := (*NetworkInfo)(nil); c.load("netinfo", &cached, err) {
+		return cached, nil
+	}
+
+	return netinfo, err
+}
+
+func (c *CachedConfig) FetchGroup(name string) ([]string, error) {
+	members, err := c.backend.FetchGroup(name)
+
+	if err == nil {
+		c.store("group "+name, members, members != nil)
+	} else if c.load("group "+name, &members, err) {
+		return members, nil
+	}
+
+	return members, err
+}
+
+func (c *CachedConfig) FetchGroupsForUser(user string) ([]string, error) {
+	groups, err := c.backend.FetchGroupsForUser(user)
+
+	if err == nil {
+		// A user without groups is cached, as the user may still have access of their own
+		c.store("groups of "+user, groups, true)
+	} else if c.load("groups of "+user, &groups, err) {
+		return groups, nil
+	}
+
+	return groups, err
+}
+
+func (c *CachedConfig) FetchKeys(user string) ([]string, error) {
+	keys, err := c.backend.FetchKeys(user)
+
+	if err == nil {
+		c.store("keys of "+user, keys, keys != nil)
+	} else if c.load("keys of "+user, &keys, err) {
+		return keys, nil
+	}
+
+	return keys, err
+}
+
+func (c *CachedConfig) FetchKey(user, key string) ([]byte, error) {
+	data, err := c.backend.FetchKey(user, key)
+
+	if err == nil {
+		c.store("key "+key+" of "+user, data, data != nil)
+	} else if c.load("key "+key+" of "+user, &data, err) {
+		return data, nil
+	}
+
+	return data, err
+}
+
+func (c *CachedConfig) FetchFile(path string, ifNotTag string) (io.ReadCloser, string, error) {
+	return c.backend.FetchFile(path, ifNotTag)
+}
+
+func (c *CachedConfig) ListFiles(pattern string) ([]string, error) {
+	return c.backend.ListFiles(pattern)
+}
+
+func (c *CachedConfig) PutFile(path string, data []byte) error {
+	return c.backend.PutFile(path, data)
+}
+
+func (c *CachedConfig) RegisterDNS(zone, name string, weighted bool) error {
+	return c.backend.RegisterDNS(zone, name, weighted)
+}
+
+func (c *CachedConfig) UnregisterDNS() error {
+	return c.backend.UnregisterDNS()
+}
+
+// LookupVariable provides the variables of the wrapped backend
+func (c *CachedConfig) LookupVariable(name string) (string, bool, error) {
+	if resolver, ok := c.backend.(VariableResolver); ok {
+		return resolver.LookupVariable(name)
+	}
+
+	return "", false, nil
+}
+
+// ReloadBackend returns a view caching the results of the reload view of the wrapped backend in the same entries
+func (c *CachedConfig) ReloadBackend() ConfigurationBackend {
+	if backend := ReloadBackend(c.backend); backend != c.backend {
+		return &CachedConfig{backend: backend, cacheFile: c.cacheFile}
+	}
+
+	return c
+}
+
+// BeginReload notifies the wrapped backend
+func (c *CachedConfig) BeginReload() {
+	BeginReload(c.backend)
+}
+
+// EndReload writes the results of the reload to the cache, along with any requests made since the last reload
+func (c *CachedConfig) EndReload() {
+	EndReload(c.backend)
+
+	c.lock.Lock()
+	c.save()
+	c.lock.Unlock()
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachedConfigSavesOncePerReload(t *testing.T) {
+	root, err := ioutil.TempDir("", "cache")
+
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "backend.cache")
+	backend := NewMemoryConfig()
+	cached := NewCachedConfig(backend, path, time.Hour)
+
+	backend.AddKey("joe", "laptop", []byte("key"))
+	backend.AddToGroup("admins", "joe", "ann")
+
+	BeginReload(cached)
+	cached.FetchGroup("admins")
+	cached.FetchKeys("joe")
+	cached.FetchKeys("ann")
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the cache to be written at the end of the reload, got %v", err)
+	}
+
+	EndReload(cached)
+
+	entries, err := readCache(path)
+
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected 3 cached entries, got %v, %v", entries, err)
+	}
+
+	// Nothing was fetched, so the cache is not written again
+	os.Remove(path)
+	BeginReload(cached)
+	EndReload(cached)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the cache not to be written without changes, got %v", err)
+	}
+
+	// The cache is used by the next server when the backend fails
+	BeginReload(cached)
+	cached.FetchKeys("joe")
+	EndReload(cached)
+
+	failure := errors.New("backend unreachable")
+	backend.Fail("FetchKeys", failure)
+	backend.Fail("FetchGroup", failure)
+	restarted := NewCachedConfig(backend, path, time.Hour)
+
+	if keys, err := restarted.FetchKeys("joe"); len(keys) != 1 || keys[0] != "laptop" || err != nil {
+		t.Errorf("Expected the cached keys of joe, got %q, %v", keys, err)
+	}
+
+	// Entries fetched by earlier reloads are written along with the changes
+	if members, err := restarted.FetchGroup("admins"); len(members) != 2 || err != nil {
+		t.Errorf("Expected the cached members of admins, got %q, %v", members, err)
+	}
+}
+
+func TestCachedConfigReloadBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	backend := NewMemoryConfig()
+	backend.AddUser("joe")
+	backend.AddKey("joe", "laptop", []byte("key"))
+	backend.SetBudget(1)
+
+	cached := NewCachedConfig(backend, filepath.Join(dir, "cache"), time.Hour)
+	reload := ReloadBackend(cached)
+
+	BeginReload(cached)
+
+	if keys, err := reload.FetchKeys("joe"); err != nil || len(keys) != 1 {
+		t.Fatalf("Expected the keys of joe, got %v, %v", keys, err)
+	}
+
+	// Lookups outside of the reload view are not counted
+	for i := 0; i < 3; i++ {
+		if _, err := cached.FetchGroupsForUser("joe"); err != nil {
+			t.Fatalf("Error fetching groups: %s", err)
+		}
+	}
+
+	EndReload(cached)
+
+	// The reload view shares the entries of the cache
+	backend.Fail("FetchKeys", errors.New("connection refused"))
+
+	if keys, err := cached.FetchKeys("joe"); err != nil || len(keys) != 1 {
+		t.Errorf("Expected the keys cached by the reload, got %v, %v", keys, err)
+	}
+}
+
+func TestCachedConfigThrottled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	backend := NewMemoryConfig()
+	backend.AddUser("joe")
+	backend.AddKey("joe", "laptop", []byte("key"))
+	backend.AddToGroup("devs", "joe")
+
+	cached := NewCachedConfig(backend, filepath.Join(dir, "cache"), time.Hour)
+	reload := ReloadBackend(cached)
+
+	BeginReload(cached)
+	reload.FetchKeys("joe")
+	reload.FetchGroup("devs")
+	EndReload(cached)
+
+	// Throttling is returned unchanged, even when a result is cached
+	backend.Fail("FetchKeys", fmt.Errorf("%w: Rate exceeded", ErrThrottled))
+
+	if keys, err := cached.FetchKeys("joe"); !errors.Is(err, ErrThrottled) || keys != nil {
+		t.Errorf("Expected FetchKeys to be throttled, got %v, %v", keys, err)
+	}
+
+	// As is a spent budget
+	backend.SetBudget(1)
+	BeginReload(cached)
+	reload.FetchGroupsForUser("joe")
+
+	if members, err := reload.FetchGroup("devs"); !errors.Is(err, ErrThrottled) || members != nil {
+		t.Errorf("Expected FetchGroup to be throttled, got %v, %v", members, err)
+	}
+
+	EndReload(cached)
+
+	// Other failures are served from the cache
+	backend.Fail("FetchKeys", errors.New("connection refused"))
+
+	if keys, err := cached.FetchKeys("joe"); err != nil || len(keys) != 1 {
+		t.Errorf("Expected the cached keys, got %v, %v", keys, err)
+	}
+}
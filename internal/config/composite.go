@@ -0,0 +1,249 @@
+package config
+
+import (
+	"io"
+	"strings"
+)
+
+// CompositeConfig routes each concern of ConfigurationBackend to a delegate, so that for example files are read from S3
+// while groups are read from an LDAP directory
+type CompositeConfig struct {
+	Files   ConfigurationBackend // FetchFile, ListFiles and PutFile
+	Network ConfigurationBackend // FetchNetworkInfo
+	Groups  ConfigurationBackend // FetchGroup and FetchGroupsForUser
+	Keys    ConfigurationBackend // FetchKeys and FetchKey
+	DNS     ConfigurationBackend // RegisterDNS and UnregisterDNS
+}
+
+// BackendSources name the source of each concern of a CompositeConfig. A source is an s3:// URL, a local path, an ldap://
+// or ldaps:// URL, or aws for the AWS services of the instance. An empty source is the source of the files.
+type BackendSources struct {
+	Files   string
+	Network string
+	Groups  string
+	Keys    string
+	DNS     string
+	LDAP    map[string]LDAPSettings // Settings of each LDAP source, by URL
+}
+
+// ParseBackendSources reads a bootstrap file naming the source of each concern. Each line is a concern followed by its
+// source, and an ldap section holds the settings of an LDAP source:
+//
+//	files s3://example-vpn/conf
+//	groups ldaps://ldap.example.com
+//
+//	ldap ldaps://ldap.example.com
+//	  user-base ou=people,dc=example,dc=com
+//
+// Environment variables are substituted as in vpn.conf.
+func ParseBackendSources(name string, reader io.Reader) (*BackendSources, error) {
+	parser := OpenFile(name, reader)
+	parser.SetVariables(NewVariableResolver(nil))
+
+	sources := &BackendSources{LDAP: make(map[string]LDAPSettings)}
+	var ldapSettings *LDAPSettings
+
+	for {
+		stmt, err := parser.Read()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ldapSettings != nil && (stmt == nil || stmt.Word == "") {
+			sources.LDAP[ldapSettings.URL] = *ldapSettings
+			ldapSettings = nil
+		}
+
+		if stmt == nil {
+			break
+		}
+
+		if stmt.Word != "" {
+			if stmt.SectionType != "ldap" {
+				return nil, stmt.Errorf("%s does not have settings", stmt.SectionType)
+			}
+
+			if err := parseLDAPSetting(ldapSettings, stmt); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		var source *string
+
+		switch stmt.SectionType {
+		case "files":
+			source = &sources.Files
+		case "network":
+			source = &sources.Network
+		case "groups":
+			source = &sources.Groups
+		case "keys":
+			source = &sources.Keys
+		case "dns":
+			source = &sources.DNS
+		case "ldap":
+			if _, exists := sources.LDAP[stmt.SectionName]; exists {
+				return nil, stmt.Errorf("ldap %s is defined more than once", stmt.SectionName)
+			}
+
+			ldapSettings = &LDAPSettings{URL: stmt.SectionName}
+			continue
+		default:
+			return nil, stmt.Errorf("unknown concern %s, must be files, network, groups, keys, dns or ldap", stmt.SectionType)
+		}
+
+		if *source != "" {
+			return nil, stmt.Errorf("%s is set more than once", stmt.SectionType)
+		}
+
+		*source = stmt.SectionName
+	}
+
+	return sources, nil
+}
+
+// parseLDAPSetting parses a statement of an ldap section of a bootstrap file
+func parseLDAPSetting(settings *LDAPSettings, stmt *ConfigStatement) error {
+	if stmt.Word == "starttls" {
+		if len(stmt.Fields) != 0 {
+			return stmt.Errorf("starttls does not have arguments")
+		}
+
+		settings.StartTLS = true
+		return nil
+	}
+
+	var setting *string
+
+	switch stmt.Word {
+	case "bind-dn":
+		setting = &settings.BindDN
+	case "bind-password":
+		setting = &settings.BindPassword
+	case "user-base":
+		setting = &settings.UserBase
+	case "user-filter":
+		setting = &settings.UserFilter
+	case "user-attribute":
+		setting = &settings.UserAttribute
+	case "key-attribute":
+		setting = &settings.KeyAttribute
+	case "group-base":
+		setting = &settings.GroupBase
+	case "group-filter":
+		setting = &settings.GroupFilter
+	case "group-attribute":
+		setting = &settings.GroupAttribute
+	case "member-attribute":
+		setting = &settings.MemberAttribute
+	default:
+		return stmt.Errorf("unknown ldap setting %s", stmt.Word)
+	}
+
+	if len(stmt.Fields) == 0 {
+		return stmt.Errorf("%s must have an argument", stmt.Word)
+	}
+
+	// DNs and filters may contain spaces
+	*setting = strings.Join(stmt.Fields, " ")
+
+	return nil
+}
+
+func (c *CompositeConfig) FetchFile(path string, ifNotTag string) (io.ReadCloser, string, error) {
+	return c.Files.FetchFile(path, ifNotTag)
+}
+
+func (c *CompositeConfig) ListFiles(pattern string) ([]string, error) {
+	return c.Files.ListFiles(pattern)
+}
+
+func (c *CompositeConfig) PutFile(path string, data []byte) error {
+	return c.Files.PutFile(path, data)
+}
+
+func (c *CompositeConfig) FetchNetworkInfo() (*NetworkInfo, error) {
+	return c.Network.FetchNetworkInfo()
+}
+
+func (c *CompositeConfig) FetchGroup(name string) ([]string, error) {
+	return c.Groups.FetchGroup(name)
+}
+
+func (c *CompositeConfig) FetchGroupsForUser(user string) ([]string, error) {
+	return c.Groups.FetchGroupsForUser(user)
+}
+
+func (c *CompositeConfig) FetchKeys(user string) ([]string, error) {
+	return c.Keys.FetchKeys(user)
+}
+
+func (c *CompositeConfig) FetchKey(user, key string) ([]byte, error) {
+	return c.Keys.FetchKey(user, key)
+}
+
+func (c *CompositeConfig) RegisterDNS(zone, name string, weighted bool) error {
+	return c.DNS.RegisterDNS(zone, name, weighted)
+}
+
+func (c *CompositeConfig) UnregisterDNS() error {
+	return c.DNS.UnregisterDNS()
+}
+
+// LookupVariable provides the variables of the first delegate that defines the variable
+func (c *CompositeConfig) LookupVariable(name string) (string, bool, error) {
+	for _, backend := range []ConfigurationBackend{c.Files, c.Network, c.Groups, c.Keys, c.DNS} {
+		if resolver, ok := backend.(VariableResolver); ok {
+			value, exists, err := resolver.LookupVariable(name)
+
+			if exists || err != nil {
+				return value, exists, err
+			}
+		}
+	}
+
+	return "", false, nil
+}
+
+// BeginReload notifies each delegate once
+func (c *CompositeConfig) BeginReload() {
+	c.eachDelegate(BeginReload)
+}
+
+// EndReload notifies each delegate once
+func (c *CompositeConfig) EndReload() {
+	c.eachDelegate(EndReload)
+}
+
+// ReloadBackend returns a composite of the reload views of the delegates
+func (c *CompositeConfig) ReloadBackend() ConfigurationBackend {
+	views := make(map[ConfigurationBackend]ConfigurationBackend)
+
+	view := func(backend ConfigurationBackend) ConfigurationBackend {
+		if backend == nil {
+			return nil
+		}
+
+		if _, exists := views[backend]; !exists {
+			views[backend] = ReloadBackend(backend)
+		}
+
+		return views[backend]
+	}
+
+	return &CompositeConfig{Files: view(c.Files), Network: view(c.Network), Groups: view(c.Groups), Keys: view(c.Keys), DNS: view(c.DNS)}
+}
+
+func (c *CompositeConfig) eachDelegate(notify func(backend ConfigurationBackend)) {
+	notified := make(map[ConfigurationBackend]bool)
+
+	for _, backend := range []ConfigurationBackend{c.Files, c.Network, c.Groups, c.Keys, c.DNS} {
+		if backend != nil && !notified[backend] {
+			notified[backend] = true
+			notify(backend)
+		}
+	}
+}
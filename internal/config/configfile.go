@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -12,6 +13,9 @@ import (
 
 type SectionType byte
 type ConfigFlag byte
+type Protocol byte
+type ConnectionPolicy byte
+type TunnelMode byte
 
 const (
 	GLOBAL = iota
@@ -26,47 +30,130 @@ const (
 	ALL     = 3
 )
 
+const (
+	TCP  = 1
+	UDP  = 2
+	ICMP = 3
+)
+
+const (
+	FULL  = 1 // All traffic of the client is sent through the VPN
+	SPLIT = 2 // Only traffic to the routes of the client is sent through the VPN
+)
+
+const (
+	EVICT  = 1 // Disconnect the oldest session to make room for a new one
+	REJECT = 2 // Refuse new sessions once the limit is reached
+)
+
+// Port is a protocol and an inclusive range of port numbers, a From of 0 matches every port of the protocol
+type Port struct {
+	Protocol Protocol
+	From     uint16
+	To       uint16
+}
+
 type Route struct {
 	Network net.IPNet
-	Ports   []uint16
+	Ports   []Port
+	Alias   string // Name of a network alias, used instead of Network and Ports
 }
 
 type Subnet struct {
 	Name  string
-	Ports []uint16
+	Ports []Port
 }
 
 type SectionConfig struct {
-	Type       SectionType
-	Name       string
-	Order      int
-	Subnets    []Subnet
-	Routes     []Route
-	NATRoutes  []Route
-	NATSetting ConfigFlag
-	DNSSetting ConfigFlag
+	Type            SectionType
+	Name            string
+	Order           int
+	Subnets         []Subnet
+	Routes          []Route
+	NATRoutes       []Route
+	DenyRoutes      []Route
+	DenySubnets     []Subnet
+	SubnetSelectors []SubnetSelector
+	DenySelectors   []SubnetSelector
+	NATSetting      ConfigFlag
+	DNSSetting      ConfigFlag
+	Schedules       []Schedule // The section only applies while one of these is active
+	Inherits        []string   // Groups applied before this section
+	MaxConnections  int        // 0 if not set
+	ConnectionLimit ConnectionPolicy
+	IP              net.IP     // Static tunnel address, only in user sections
+	IPPool          *net.IPNet // Tunnel addresses assigned to members, only in group sections
+	Bandwidth       *Bandwidth // nil if not set
+	DNSServers      []net.IP   // Replace the servers of earlier sections
+	DNSDomain       string
+	DNSSearch       []string // Added to the search domains of earlier sections
+	BlockOutsideDNS ConfigFlag
+	Tunnel          TunnelMode    // 0 if not set
+	SessionTimeout  time.Duration // 0 if not set
+	ReauthInterval  time.Duration // 0 if not set
 }
 
 type ConfigFile struct {
 	WatchTime       *time.Duration
 	Network         *net.IPNet
+	Network6        *net.IPNet // nil if the tunnel is IPv4 only
 	Route53Zone     string
 	DomainName      string
 	Route53Weighted bool
 	KeyStrength     int
+	Server          ServerSettings // Only the options set in the global section, see ServerOptions
 	GlobalConfig    *SectionConfig
 	Groups          map[string]*SectionConfig
 	Users           map[string]*SectionConfig
+	Networks        map[string]*NetworkAlias
+	Sources         map[string]string // Tag of each file read, by path
+	Includes        []string          // Include patterns, checked for new files
+	aliasRefs       []aliasReference
+	inheritRefs     []inheritReference
+	addressRefs     []addressReference
+	serverStmts     map[string]*ConfigStatement
+	validator       *validator // Only set when parsing in strict mode
+	formatting      bool       // Set by FormatConfig, include statements are kept rather than followed
+	includeStmts    []string
+	verbatim        map[string][]string // Statements containing variables or not understood by section header, only when formatting
+	variables       VariableResolver
+	comments        map[commentKey]*comments
+	trailer         []string // Comments following the last statement
+}
+
+// Bandwidth limits the traffic of each session in bits per second, 0 is unlimited
+type Bandwidth struct {
+	Down uint64 // Traffic sent to the client
+	Up   uint64 // Traffic sent by the client
 }
 
 type UserRoute struct {
 	Network net.IPNet
-	Ports   []uint16
+	Ports   []Port
 }
 
 type UserConfig struct {
-	DNSSetting ConfigFlag
-	Routes     []UserRoute
+	DNSSetting      ConfigFlag
+	NATSetting      ConfigFlag // ALL, ON for the listed nat routes only, or OFF
+	Routes          []UserRoute
+	Denies          []UserRoute // Enforced by the firewall ahead of Routes
+	MaxConnections  int         // Simultaneous sessions permitted, at least 1
+	ConnectionLimit ConnectionPolicy
+	IP              net.IP     // Static tunnel address, nil if not set
+	IPPool          *net.IPNet // Pool to assign a tunnel address from if IP is not set, nil if the address is dynamic
+	Bandwidth       Bandwidth
+	DNSServers      []net.IP // Pushed instead of the tunnel's DNS proxy
+	DNSDomain       string
+	DNSSearch       []string
+	BlockOutsideDNS bool          // Block DNS servers on other interfaces of Windows clients
+	FullTunnel      bool          // Send all traffic through the VPN, Denies then include every denied network
+	SessionTimeout  time.Duration // Maximum length of a session, 0 for unlimited
+	ReauthInterval  time.Duration // Time between checks of the user's key and access, 0 for never
+}
+
+type routePorts struct {
+	all   bool // true if any rule allows all traffic to the network
+	ports []Port
 }
 
 type networkKey struct {
@@ -75,50 +162,123 @@ type networkKey struct {
 	mask int // Bits of the mask
 }
 
-func (config *ConfigFile) GetUserConfig(user string, groups []string, netinfo *NetworkInfo) (*UserConfig, error) {
+// GetUserConfig builds the effective configuration of a user at the given time
+func (config *ConfigFile) GetUserConfig(user string, groups []string, netinfo *NetworkInfo, now time.Time) (*UserConfig, error) {
 	var dns ConfigFlag
 	allSubnets := true
 	sections := make([]*SectionConfig, 1, len(groups)+2)
+	scheduled := false
 
 	sections[0] = config.GlobalConfig
 
-	for _, group := range groups {
-		groupConfig, exists := config.Groups[group]
+	memberOf := make([]*SectionConfig, 0, len(groups))
 
-		if exists {
-			sections = append(sections, groupConfig)
+	for _, group := range groups {
+		if groupConfig, exists := config.Groups[group]; exists {
+			memberOf = append(memberOf, groupConfig)
 		}
 	}
 
+	sort.Slice(memberOf, func(i int, j int) bool { return memberOf[i].Order < memberOf[j].Order })
+
+	added := make(map[*SectionConfig]bool, len(memberOf))
+
+	for _, groupConfig := range memberOf {
+		var skipped bool
+		sections, skipped = config.appendGroup(sections, groupConfig, now, added)
+		scheduled = scheduled || skipped
+	}
+
 	userConfig, exists := config.Users[user]
 
-	if !exists && len(sections) == 1 {
-		return nil, fmt.Errorf("User %s does not have access", user)
+	if exists && !sectionActive(userConfig, now) {
+		return nil, fmt.Errorf("User %s is %w", user, ErrOutsideSchedule)
 	}
 
-	sort.Slice(sections, func(i int, j int) bool {
-		if sections[i].Type != sections[j].Type {
-			return sections[i].Type < sections[j].Type
-		} else {
-			return sections[i].Order < sections[j].Order
+	if !exists && len(sections) == 1 {
+		if scheduled {
+			return nil, fmt.Errorf("User %s is %w", user, ErrOutsideSchedule)
 		}
-	})
+
+		return nil, fmt.Errorf("User %s does not have access", user)
+	}
 
 	if exists {
 		sections = append(sections, userConfig)
 	}
 
-	routes := make(map[networkKey]map[uint16]bool)
+	routes := make(map[networkKey]*routePorts)
 	var natRoutes []Route
+	var denies []networkPorts
 
 	var nat ConfigFlag
 	nat = ALL
 
+	maxConnections := 1
+	var connectionLimit ConnectionPolicy = EVICT
+	var ip net.IP
+	var ipPool *net.IPNet
+	var bandwidth Bandwidth
+	var dnsServers []net.IP
+	var dnsDomain string
+	var dnsSearch []string
+	var blockOutsideDNS ConfigFlag
+	var tunnel TunnelMode = SPLIT
+	var sessionTimeout, reauthInterval time.Duration
+
 	for _, section := range sections {
 		if section.DNSSetting != NOT_SET {
 			dns = section.DNSSetting
 		}
 
+		if section.MaxConnections != 0 {
+			maxConnections = section.MaxConnections
+			connectionLimit = section.ConnectionLimit
+		}
+
+		if section.IP != nil {
+			ip = section.IP
+		}
+
+		if section.IPPool != nil {
+			ipPool = section.IPPool
+		}
+
+		if section.Bandwidth != nil {
+			bandwidth = *section.Bandwidth
+		}
+
+		if len(section.DNSServers) != 0 {
+			dnsServers = section.DNSServers
+		}
+
+		if section.DNSDomain != "" {
+			dnsDomain = section.DNSDomain
+		}
+
+		for _, domain := range section.DNSSearch {
+			if !containsString(dnsSearch, domain) {
+				dnsSearch = append(dnsSearch, domain)
+			}
+		}
+
+		if section.BlockOutsideDNS != NOT_SET {
+			blockOutsideDNS = section.BlockOutsideDNS
+		}
+
+		if section.Tunnel != 0 {
+			tunnel = section.Tunnel
+		}
+
+		// The shortest limit of any section applies
+		if section.SessionTimeout != 0 && (sessionTimeout == 0 || section.SessionTimeout < sessionTimeout) {
+			sessionTimeout = section.SessionTimeout
+		}
+
+		if section.ReauthInterval != 0 && (reauthInterval == 0 || section.ReauthInterval < reauthInterval) {
+			reauthInterval = section.ReauthInterval
+		}
+
 		if section.NATSetting != NOT_SET {
 			nat = section.NATSetting
 		}
@@ -126,30 +286,40 @@ func (config *ConfigFile) GetUserConfig(user string, groups []string, netinfo *N
 		natRoutes = append(natRoutes, section.NATRoutes...)
 
 		for _, route := range section.Routes {
-			addRoute(route.Network, route.Ports, routes)
-			key := toNetworkKey(route.Network)
-			ports := routes[key]
-			if ports == nil {
-				ports = make(map[uint16]bool, len(route.Ports))
-				routes[key] = ports
-			}
-
-			for _, port := range route.Ports {
-				ports[port] = true
+			for _, expanded := range config.expandRoute(route, netinfo) {
+				addRoute(expanded.network, expanded.ports, routes)
 			}
 		}
 
-		if len(section.Subnets) != 0 {
+		if len(section.Subnets) != 0 || len(section.SubnetSelectors) != 0 || config.hasSubnets(section.Routes) {
 			allSubnets = false
 		}
 
-		for _, subnet := range section.Subnets {
-			network, exists := netinfo.Subnets[subnet.Name]
+		for _, selector := range section.SubnetSelectors {
+			for _, expanded := range selector.expand(netinfo) {
+				addRoute(expanded.network, expanded.ports, routes)
+			}
+		}
 
-			if exists {
+		for _, subnet := range section.Subnets {
+			for _, network := range netinfo.subnetNetworks(subnet.Name) {
 				addRoute(network, subnet.Ports, routes)
 			}
 		}
+
+		for _, route := range section.DenyRoutes {
+			denies = append(denies, config.expandRoute(route, netinfo)...)
+		}
+
+		for _, subnet := range section.DenySubnets {
+			for _, network := range netinfo.subnetNetworks(subnet.Name) {
+				denies = append(denies, networkPorts{network: network, ports: subnet.Ports})
+			}
+		}
+
+		for _, selector := range section.DenySelectors {
+			denies = append(denies, selector.expand(netinfo)...)
+		}
 	}
 
 	if nat != OFF {
@@ -160,7 +330,9 @@ func (config *ConfigFile) GetUserConfig(user string, groups []string, netinfo *N
 		}
 
 		for _, route := range natRoutes {
-			addRoute(route.Network, route.Ports, routes)
+			for _, expanded := range config.expandRoute(route, netinfo) {
+				addRoute(expanded.network, expanded.ports, routes)
+			}
 		}
 	}
 
@@ -168,24 +340,53 @@ func (config *ConfigFile) GetUserConfig(user string, groups []string, netinfo *N
 		for _, subnet := range netinfo.Subnets {
 			addRoute(subnet, nil, routes)
 		}
+
+		for _, networks := range netinfo.SubnetsIPv6 {
+			for _, network := range networks {
+				addRoute(network, nil, routes)
+			}
+		}
 	}
 
 	result := &UserConfig{
-		DNSSetting: dns,
-		Routes:     make([]UserRoute, 0, len(routes)),
+		DNSSetting:      dns,
+		NATSetting:      nat,
+		Denies:          applyDenies(routes, denies),
+		MaxConnections:  maxConnections,
+		ConnectionLimit: connectionLimit,
+		Bandwidth:       bandwidth,
+		DNSServers:      dnsServers,
+		DNSDomain:       dnsDomain,
+		DNSSearch:       dnsSearch,
+		BlockOutsideDNS: blockOutsideDNS == ON,
+		FullTunnel:      tunnel == FULL,
+		SessionTimeout:  sessionTimeout,
+		ReauthInterval:  reauthInterval,
+	}
+
+	if result.FullTunnel {
+		// Every deny must be enforced by the firewall, not only those overlapping a route
+		result.Denies = denyRoutes(denies)
+	}
+
+	if ip != nil {
+		// Only one session can hold a static address
+		result.IP = ip
+		result.MaxConnections = 1
+	} else {
+		result.IPPool = ipPool
 	}
 
+	result.Routes = make([]UserRoute, 0, len(routes))
+
 	for key, ports := range routes {
-		routePorts := make([]uint16, 0, len(ports))
+		route := UserRoute{Network: toIPNet(key)}
 
-		for port, _ := range ports {
-			routePorts = append(routePorts, port)
+		if !ports.all {
+			route.Ports = mergePorts(ports.ports)
 		}
 
-		result.Routes = append(result.Routes, UserRoute{
-			Network: toIPNet(key),
-			Ports:   routePorts,
-		})
+		result.Routes = append(result.Routes, route)
 	}
 
 	sort.Slice(result.Routes, func(i int, j int) bool { return result.Routes[i].Network.String() < result.Routes[j].Network.String() })
@@ -193,11 +394,12 @@ func (config *ConfigFile) GetUserConfig(user string, groups []string, netinfo *N
 	return result, nil
 }
 
-func (config *ConfigFile) String() string {
-	rv := config.GlobalConfig.String()
+// globalLines returns the settings of the global section that are not part of GlobalConfig
+func (config *ConfigFile) globalLines() []string {
+	var rv []string
 
-	if config.WatchTime != nil && config.WatchTime.Seconds() > 0 {
-		rv += fmt.Sprintf("\twatch %ds\n", int(config.WatchTime.Seconds()))
+	if config.WatchTime != nil {
+		rv = append(rv, fmt.Sprintf("watch %s", durationString(*config.WatchTime)))
 	}
 
 	if config.DomainName != "" {
@@ -205,60 +407,138 @@ func (config *ConfigFile) String() string {
 		if config.Route53Weighted {
 			mode = "weighted"
 		}
-		rv += fmt.Sprintf("\troute53 %s %s %s\n", config.Route53Zone, config.DomainName, mode)
+		rv = append(rv, fmt.Sprintf("route53 %s %s %s", config.Route53Zone, config.DomainName, mode))
 	}
 
 	if config.Network != nil {
-		rv += fmt.Sprintf("\tnet %s\n", config.Network.String())
+		rv = append(rv, fmt.Sprintf("net %s", config.Network.String()))
 	}
 
-	if config.KeyStrength != 0 {
-		rv += fmt.Sprintf("\tkey-strength %d\n", config.KeyStrength)
+	if config.Network6 != nil {
+		rv = append(rv, fmt.Sprintf("net6 %s", config.Network6.String()))
 	}
 
-	for _, section := range config.Groups {
-		rv += section.String()
+	if config.KeyStrength != 0 {
+		rv = append(rv, fmt.Sprintf("key-strength %d", config.KeyStrength))
 	}
 
-	for _, section := range config.Users {
-		rv += section.String()
+	return append(rv, config.Server.serverLines()...)
+}
+
+func (section *SectionConfig) String() string {
+	rv := section.header() + "\n"
+
+	for _, line := range section.lines() {
+		rv += "\t" + line + "\n"
 	}
 
 	return rv
 }
 
-func (section *SectionConfig) String() string {
-	var rv string
+func (section *SectionConfig) header() string {
 	switch section.Type {
-	case GLOBAL:
-		rv = "global\n"
-		break
 	case GROUP:
-		rv = fmt.Sprintf("group %s\n", section.Name)
-		break
+		return "group " + section.Name
 	case USER:
-		rv = fmt.Sprintf("user %s\n", section.Name)
-		break
+		return "user " + section.Name
+	default:
+		return "global"
+	}
+}
+
+// lines returns the statements of the section in canonical order, without indentation
+func (section *SectionConfig) lines() []string {
+	var rv []string
+
+	for _, group := range section.Inherits {
+		rv = append(rv, fmt.Sprintf("inherits %s", group))
 	}
 
 	if section.DNSSetting != NOT_SET {
-		rv += fmt.Sprintf("\tdns %s\n", section.DNSSetting.String())
+		rv = append(rv, fmt.Sprintf("dns %s", section.DNSSetting.String()))
+	}
+
+	for _, server := range section.DNSServers {
+		rv = append(rv, fmt.Sprintf("dns-server %s", server.String()))
+	}
+
+	if section.DNSDomain != "" {
+		rv = append(rv, fmt.Sprintf("dns-domain %s", section.DNSDomain))
+	}
+
+	for _, domain := range section.DNSSearch {
+		rv = append(rv, fmt.Sprintf("dns-search %s", domain))
+	}
+
+	if section.BlockOutsideDNS != NOT_SET {
+		rv = append(rv, fmt.Sprintf("block-outside-dns %s", section.BlockOutsideDNS.String()))
+	}
+
+	if section.IP != nil {
+		rv = append(rv, fmt.Sprintf("ip %s", section.IP.String()))
+	}
+
+	if section.IPPool != nil {
+		rv = append(rv, fmt.Sprintf("ip-pool %s", section.IPPool.String()))
+	}
+
+	if section.Tunnel != 0 {
+		rv = append(rv, fmt.Sprintf("tunnel %s", section.Tunnel.String()))
+	}
+
+	if section.SessionTimeout != 0 {
+		rv = append(rv, fmt.Sprintf("session-timeout %s", durationString(section.SessionTimeout)))
+	}
+
+	if section.ReauthInterval != 0 {
+		rv = append(rv, fmt.Sprintf("reauth-interval %s", durationString(section.ReauthInterval)))
+	}
+
+	if section.Bandwidth != nil {
+		rv = append(rv, fmt.Sprintf("bandwidth %s %s", rateString(section.Bandwidth.Down), rateString(section.Bandwidth.Up)))
+	}
+
+	if section.MaxConnections != 0 {
+		rv = append(rv, fmt.Sprintf("max-connections %d %s", section.MaxConnections, section.ConnectionLimit.String()))
 	}
 
-	if section.NATSetting == ON || section.NATSetting == OFF {
-		rv += fmt.Sprintf("\tnat %s\n", section.NATSetting.String())
+	for _, schedule := range section.Schedules {
+		rv = append(rv, fmt.Sprintf("schedule %s", schedule.String()))
 	}
 
 	for _, subnet := range section.Subnets {
-		rv += fmt.Sprintf("\t%s\n", subnet.String())
+		rv = append(rv, subnet.String())
+	}
+
+	for _, selector := range section.SubnetSelectors {
+		rv = append(rv, selector.String())
 	}
 
 	for _, nat := range section.NATRoutes {
-		rv += fmt.Sprintf("\tnat %s\n", nat.String())
+		rv = append(rv, fmt.Sprintf("nat %s", nat.String()))
+	}
+
+	// nat routes set ON, so the setting follows them to keep its effect when read back
+	if section.NATSetting == ALL {
+		rv = append(rv, "nat on")
+	} else if section.NATSetting == OFF {
+		rv = append(rv, "nat off")
 	}
 
 	for _, route := range section.Routes {
-		rv += fmt.Sprintf("\troute %s\n", route.String())
+		rv = append(rv, fmt.Sprintf("route %s", route.String()))
+	}
+
+	for _, subnet := range section.DenySubnets {
+		rv = append(rv, fmt.Sprintf("deny %s", subnet.String()))
+	}
+
+	for _, selector := range section.DenySelectors {
+		rv = append(rv, fmt.Sprintf("deny %s", selector.String()))
+	}
+
+	for _, route := range section.DenyRoutes {
+		rv = append(rv, fmt.Sprintf("deny %s", route.String()))
 	}
 
 	return rv
@@ -266,37 +546,94 @@ func (section *SectionConfig) String() string {
 
 func (subnet Subnet) String() string {
 	if len(subnet.Ports) == 0 {
-		return fmt.Sprintf("%s", subnet.Name)
+		return subnet.Name
 	} else {
-		ports := ""
-
-		for _, port := range subnet.Ports {
-			if ports != "" {
-				ports += " "
-			}
-
-			ports += strconv.Itoa(int(port))
-		}
-
-		return fmt.Sprintf("%s %s", subnet.Name, ports)
+		return fmt.Sprintf("%s %s", subnet.Name, portsString(subnet.Ports))
 	}
 }
 
 func (route Route) String() string {
-	if len(route.Ports) == 0 {
-		return fmt.Sprintf("%s", route.Network.String())
+	if route.Alias != "" {
+		return route.Alias
+	} else if len(route.Ports) == 0 {
+		return route.Network.String()
 	} else {
-		ports := ""
+		return fmt.Sprintf("%s %s", route.Network.String(), portsString(route.Ports))
+	}
+}
 
-		for _, port := range route.Ports {
-			if ports != "" {
-				ports += " "
-			}
+func (route UserRoute) String() string {
+	if len(route.Ports) == 0 {
+		return route.Network.String()
+	}
+
+	return fmt.Sprintf("%s %s", route.Network.String(), portsString(route.Ports))
+}
+
+func (port Port) String() string {
+	if port.From == 0 {
+		return port.Protocol.String()
+	}
+
+	rv := strconv.Itoa(int(port.From))
+
+	if port.To != port.From {
+		rv += "-" + strconv.Itoa(int(port.To))
+	}
+
+	if port.Protocol == TCP {
+		return rv
+	}
+
+	return port.Protocol.String() + "/" + rv
+}
+
+func portsString(ports []Port) string {
+	rv := ""
 
-			ports += strconv.Itoa(int(port))
+	for _, port := range ports {
+		if rv != "" {
+			rv += " "
 		}
 
-		return fmt.Sprintf("route %s %s", route.Network.String(), ports)
+		rv += port.String()
+	}
+
+	return rv
+}
+
+func (protocol Protocol) String() string {
+	switch protocol {
+	case TCP:
+		return "tcp"
+	case UDP:
+		return "udp"
+	case ICMP:
+		return "icmp"
+	default:
+		return ""
+	}
+}
+
+func (mode TunnelMode) String() string {
+	switch mode {
+	case FULL:
+		return "full"
+	case SPLIT:
+		return "split"
+	default:
+		return ""
+	}
+}
+
+func (policy ConnectionPolicy) String() string {
+	switch policy {
+	case EVICT:
+		return "evict"
+	case REJECT:
+		return "reject"
+	default:
+		return ""
 	}
 }
 
@@ -315,17 +652,58 @@ func (flag ConfigFlag) String() string {
 	}
 }
 
-func addRoute(network net.IPNet, ports []uint16, routes map[networkKey]map[uint16]bool) {
+func addRoute(network net.IPNet, ports []Port, routes map[networkKey]*routePorts) {
 	key := toNetworkKey(network)
 	currentPorts := routes[key]
 	if currentPorts == nil {
-		currentPorts = make(map[uint16]bool, len(ports))
+		currentPorts = new(routePorts)
 		routes[key] = currentPorts
 	}
 
-	for _, port := range ports {
-		currentPorts[port] = true
+	if len(ports) == 0 {
+		currentPorts.all = true
+	} else {
+		currentPorts.ports = append(currentPorts.ports, ports...)
+	}
+}
+
+// mergePorts sorts ports by protocol and start, combining overlapping and adjacent ranges
+func mergePorts(ports []Port) []Port {
+	sorted := make([]Port, len(ports))
+	copy(sorted, ports)
+
+	sort.Slice(sorted, func(i int, j int) bool {
+		if sorted[i].Protocol != sorted[j].Protocol {
+			return sorted[i].Protocol < sorted[j].Protocol
+		}
+		return sorted[i].From < sorted[j].From
+	})
+
+	merged := make([]Port, 0, len(sorted))
+
+	for _, port := range sorted {
+		if len(merged) != 0 {
+			last := &merged[len(merged)-1]
+
+			if last.Protocol == port.Protocol {
+				if last.From == 0 {
+					continue
+				} else if port.From == 0 {
+					*last = port
+					continue
+				} else if uint32(port.From) <= uint32(last.To)+1 {
+					if port.To > last.To {
+						last.To = port.To
+					}
+					continue
+				}
+			}
+		}
+
+		merged = append(merged, port)
 	}
+
+	return merged
 }
 
 func toNetworkKey(network net.IPNet) networkKey {
@@ -342,28 +720,158 @@ func toIPNet(network networkKey) (rv net.IPNet) {
 	return rv
 }
 
-func ParseConfig(reader io.Reader) (*ConfigFile, error) {
-	parser := Open(reader)
-
-	configFile := &ConfigFile{
+func newConfigFile() *ConfigFile {
+	return &ConfigFile{
 		GlobalConfig: &SectionConfig{
 			Type: GLOBAL,
 		},
-		Groups: make(map[string]*SectionConfig),
-		Users:  make(map[string]*SectionConfig),
+		Groups:   make(map[string]*SectionConfig),
+		Users:    make(map[string]*SectionConfig),
+		Networks: make(map[string]*NetworkAlias),
+		Sources:  make(map[string]string),
+		comments: make(map[commentKey]*comments),
+	}
+}
+
+// ParseConfig parses a single configuration file, include statements are not permitted
+func ParseConfig(reader io.Reader) (*ConfigFile, error) {
+	configFile := newConfigFile()
+	configFile.variables = NewVariableResolver(nil)
+
+	err := configFile.parse(configFile.open("config", reader), nil, nil)
+
+	if err == nil {
+		err = configFile.resolve()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return configFile, nil
+}
+
+// LoadConfig fetches and parses the configuration file at path along with every file it includes
+func LoadConfig(backend ConfigurationBackend, path string) (*ConfigFile, error) {
+	configFile := newConfigFile()
+	configFile.variables = NewVariableResolver(backend)
+
+	err := configFile.load(backend, path, nil)
+
+	if err == nil {
+		err = configFile.resolve()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return configFile, nil
+}
+
+// Modified checks whether any file read by LoadConfig has changed, or an include pattern matches a new file
+func (config *ConfigFile) Modified(backend ConfigurationBackend) (bool, error) {
+	for path, tag := range config.Sources {
+		file, newTag, err := backend.FetchFile(path, tag)
+
+		if err != nil {
+			return false, err
+		}
+
+		if file != nil {
+			file.Close()
+			return true, nil
+		}
+
+		if newTag != tag {
+			return true, nil
+		}
+	}
+
+	for _, pattern := range config.Includes {
+		paths, err := backend.ListFiles(pattern)
+
+		if err != nil {
+			return false, err
+		}
+
+		for _, name := range paths {
+			if _, exists := config.Sources[name]; !exists {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (configFile *ConfigFile) load(backend ConfigurationBackend, path string, stack []string) error {
+	for _, parent := range stack {
+		if parent == path {
+			return fmt.Errorf("%s is included recursively", path)
+		}
+	}
+
+	file, tag, err := backend.FetchFile(path, "")
+
+	if file == nil {
+		if err == nil {
+			err = fmt.Errorf("Unable to load %s", path)
+		}
+		return err
+	}
+
+	defer file.Close()
+
+	configFile.Sources[path] = tag
+
+	return configFile.parse(configFile.open(path, file), backend, append(stack, path))
+}
+
+// open returns a parser for a file of the configuration, substituting variables unless formatting
+func (configFile *ConfigFile) open(name string, reader io.Reader) *Parser {
+	parser := OpenFile(name, reader)
+
+	if configFile.variables != nil {
+		parser.SetVariables(configFile.variables)
 	}
 
+	return parser
+}
+
+func (configFile *ConfigFile) parse(parser *Parser, backend ConfigurationBackend, stack []string) error {
 	var err error
 	var stmt *ConfigStatement
 
 	for stmt, err = parser.Read(); stmt != nil; stmt, err = parser.Read() {
 		var section *SectionConfig
 
-		if stmt.SectionType == "global" {
+		if configFile.validator != nil && stmt.Word == "" {
+			configFile.validator.declareSection(stmt)
+		}
+
+		configFile.recordComments(stmt)
+
+		if stmt.Word == "include" && stmt.SectionType == "" && configFile.formatting {
+			configFile.includeStmts = append(configFile.includeStmts, strings.Join(append([]string{stmt.Word}, stmt.Fields...), " "))
+			continue
+		} else if stmt.Word == "include" && stmt.SectionType == "" {
+			err = configFile.include(stmt, backend, stack)
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		} else if stmt.SectionType == "global" {
+			if configFile.formatting && configFile.keepVerbatim(stmt) {
+				continue
+			}
+
 			isGlobal, err := parseGlobal(configFile, stmt)
 
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			if isGlobal {
@@ -388,52 +896,166 @@ func ParseConfig(reader io.Reader) (*ConfigFile, error) {
 
 			if section == nil {
 				section = &SectionConfig{
-					Type: USER,
-					Name: stmt.SectionName,
+					Type:  USER,
+					Name:  stmt.SectionName,
+					Order: len(configFile.Users),
 				}
 
 				configFile.Users[section.Name] = section
 			}
-		} else {
-			return nil, fmt.Errorf("config:%d unrecognized section type %s", stmt.Line, stmt.SectionType)
-		}
+		} else if stmt.SectionType == "network" {
+			alias := configFile.Networks[stmt.SectionName]
 
-		err = parseSection(section, stmt)
-	}
+			if alias == nil {
+				if !isAliasName(stmt.SectionName) {
+					return stmt.Errorf("invalid network name %s", stmt.SectionName)
+				}
 
-	if err != nil {
-		return nil, err
+				alias = &NetworkAlias{
+					Name:  stmt.SectionName,
+					Order: len(configFile.Networks),
+				}
+
+				configFile.Networks[alias.Name] = alias
+			}
+
+			if configFile.formatting && configFile.keepVerbatim(stmt) {
+				continue
+			}
+
+			err = parseNetworkSection(alias, stmt)
+
+			if err != nil {
+				return err
+			}
+
+			if configFile.validator != nil {
+				configFile.validator.record(stmt)
+			}
+
+			continue
+		} else {
+			return stmt.Errorf("unrecognized section type %s", stmt.SectionType)
+		}
+
+		if configFile.formatting && configFile.keepVerbatim(stmt) {
+			continue
+		}
+
+		err = parseSection(section, stmt)
+
+		if unknown, ok := err.(*unknownStatementError); ok && configFile.formatting {
+			configFile.addVerbatim(stmt)
+			continue
+		} else if ok {
+			configFile.unknownStatement(unknown)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if configFile.validator != nil {
+			configFile.validator.record(stmt)
+		}
+
+		if stmt.Word == "ip" || stmt.Word == "ip-pool" {
+			configFile.addressRefs = append(configFile.addressRefs, addressReference{section: section, stmt: stmt})
+		} else if stmt.Word == "inherits" {
+			configFile.inheritRefs = append(configFile.inheritRefs, inheritReference{group: section.Name, parent: stmt.Fields[0], stmt: stmt})
+		} else if (stmt.Word == "route" || stmt.Word == "nat" || stmt.Word == "deny") && isAliasName(stmt.Fields[0]) {
+			configFile.aliasRefs = append(configFile.aliasRefs, aliasReference{name: stmt.Fields[0], stmt: stmt})
+		}
 	}
 
-	return configFile, nil
+	configFile.trailer = append(configFile.trailer, parser.Comments()...)
+
+	return err
+}
+
+func (configFile *ConfigFile) include(stmt *ConfigStatement, backend ConfigurationBackend, stack []string) error {
+	if len(stmt.Fields) == 0 {
+		return stmt.Errorf("include must have at least one argument")
+	}
+
+	if backend == nil {
+		return stmt.Errorf("include is not permitted here")
+	}
+
+	for _, pattern := range stmt.Fields {
+		pattern = path.Clean(strings.TrimPrefix(pattern, "/"))
+
+		if pattern == ".." || strings.HasPrefix(pattern, "../") {
+			return stmt.Errorf("include %s is outside of the configuration root", pattern)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return stmt.Errorf("invalid include pattern %s: %w", pattern, err)
+		}
+
+		if !strings.ContainsAny(pattern, "*?[") {
+			err := configFile.load(backend, pattern, stack)
+
+			if err != nil {
+				return stmt.Errorf("include %s: %w", pattern, err)
+			}
+
+			continue
+		}
+
+		configFile.Includes = append(configFile.Includes, pattern)
+
+		paths, err := backend.ListFiles(pattern)
+
+		if err != nil {
+			return stmt.Errorf("include %s: %w", pattern, err)
+		}
+
+		for _, name := range paths {
+			err = configFile.load(backend, name, stack)
+
+			if err != nil {
+				return stmt.Errorf("include %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
 }
 
 func parseSection(section *SectionConfig, stmt *ConfigStatement) (err error) {
 	if strings.HasPrefix(stmt.Word, "subnet-") || strings.HasPrefix(stmt.Word, "pcx-") {
 		subnet := Subnet{Name: stmt.Word}
 
-		subnet.Ports, err = parsePorts(stmt.Line, stmt.Fields)
+		subnet.Ports, err = parsePorts(stmt, stmt.Fields)
 
 		if err != nil {
 			return err
 		}
 
 		section.Subnets = append(section.Subnets, subnet)
+	} else if stmt.Word == "subnets" {
+		selector, err := parseSelector(stmt, stmt.Fields)
+
+		if err != nil {
+			return err
+		}
+
+		section.SubnetSelectors = append(section.SubnetSelectors, selector)
 	} else if stmt.Word == "nat" {
 		if len(stmt.Fields) == 0 {
-			return fmt.Errorf("config:%d nat must have at least one argument", stmt.Line)
+			return stmt.Errorf("nat must have at least one argument")
 		}
 
 		switch stmt.Fields[0] {
 		case "on":
 			if len(stmt.Fields) > 1 {
-				return fmt.Errorf("config:%d nat cannot have arguments after 'on'", stmt.Line)
+				return stmt.Errorf("nat cannot have arguments after 'on'")
 			}
 			section.NATSetting = ALL
 			break
 		case "off":
 			if len(stmt.Fields) > 1 {
-				return fmt.Errorf("config:%d nat cannot have arguments after 'off'", stmt.Line)
+				return stmt.Errorf("nat cannot have arguments after 'off'")
 			}
 			section.NATSetting = OFF
 			break
@@ -455,9 +1077,238 @@ func parseSection(section *SectionConfig, stmt *ConfigStatement) (err error) {
 		}
 
 		section.Routes = append(section.Routes, route)
+	} else if stmt.Word == "deny" {
+		if len(stmt.Fields) == 0 {
+			return stmt.Errorf("deny must have at least one argument")
+		}
+
+		if strings.HasPrefix(stmt.Fields[0], "subnet-") || strings.HasPrefix(stmt.Fields[0], "pcx-") {
+			subnet := Subnet{Name: stmt.Fields[0]}
+
+			subnet.Ports, err = parsePorts(stmt, stmt.Fields[1:])
+
+			if err != nil {
+				return err
+			}
+
+			section.DenySubnets = append(section.DenySubnets, subnet)
+		} else if stmt.Fields[0] == "subnets" {
+			selector, err := parseSelector(stmt, stmt.Fields[1:])
+
+			if err != nil {
+				return err
+			}
+
+			section.DenySelectors = append(section.DenySelectors, selector)
+		} else {
+			route, err := parseRoute(stmt)
+
+			if err != nil {
+				return err
+			}
+
+			section.DenyRoutes = append(section.DenyRoutes, route)
+		}
+	} else if stmt.Word == "schedule" {
+		if section.Type == GLOBAL {
+			return stmt.Errorf("schedule is not permitted in the global section")
+		}
+
+		schedule, err := parseSchedule(stmt)
+
+		if err != nil {
+			return err
+		}
+
+		section.Schedules = append(section.Schedules, schedule)
+	} else if stmt.Word == "inherits" {
+		if section.Type != GROUP {
+			return stmt.Errorf("inherits is only permitted in group sections")
+		}
+
+		if len(stmt.Fields) != 1 {
+			return stmt.Errorf("inherits must have exactly one argument")
+		}
+
+		if stmt.Fields[0] == section.Name {
+			return stmt.Errorf("group %s cannot inherit itself", section.Name)
+		}
+
+		section.Inherits = append(section.Inherits, stmt.Fields[0])
+	} else if stmt.Word == "ip" {
+		if section.Type != USER {
+			return stmt.Errorf("ip is only permitted in user sections")
+		}
+
+		if len(stmt.Fields) != 1 {
+			return stmt.Errorf("ip must have exactly one argument")
+		}
+
+		if section.IP != nil {
+			return stmt.Errorf("user %s already has ip %s", section.Name, section.IP)
+		}
+
+		section.IP = net.ParseIP(stmt.Fields[0]).To4()
+
+		if section.IP == nil {
+			return stmt.Errorf("cannot parse ip %s", stmt.Fields[0])
+		}
+	} else if stmt.Word == "ip-pool" {
+		if section.Type != GROUP {
+			return stmt.Errorf("ip-pool is only permitted in group sections")
+		}
+
+		if len(stmt.Fields) != 1 {
+			return stmt.Errorf("ip-pool must have exactly one argument")
+		}
+
+		if section.IPPool != nil {
+			return stmt.Errorf("group %s already has ip-pool %s", section.Name, section.IPPool.String())
+		}
+
+		ip, pool, err := net.ParseCIDR(stmt.Fields[0])
+
+		if err != nil || ip.To4() == nil {
+			return stmt.Errorf("cannot parse ip-pool %s", stmt.Fields[0])
+		}
+
+		section.IPPool = pool
+	} else if stmt.Word == "tunnel" {
+		if len(stmt.Fields) != 1 {
+			return stmt.Errorf("tunnel must have exactly one argument")
+		}
+
+		switch stmt.Fields[0] {
+		case "full":
+			section.Tunnel = FULL
+			break
+		case "split":
+			section.Tunnel = SPLIT
+			break
+		default:
+			return stmt.Errorf("tunnel must be 'full' or 'split'")
+		}
+	} else if stmt.Word == "session-timeout" || stmt.Word == "reauth-interval" {
+		if len(stmt.Fields) != 1 {
+			return stmt.Errorf("%s must have exactly one argument", stmt.Word)
+		}
+
+		duration, err := time.ParseDuration(stmt.Fields[0])
+
+		if err != nil {
+			return stmt.Errorf("cannot parse %s duration %s: %w", stmt.Word, stmt.Fields[0], err)
+		}
+
+		if duration < time.Minute {
+			return stmt.Errorf("%s must be at least 1m", stmt.Word)
+		}
+
+		if stmt.Word == "session-timeout" {
+			section.SessionTimeout = duration
+		} else {
+			section.ReauthInterval = duration
+		}
+	} else if stmt.Word == "bandwidth" {
+		if len(stmt.Fields) != 2 {
+			return stmt.Errorf("bandwidth must have exactly 2 arguments")
+		}
+
+		down, err := parseRate(stmt, stmt.Fields[0])
+
+		if err != nil {
+			return err
+		}
+
+		up, err := parseRate(stmt, stmt.Fields[1])
+
+		if err != nil {
+			return err
+		}
+
+		section.Bandwidth = &Bandwidth{Down: down, Up: up}
+	} else if stmt.Word == "max-connections" {
+		if len(stmt.Fields) != 1 && len(stmt.Fields) != 2 {
+			return stmt.Errorf("max-connections must have 1 or 2 arguments")
+		}
+
+		max, err := strconv.Atoi(stmt.Fields[0])
+
+		if err != nil || max < 1 {
+			return stmt.Errorf("invalid max-connections %s", stmt.Fields[0])
+		}
+
+		section.MaxConnections = max
+		section.ConnectionLimit = EVICT
+
+		if len(stmt.Fields) == 2 {
+			switch stmt.Fields[1] {
+			case "evict":
+				break
+			case "reject":
+				section.ConnectionLimit = REJECT
+				break
+			default:
+				return stmt.Errorf("max-connections policy must be 'evict' or 'reject'")
+			}
+		}
+	} else if stmt.Word == "dns-server" {
+		if len(stmt.Fields) == 0 {
+			return stmt.Errorf("dns-server must have at least one argument")
+		}
+
+		for _, field := range stmt.Fields {
+			server := net.ParseIP(field)
+
+			if server == nil {
+				return stmt.Errorf("cannot parse dns-server %s", field)
+			}
+
+			if server.To4() != nil {
+				server = server.To4()
+			}
+
+			section.DNSServers = append(section.DNSServers, server)
+		}
+	} else if stmt.Word == "dns-domain" {
+		if len(stmt.Fields) != 1 {
+			return stmt.Errorf("dns-domain must have exactly one argument")
+		}
+
+		if !isDomainName(stmt.Fields[0]) {
+			return stmt.Errorf("invalid dns-domain %s", stmt.Fields[0])
+		}
+
+		section.DNSDomain = stmt.Fields[0]
+	} else if stmt.Word == "dns-search" {
+		if len(stmt.Fields) == 0 {
+			return stmt.Errorf("dns-search must have at least one argument")
+		}
+
+		for _, field := range stmt.Fields {
+			if !isDomainName(field) {
+				return stmt.Errorf("invalid dns-search domain %s", field)
+			}
+
+			section.DNSSearch = append(section.DNSSearch, field)
+		}
+	} else if stmt.Word == "block-outside-dns" {
+		if len(stmt.Fields) != 1 {
+			return stmt.Errorf("block-outside-dns must have exactly one argument")
+		}
+
+		switch stmt.Fields[0] {
+		case "on":
+			section.BlockOutsideDNS = ON
+			break
+		case "off":
+			section.BlockOutsideDNS = OFF
+			break
+		default:
+			return stmt.Errorf("block-outside-dns setting must be 'on' or 'off'")
+		}
 	} else if stmt.Word == "dns" {
 		if len(stmt.Fields) != 1 {
-			return fmt.Errorf("config:%d dns must have exactly one argument", stmt.Line)
+			return stmt.Errorf("dns must have exactly one argument")
 		}
 
 		switch stmt.Fields[0] {
@@ -468,8 +1319,10 @@ func parseSection(section *SectionConfig, stmt *ConfigStatement) (err error) {
 			section.DNSSetting = OFF
 			break
 		default:
-			return fmt.Errorf("config:%d dns setting must be 'on' or 'off'", stmt.Line)
+			return stmt.Errorf("dns setting must be 'on' or 'off'")
 		}
+	} else if stmt.Word != "" {
+		return &unknownStatementError{stmt: stmt}
 	}
 
 	return nil
@@ -479,12 +1332,12 @@ func parseGlobal(configFile *ConfigFile, stmt *ConfigStatement) (isglobal bool,
 	switch stmt.Word {
 	case "watch":
 		if len(stmt.Fields) != 1 {
-			return true, fmt.Errorf("config:%d watch must have exactly one argument", stmt.Line)
+			return true, stmt.Errorf("watch must have exactly one argument")
 		}
 		watchTime, err := time.ParseDuration(stmt.Fields[0])
 
 		if err != nil {
-			return true, fmt.Errorf("config:%d cannot parse watch duration %s: %w", stmt.Line, stmt.Fields[0], err)
+			return true, stmt.Errorf("cannot parse watch duration %s: %w", stmt.Fields[0], err)
 		}
 
 		configFile.WatchTime = &watchTime
@@ -492,25 +1345,41 @@ func parseGlobal(configFile *ConfigFile, stmt *ConfigStatement) (isglobal bool,
 		return true, nil
 	case "net":
 		if len(stmt.Fields) != 1 {
-			return true, fmt.Errorf("config:%d net must have exactly one argument", stmt.Line)
+			return true, stmt.Errorf("net must have exactly one argument")
 		}
 
 		netString := stmt.Fields[0]
 
 		if strings.IndexRune(netString, '/') == -1 {
-			ip := net.ParseIP(netString)
+			netString += "/24"
+		}
 
-			if ip == nil {
-				return true, fmt.Errorf("config:%d cannot parse net %s", stmt.Line, netString)
-			}
+		_, configFile.Network, err = net.ParseCIDR(netString)
 
-			configFile.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}
-		} else {
-			_, configFile.Network, err = net.ParseCIDR(netString)
+		if err != nil {
+			return true, stmt.Errorf("cannot parse net %s", stmt.Fields[0])
+		}
 
-			if err != nil {
-				return true, fmt.Errorf("config:%d cannot parse net %s", stmt.Line, netString)
-			}
+		if ones, bits := configFile.Network.Mask.Size(); bits != 32 || ones > 29 {
+			return true, stmt.Errorf("net %s must be an IPv4 network of at least 8 addresses", stmt.Fields[0])
+		}
+
+		return true, nil
+
+	case "net6":
+		if len(stmt.Fields) != 1 {
+			return true, stmt.Errorf("net6 must have exactly one argument")
+		}
+
+		_, configFile.Network6, err = net.ParseCIDR(stmt.Fields[0])
+
+		if err != nil {
+			return true, stmt.Errorf("cannot parse net6 %s", stmt.Fields[0])
+		}
+
+		// The upper half of the network must hold the static addresses mapped from net
+		if ones, bits := configFile.Network6.Mask.Size(); configFile.Network6.IP.To4() != nil || bits != 128 || ones < 64 || ones > 96 {
+			return true, stmt.Errorf("net6 %s must be an IPv6 network with a prefix between /64 and /96", stmt.Fields[0])
 		}
 
 		return true, nil
@@ -519,7 +1388,7 @@ func parseGlobal(configFile *ConfigFile, stmt *ConfigStatement) (isglobal bool,
 		fields := len(stmt.Fields)
 
 		if fields != 2 && fields != 3 {
-			return true, fmt.Errorf("config:%d route53 must have 2 or 3 arguments", stmt.Line)
+			return true, stmt.Errorf("route53 must have 2 or 3 arguments")
 		}
 
 		configFile.Route53Zone = stmt.Fields[0]
@@ -529,7 +1398,7 @@ func parseGlobal(configFile *ConfigFile, stmt *ConfigStatement) (isglobal bool,
 			if stmt.Fields[2] == "weighted" {
 				configFile.Route53Weighted = true
 			} else if stmt.Fields[2] != "simple" {
-				return true, fmt.Errorf("config:%d invalid route53 entry type %s", stmt.Line, stmt.Fields[2])
+				return true, stmt.Errorf("invalid route53 entry type %s", stmt.Fields[2])
 			}
 		}
 
@@ -537,63 +1406,231 @@ func parseGlobal(configFile *ConfigFile, stmt *ConfigStatement) (isglobal bool,
 
 	case "key-strength":
 		if len(stmt.Fields) != 1 {
-			return true, fmt.Errorf("config:%d key-strength must have exactly 1 argument", stmt.Line)
+			return true, stmt.Errorf("key-strength must have exactly 1 argument")
 		}
 
 		strength, err := strconv.Atoi(stmt.Fields[0])
 
 		if err != nil {
-			return true, fmt.Errorf("config:%d invalid key-strength %s", stmt.Line, stmt.Fields[0])
+			return true, stmt.Errorf("invalid key-strength %s", stmt.Fields[0])
 		}
 
 		configFile.KeyStrength = strength
 		return true, nil
 	}
 
-	return false, nil
+	return parseServerOption(configFile, stmt)
 }
 
-func parsePorts(line int, fields []string) ([]uint16, error) {
-	var ports []uint16
+func parsePorts(stmt *ConfigStatement, fields []string) ([]Port, error) {
+	var ports []Port
 
 	for _, portStr := range fields {
-		port, err := strconv.ParseUint(portStr, 10, 16)
+		var port Port
+		numStr := portStr
+
+		if slash := strings.IndexRune(portStr, '/'); slash != -1 {
+			port.Protocol = parseProtocol(portStr[:slash])
+			numStr = portStr[slash+1:]
+
+			if port.Protocol == 0 {
+				return nil, stmt.Errorf("unknown protocol in %s", portStr)
+			} else if port.Protocol == ICMP {
+				return nil, stmt.Errorf("icmp does not take a port number: %s", portStr)
+			}
+		} else if port.Protocol = parseProtocol(portStr); port.Protocol != 0 {
+			ports = append(ports, port)
+			continue
+		} else {
+			port.Protocol = TCP
+		}
+
+		toStr := numStr
+
+		if dash := strings.IndexRune(numStr, '-'); dash != -1 {
+			toStr = numStr[dash+1:]
+			numStr = numStr[:dash]
+		}
+
+		from, err := parsePortNumber(stmt, numStr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parsePortNumber(stmt, toStr)
 
 		if err != nil {
-			return nil, fmt.Errorf("config:%d unable to parse port number %s: %w", line, portStr, err)
+			return nil, err
 		}
 
-		ports = append(ports, uint16(port))
+		if to < from {
+			return nil, stmt.Errorf("invalid port range %s", portStr)
+		}
+
+		port.From = from
+		port.To = to
+		ports = append(ports, port)
 	}
 
 	return ports, nil
 }
 
+// isDomainName checks that name only contains the characters of a DNS name
+func isDomainName(name string) bool {
+	if name == "" || name[0] == '.' || name[0] == '-' {
+		return false
+	}
+
+	for _, c := range name {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRate parses a rate in bits per second with an optional k, m or g multiplier and bit suffix, such as 10mbit, or
+// unlimited
+func parseRate(stmt *ConfigStatement, rateStr string) (uint64, error) {
+	if rateStr == "unlimited" {
+		return 0, nil
+	}
+
+	value := strings.TrimSuffix(strings.ToLower(rateStr), "bit")
+	multiplier := uint64(1)
+
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1000
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1000 * 1000
+	case strings.HasSuffix(value, "g"):
+		multiplier = 1000 * 1000 * 1000
+	}
+
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	rate, err := strconv.ParseUint(value, 10, 32)
+
+	if err != nil || rate == 0 {
+		return 0, stmt.Errorf("invalid rate %s", rateStr)
+	}
+
+	return rate * multiplier, nil
+}
+
+// durationString formats a duration without trailing zero units, such as 8h or 1h30m
+func durationString(duration time.Duration) string {
+	rv := duration.String()
+
+	if strings.HasSuffix(rv, "m0s") {
+		rv = rv[:len(rv)-2]
+	}
+
+	if strings.HasSuffix(rv, "h0m") {
+		rv = rv[:len(rv)-2]
+	}
+
+	return rv
+}
+
+func rateString(rate uint64) string {
+	switch {
+	case rate == 0:
+		return "unlimited"
+	case rate%(1000*1000*1000) == 0:
+		return fmt.Sprintf("%dgbit", rate/(1000*1000*1000))
+	case rate%(1000*1000) == 0:
+		return fmt.Sprintf("%dmbit", rate/(1000*1000))
+	case rate%1000 == 0:
+		return fmt.Sprintf("%dkbit", rate/1000)
+	default:
+		return fmt.Sprintf("%dbit", rate)
+	}
+}
+
+func parsePortNumber(stmt *ConfigStatement, numStr string) (uint16, error) {
+	num, err := strconv.ParseUint(numStr, 10, 16)
+
+	if err != nil {
+		return 0, stmt.Errorf("unable to parse port number %s: %w", numStr, err)
+	} else if num == 0 {
+		return 0, stmt.Errorf("invalid port number %s", numStr)
+	}
+
+	return uint16(num), nil
+}
+
+func parseProtocol(name string) Protocol {
+	switch strings.ToLower(name) {
+	case "tcp":
+		return TCP
+	case "udp":
+		return UDP
+	case "icmp":
+		return ICMP
+	default:
+		return 0
+	}
+}
+
 func parseRoute(stmt *ConfigStatement) (route Route, err error) {
 	if len(stmt.Fields) == 0 {
-		return route, fmt.Errorf("config:%d %s must have at least one argument", stmt.Line, stmt.Word)
+		return route, stmt.Errorf("%s must have at least one argument", stmt.Word)
 	}
 
-	netString := stmt.Fields[0]
+	return parseRouteFields(stmt, stmt.Fields)
+}
+
+// parseRouteFields parses a network or network alias followed by ports
+func parseRouteFields(stmt *ConfigStatement, fields []string) (route Route, err error) {
+	netString := fields[0]
 	if strings.IndexRune(netString, '/') == -1 {
 		ip := net.ParseIP(netString)
 
 		if ip == nil {
-			return route, fmt.Errorf("config:%d cannot parse net %s", stmt.Line, netString)
-		}
+			if isAliasName(netString) {
+				if len(fields) > 1 {
+					return route, stmt.Errorf("network %s cannot be given ports", netString)
+				}
 
-		route.Network = net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
-	} else {
-		_, network, err := net.ParseCIDR(netString)
+				route.Alias = netString
+				return route, nil
+			}
 
-		if err != nil {
-			return route, fmt.Errorf("config:%d cannot parse net %s", stmt.Line, netString)
+			return route, stmt.Errorf("cannot parse net %s", netString)
+		}
+
+		if ip.To4() != nil {
+			netString += "/32"
+		} else {
+			netString += "/128"
 		}
+	}
+
+	_, network, err := net.ParseCIDR(netString)
 
-		route.Network = *network
+	if err != nil {
+		return route, stmt.Errorf("cannot parse net %s", fields[0])
 	}
 
-	route.Ports, err = parsePorts(stmt.Line, stmt.Fields[1:])
+	route.Network = *network
+
+	route.Ports, err = parsePorts(stmt, fields[1:])
 
 	return route, err
 }
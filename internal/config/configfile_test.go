@@ -0,0 +1,271 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePorts(t *testing.T) {
+	for _, test := range []struct {
+		fields   string
+		expected []Port
+	}{
+		{"22", []Port{{TCP, 22, 22}}},
+		{"tcp/443 udp/53", []Port{{TCP, 443, 443}, {UDP, 53, 53}}},
+		{"udp", []Port{{UDP, 0, 0}}},
+		{"icmp", []Port{{ICMP, 0, 0}}},
+		{"UDP/500", []Port{{UDP, 500, 500}}},
+		{"8000-8100 udp/60000-61000", []Port{{TCP, 8000, 8100}, {UDP, 60000, 61000}}},
+	} {
+		stmt := &ConfigStatement{File: "config", Line: 1, Word: "route"}
+		ports, err := parsePorts(stmt, strings.Fields(test.fields))
+
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", test.fields, err)
+			continue
+		}
+
+		if portsString(ports) != portsString(test.expected) {
+			t.Errorf("parsePorts(%q) = %v, expected %v", test.fields, ports, test.expected)
+		}
+	}
+}
+
+func TestParsePortsInvalid(t *testing.T) {
+	for _, fields := range []string{"0", "65536", "ssh", "sctp/22", "icmp/8", "8100-8000", "udp/", "22-"} {
+		stmt := &ConfigStatement{File: "config", Line: 3, Word: "route"}
+		_, err := parsePorts(stmt, []string{fields})
+
+		if err == nil {
+			t.Errorf("Expected an error parsing %q", fields)
+		} else if !strings.HasPrefix(err.Error(), "config:3 ") {
+			t.Errorf("Expected the error for %q to name the line, got %s", fields, err)
+		}
+	}
+}
+
+func TestRouteProtocols(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`group ops
+  route 10.10.0.0/16 tcp/443 udp/53 icmp
+  nat 10.30.0.0/16 udp
+  subnet-0c02187459d3a72b2 22 udp/123
+`))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	section := conf.Groups["ops"]
+
+	if len(section.Routes) != 1 || section.Routes[0].String() != "10.10.0.0/16 443 udp/53 icmp" {
+		t.Errorf("Unexpected routes %v", section.Routes)
+	}
+
+	if len(section.NATRoutes) != 1 || section.NATRoutes[0].String() != "10.30.0.0/16 udp" {
+		t.Errorf("Unexpected nat routes %v", section.NATRoutes)
+	}
+
+	if len(section.Subnets) != 1 || section.Subnets[0].String() != "subnet-0c02187459d3a72b2 22 udp/123" {
+		t.Errorf("Unexpected subnets %v", section.Subnets)
+	}
+}
+
+func newIncludeBackend(t *testing.T, files map[string]string) *MemoryConfig {
+	backend := NewMemoryConfig()
+
+	for name, data := range files {
+		if err := backend.PutFile(name, []byte(data)); err != nil {
+			t.Fatalf("Error writing %s: %s", name, err)
+		}
+	}
+
+	return backend
+}
+
+func TestIncludeGlob(t *testing.T) {
+	backend := newIncludeBackend(t, map[string]string{
+		"vpn.conf":          "global\n  dns off\n\ninclude groups/*.conf users.conf\n",
+		"groups/devs.conf":  "group devs\n  route 10.1.0.0/16\n",
+		"groups/ops.conf":   "group ops\n  route 10.2.0.0/16\n",
+		"groups/notes.txt":  "not a config file\n",
+		"users.conf":        "user joe\n  dns on\n",
+		"other/extra.conf":  "group extra\n",
+		"groups/sub/x.conf": "group nested\n",
+	})
+
+	conf, err := LoadConfig(backend, "vpn.conf")
+
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	for _, group := range []string{"devs", "ops"} {
+		if conf.Groups[group] == nil {
+			t.Errorf("Expected group %s to be included", group)
+		}
+	}
+
+	if len(conf.Groups) != 2 {
+		t.Errorf("Expected only the groups matching the pattern, got %d groups", len(conf.Groups))
+	}
+
+	if conf.Users["joe"] == nil {
+		t.Errorf("Expected user joe to be included")
+	}
+
+	if len(conf.Sources) != 4 {
+		t.Errorf("Expected 4 sources, got %v", conf.Sources)
+	}
+
+	if len(conf.Includes) != 1 || conf.Includes[0] != "groups/*.conf" {
+		t.Errorf("Expected the pattern to be recorded, got %q", conf.Includes)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{"cycle", map[string]string{"vpn.conf": "include a.conf\n", "a.conf": "include b.conf\n", "b.conf": "include a.conf\n"},
+			"a.conf is included recursively"},
+		{"self", map[string]string{"vpn.conf": "include vpn.conf\n"}, "vpn.conf is included recursively"},
+		{"missing", map[string]string{"vpn.conf": "include missing.conf\n"}, "Unable to load missing.conf"},
+		{"error location", map[string]string{"vpn.conf": "include a.conf\n", "a.conf": "group devs\n  route 10.1.0.0/33\n"},
+			"a.conf:2 cannot parse net 10.1.0.0/33"},
+		{"no arguments", map[string]string{"vpn.conf": "include\n"}, "vpn.conf:1 include must have at least one argument"},
+		{"parent", map[string]string{"vpn.conf": "include ../secret.conf\n"}, "vpn.conf:1 include ../secret.conf is outside of the configuration root"},
+		{"parent pattern", map[string]string{"vpn.conf": "include groups/../../*.conf\n"}, "vpn.conf:1 include ../*.conf is outside of the configuration root"},
+		{"parent only", map[string]string{"vpn.conf": "include /..\n"}, "vpn.conf:1 include .. is outside of the configuration root"},
+	} {
+		_, err := LoadConfig(newIncludeBackend(t, test.files), "vpn.conf")
+
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestIncludeNoTrailingNewline(t *testing.T) {
+	backend := newIncludeBackend(t, map[string]string{
+		"vpn.conf":         "include groups/*.conf users.conf",
+		"groups/devs.conf": "group devs\n  route 10.1.0.0/16",
+		"users.conf":       "user joe\n  dns on",
+	})
+
+	conf, err := LoadConfig(backend, "vpn.conf")
+
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	if devs := conf.Groups["devs"]; devs == nil || len(devs.Routes) != 1 {
+		t.Errorf("Expected the last line of groups/devs.conf to be parsed, got %v", devs)
+	}
+
+	if joe := conf.Users["joe"]; joe == nil || joe.DNSSetting != ON {
+		t.Errorf("Expected the last line of users.conf to be parsed, got %v", joe)
+	}
+}
+
+func TestIncludeNotPermitted(t *testing.T) {
+	_, err := ParseConfig(strings.NewReader("include users.conf\n"))
+
+	if err == nil || !strings.Contains(err.Error(), "include is not permitted here") {
+		t.Errorf("Expected include to be rejected, got %v", err)
+	}
+}
+
+func TestModifiedIncludes(t *testing.T) {
+	backend := newIncludeBackend(t, map[string]string{
+		"vpn.conf":         "include groups/*.conf users.conf\n",
+		"groups/devs.conf": "group devs\n",
+		"users.conf":       "user joe\n",
+	})
+
+	load := func() *ConfigFile {
+		conf, err := LoadConfig(backend, "vpn.conf")
+
+		if err != nil {
+			t.Fatalf("Error loading config: %s", err)
+		}
+
+		return conf
+	}
+
+	expectModified := func(conf *ConfigFile, expected bool, change string) {
+		t.Helper()
+
+		modified, err := conf.Modified(backend)
+
+		if err != nil {
+			t.Fatalf("Error checking %s: %s", change, err)
+		}
+
+		if modified != expected {
+			t.Errorf("Modified() = %t after %s", modified, change)
+		}
+	}
+
+	conf := load()
+	expectModified(conf, false, "no change")
+
+	backend.PutFile("users.conf", []byte("user ann\n"))
+	expectModified(conf, true, "changing an included file")
+
+	conf = load()
+	backend.PutFile("groups/ops.conf", []byte("group ops\n"))
+	expectModified(conf, true, "adding a file matching a pattern")
+
+	conf = load()
+	backend.PutFile("other.conf", []byte("group other\n"))
+	expectModified(conf, false, "adding a file that is not included")
+
+	backend.DeleteFile("groups/devs.conf")
+	expectModified(conf, true, "deleting an included file")
+}
+
+func TestIPv6Subnets(t *testing.T) {
+	netinfo := &NetworkInfo{
+		Subnets: map[string]net.IPNet{
+			"subnet-a": parseNetwork(t, "10.1.1.0/24"),
+			"subnet-b": parseNetwork(t, "10.1.2.0/24"),
+		},
+		SubnetsIPv6: map[string][]net.IPNet{
+			"subnet-a": {parseNetwork(t, "2600:1f18:2a1:c700::/64")},
+			"pcx-0ab":  {parseNetwork(t, "2600:1f18:2a1:c800::/56")},
+		},
+	}
+
+	for _, test := range []struct {
+		rules    string
+		expected string
+	}{
+		// Without subnet rules, every network is routed
+		{"dns on", "10.1.1.0/24, 10.1.2.0/24, 2600:1f18:2a1:c700::/64, 2600:1f18:2a1:c800::/56"},
+		{"subnet-a 443", "10.1.1.0/24 443, 2600:1f18:2a1:c700::/64 443"},
+		{"pcx-0ab", "2600:1f18:2a1:c800::/56"},
+		{"subnet-a\n  deny 2600:1f18:2a1:c700::/64", "10.1.1.0/24"},
+	} {
+		conf, err := ParseConfig(strings.NewReader("group devs\n  " + test.rules + "\n"))
+
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", test.rules, err)
+			continue
+		}
+
+		userConf, err := conf.GetUserConfig("joe", []string{"devs"}, netinfo, time.Now())
+
+		if err != nil {
+			t.Errorf("Error getting config for %q: %s", test.rules, err)
+			continue
+		}
+
+		if routes := routesString(userConf.Routes); routes != test.expected {
+			t.Errorf("Routes for %q are %q, expected %q", test.rules, routes, test.expected)
+		}
+	}
+}
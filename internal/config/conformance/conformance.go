@@ -0,0 +1,377 @@
+// Package conformance checks that a config.ConfigurationBackend follows the rules of the interface, so that every backend
+// behaves the same way for missing files, users, groups and keys, for file tags and for PutFile
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+// Fixture is a backend under test, with functions to set up users, groups and keys. A nil function skips the tests that
+// need it.
+type Fixture struct {
+	Backend    config.ConfigurationBackend
+	AddUser    func(user string) error
+	AddKey     func(user, keyId string, key []byte) (string, error) // Returns the id of the key in the backend
+	AddToGroup func(group string, users ...string) error
+	Fail       func(method string, err error) // Makes method return err, or succeed again if err is nil
+	Close      func()                         // Releases the backend at the end of a test
+}
+
+type conformanceTest struct {
+	name string
+	run  func(t *testing.T, fixture *Fixture)
+}
+
+var tests = []conformanceTest{
+	{"FetchFileNotFound", testFetchFileNotFound},
+	{"FetchFileTag", testFetchFileTag},
+	{"PutFileOverwrite", testPutFileOverwrite},
+	{"PutFileNested", testPutFileNested},
+	{"ListFilesNoMatch", testListFilesNoMatch},
+	{"FetchNetworkInfo", testFetchNetworkInfo},
+	{"GroupNotFound", testGroupNotFound},
+	{"UserNotFound", testUserNotFound},
+	{"UserWithoutKeys", testUserWithoutKeys},
+	{"Keys", testKeys},
+	{"Groups", testGroups},
+	{"Failures", testFailures},
+}
+
+// Run runs every conformance test as a subtest of t, each with a new fixture
+func Run(t *testing.T, newFixture func(t *testing.T) *Fixture) {
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newFixture(t)
+
+			if fixture.Close != nil {
+				defer fixture.Close()
+			}
+
+			test.run(t, fixture)
+		})
+	}
+}
+
+// fetchFile returns the content and tag of a file, data is nil if the reader is nil
+func fetchFile(t *testing.T, backend config.ConfigurationBackend, path, ifNotTag string) ([]byte, string) {
+	reader, tag, err := backend.FetchFile(path, ifNotTag)
+
+	if err != nil {
+		t.Fatalf("FetchFile(%q, %q) returned error %s", path, ifNotTag, err)
+	}
+
+	if reader == nil {
+		return nil, tag
+	}
+
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+
+	if err != nil {
+		t.Fatalf("Error reading %s: %s", path, err)
+	}
+
+	return data, tag
+}
+
+func putFile(t *testing.T, backend config.ConfigurationBackend, path string, data []byte) {
+	if err := backend.PutFile(path, data); err != nil {
+		t.Fatalf("PutFile(%q) returned error %s", path, err)
+	}
+}
+
+func testFetchFileNotFound(t *testing.T, fixture *Fixture) {
+	for _, ifNotTag := range []string{"", "tag"} {
+		reader, tag, err := fixture.Backend.FetchFile("missing.conf", ifNotTag)
+
+		if reader != nil || tag != "" || err != nil {
+			t.Errorf("FetchFile of a missing file with tag %q returned %v, %q, %v, expected nil, \"\", nil", ifNotTag, reader, tag, err)
+		}
+	}
+}
+
+func testFetchFileTag(t *testing.T, fixture *Fixture) {
+	putFile(t, fixture.Backend, "main.conf", []byte("user alice\n"))
+
+	data, tag := fetchFile(t, fixture.Backend, "main.conf", "")
+
+	if string(data) != "user alice\n" {
+		t.Errorf("FetchFile returned %q, expected %q", data, "user alice\n")
+	}
+
+	if tag == "" {
+		t.Fatalf("FetchFile returned an empty tag")
+	}
+
+	data, unchanged := fetchFile(t, fixture.Backend, "main.conf", tag)
+
+	if data != nil {
+		t.Errorf("FetchFile with the current tag returned the file")
+	}
+
+	if unchanged != tag {
+		t.Errorf("FetchFile with the current tag returned tag %q, expected %q", unchanged, tag)
+	}
+
+	if data, _ = fetchFile(t, fixture.Backend, "main.conf", tag+"-other"); string(data) != "user alice\n" {
+		t.Errorf("FetchFile with another tag returned %q, expected %q", data, "user alice\n")
+	}
+}
+
+func testPutFileOverwrite(t *testing.T, fixture *Fixture) {
+	putFile(t, fixture.Backend, "main.conf", []byte("user alice bob carol\n"))
+	_, oldTag := fetchFile(t, fixture.Backend, "main.conf", "")
+
+	putFile(t, fixture.Backend, "main.conf", []byte("user dave\n"))
+	data, tag := fetchFile(t, fixture.Backend, "main.conf", oldTag)
+
+	if string(data) != "user dave\n" {
+		t.Errorf("FetchFile after overwriting returned %q, expected %q", data, "user dave\n")
+	}
+
+	if tag == oldTag {
+		t.Errorf("Tag %q did not change when the file was overwritten", tag)
+	}
+}
+
+func testPutFileNested(t *testing.T, fixture *Fixture) {
+	putFile(t, fixture.Backend, "conf.d/users.conf", []byte("user alice\n"))
+
+	if data, _ := fetchFile(t, fixture.Backend, "conf.d/users.conf", ""); string(data) != "user alice\n" {
+		t.Errorf("FetchFile returned %q, expected %q", data, "user alice\n")
+	}
+
+	paths, err := fixture.Backend.ListFiles("conf.d/*.conf")
+
+	if err != nil {
+		t.Fatalf("ListFiles returned error %s", err)
+	}
+
+	if len(paths) != 1 || paths[0] != "conf.d/users.conf" {
+		t.Errorf("ListFiles returned %q, expected [conf.d/users.conf]", paths)
+	}
+}
+
+func testListFilesNoMatch(t *testing.T, fixture *Fixture) {
+	paths, err := fixture.Backend.ListFiles("missing.d/*.conf")
+
+	if err != nil || len(paths) != 0 {
+		t.Errorf("ListFiles without matches returned %q, %v, expected no paths and no error", paths, err)
+	}
+}
+
+func testFetchNetworkInfo(t *testing.T, fixture *Fixture) {
+	netinfo, err := fixture.Backend.FetchNetworkInfo()
+
+	if netinfo == nil && err == nil {
+		t.Errorf("FetchNetworkInfo returned nil without an error")
+	}
+}
+
+func testGroupNotFound(t *testing.T, fixture *Fixture) {
+	if members, err := fixture.Backend.FetchGroup("nobody"); members != nil || err != nil {
+		t.Errorf("FetchGroup of a missing group returned %q, %v, expected nil, nil", members, err)
+	}
+}
+
+func testUserNotFound(t *testing.T, fixture *Fixture) {
+	if keys, err := fixture.Backend.FetchKeys("nobody"); keys != nil || err != nil {
+		t.Errorf("FetchKeys of a missing user returned %q, %v, expected nil, nil", keys, err)
+	}
+
+	if key, err := fixture.Backend.FetchKey("nobody", "key"); key != nil || err != nil {
+		t.Errorf("FetchKey of a missing user returned %q, %v, expected nil, nil", key, err)
+	}
+
+	if groups, err := fixture.Backend.FetchGroupsForUser("nobody"); len(groups) != 0 || err != nil {
+		t.Errorf("FetchGroupsForUser of a missing user returned %q, %v, expected no groups and no error", groups, err)
+	}
+}
+
+func testUserWithoutKeys(t *testing.T, fixture *Fixture) {
+	if fixture.AddUser == nil {
+		t.Skip("Fixture cannot add users")
+	}
+
+	if err := fixture.AddUser("alice"); err != nil {
+		t.Fatalf("Error adding user: %s", err)
+	}
+
+	if keys, err := fixture.Backend.FetchKeys("alice"); keys == nil || len(keys) != 0 || err != nil {
+		t.Errorf("FetchKeys of a user without keys returned %#v, %v, expected an empty list", keys, err)
+	}
+}
+
+func testKeys(t *testing.T, fixture *Fixture) {
+	if fixture.AddKey == nil {
+		t.Skip("Fixture cannot add keys")
+	}
+
+	var ids []string
+	keys := make(map[string][]byte)
+
+	for _, name := range []string{"laptop", "phone"} {
+		key := publicKey(t)
+		id, err := fixture.AddKey("alice", name, key)
+
+		if err != nil {
+			t.Fatalf("Error adding key: %s", err)
+		}
+
+		ids = append(ids, id)
+		keys[id] = key
+	}
+
+	fetched, err := fixture.Backend.FetchKeys("alice")
+
+	if err != nil {
+		t.Fatalf("FetchKeys returned error %s", err)
+	}
+
+	sort.Strings(fetched)
+	sort.Strings(ids)
+
+	if len(fetched) != 2 || fetched[0] != ids[0] || fetched[1] != ids[1] {
+		t.Errorf("FetchKeys returned %q, expected %q", fetched, ids)
+	}
+
+	for id, key := range keys {
+		if data, err := fixture.Backend.FetchKey("alice", id); !bytes.Equal(data, key) || err != nil {
+			t.Errorf("FetchKey of %s returned %q, %v, expected %q", id, data, err, key)
+		}
+	}
+
+	if data, err := fixture.Backend.FetchKey("alice", "tablet"); data != nil || err != nil {
+		t.Errorf("FetchKey of a missing key returned %q, %v, expected nil, nil", data, err)
+	}
+}
+
+func testGroups(t *testing.T, fixture *Fixture) {
+	if fixture.AddToGroup == nil {
+		t.Skip("Fixture cannot add groups")
+	}
+
+	if err := fixture.AddToGroup("admins", "alice", "bob"); err != nil {
+		t.Fatalf("Error adding group: %s", err)
+	}
+
+	if err := fixture.AddToGroup("developers", "bob"); err != nil {
+		t.Fatalf("Error adding group: %s", err)
+	}
+
+	members, err := fixture.Backend.FetchGroup("admins")
+
+	if err != nil {
+		t.Fatalf("FetchGroup returned error %s", err)
+	}
+
+	sort.Strings(members)
+
+	if len(members) != 2 || members[0] != "alice" || members[1] != "bob" {
+		t.Errorf("FetchGroup returned %q, expected [alice bob]", members)
+	}
+
+	groups, err := fixture.Backend.FetchGroupsForUser("bob")
+
+	if err != nil {
+		t.Fatalf("FetchGroupsForUser returned error %s", err)
+	}
+
+	sort.Strings(groups)
+
+	if len(groups) != 2 || groups[0] != "admins" || groups[1] != "developers" {
+		t.Errorf("FetchGroupsForUser returned %q, expected [admins developers]", groups)
+	}
+}
+
+// publicKey returns a new RSA public key as PEM
+func publicKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+var errInjected = errors.New("injected failure")
+
+func testFailures(t *testing.T, fixture *Fixture) {
+	if fixture.Fail == nil {
+		t.Skip("Fixture cannot inject failures")
+	}
+
+	backend := fixture.Backend
+
+	calls := map[string]func() error{
+		"FetchFile": func() error {
+			_, _, err := backend.FetchFile("main.conf", "")
+			return err
+		},
+		"ListFiles": func() error {
+			_, err := backend.ListFiles("*.conf")
+			return err
+		},
+		"PutFile": func() error {
+			return backend.PutFile("main.conf", []byte("user alice\n"))
+		},
+		"FetchNetworkInfo": func() error {
+			_, err := backend.FetchNetworkInfo()
+			return err
+		},
+		"FetchGroup": func() error {
+			_, err := backend.FetchGroup("admins")
+			return err
+		},
+		"FetchGroupsForUser": func() error {
+			_, err := backend.FetchGroupsForUser("alice")
+			return err
+		},
+		"FetchKeys": func() error {
+			_, err := backend.FetchKeys("alice")
+			return err
+		},
+		"FetchKey": func() error {
+			_, err := backend.FetchKey("alice", "laptop")
+			return err
+		},
+		"RegisterDNS": func() error {
+			return backend.RegisterDNS("example.com.", "vpn.example.com.", false)
+		},
+		"UnregisterDNS": func() error {
+			return backend.UnregisterDNS()
+		},
+	}
+
+	for method, call := range calls {
+		fixture.Fail(method, errInjected)
+
+		if err := call(); !errors.Is(err, errInjected) {
+			t.Errorf("%s returned %v with an injected failure", method, err)
+		}
+
+		fixture.Fail(method, nil)
+
+		if err := call(); err != nil {
+			t.Errorf("%s returned %v after the failure was removed", method, err)
+		}
+	}
+}
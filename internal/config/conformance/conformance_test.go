@@ -0,0 +1,25 @@
+package conformance
+
+import (
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	Run(t, Memory)
+}
+
+func TestLocal(t *testing.T) {
+	Run(t, Local)
+}
+
+func TestLDAP(t *testing.T) {
+	Run(t, LDAP)
+}
+
+func TestComposite(t *testing.T) {
+	Run(t, Composite)
+}
+
+func TestCached(t *testing.T) {
+	Run(t, Cached)
+}
@@ -0,0 +1,244 @@
+package conformance
+
+import (
+	"fmt"
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/amadigan/openvpn-aws/internal/config/ldaptest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Memory returns a fixture for a new config.MemoryConfig
+func Memory(t *testing.T) *Fixture {
+	backend := config.NewMemoryConfig()
+
+	return &Fixture{
+		Backend: backend,
+		AddUser: func(user string) error {
+			backend.AddUser(user)
+			return nil
+		},
+		AddKey: func(user, keyId string, key []byte) (string, error) {
+			backend.AddKey(user, keyId, key)
+			return keyId, nil
+		},
+		AddToGroup: func(group string, users ...string) error {
+			backend.AddToGroup(group, users...)
+			return nil
+		},
+		Fail: backend.Fail,
+	}
+}
+
+// Local returns a fixture for a config.LocalConfig in a new temporary directory
+func Local(t *testing.T) *Fixture {
+	root, err := ioutil.TempDir("", "conformance")
+
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	backend := &config.LocalConfig{Root: root}
+	groups := make(map[string][]string)
+
+	return &Fixture{
+		Backend: backend,
+		AddUser: func(user string) error {
+			return os.MkdirAll(filepath.Join(root, "user", user), 0755)
+		},
+		AddKey: func(user, keyId string, key []byte) (string, error) {
+			return keyId, backend.PutFile(filepath.Join("user", user, keyId), key)
+		},
+		AddToGroup: func(group string, users ...string) error {
+			groups[group] = append(groups[group], users...)
+			return backend.PutFile("groups", formatGroups(groups))
+		},
+		Close: func() {
+			os.RemoveAll(root)
+		},
+	}
+}
+
+// formatGroups returns the groups file of LocalConfig, one line per group with its members
+func formatGroups(groups map[string][]string) []byte {
+	names := make([]string, 0, len(groups))
+
+	for name := range groups {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var rv strings.Builder
+
+	for _, name := range names {
+		fmt.Fprintf(&rv, "%s %s\n", name, strings.Join(groups[name], " "))
+	}
+
+	return []byte(rv.String())
+}
+
+// LDAP returns a fixture for a config.LDAPConfig reading an ldaptest.Server, with files in a config.MemoryConfig
+func LDAP(t *testing.T) *Fixture {
+	server, err := ldaptest.NewServer()
+
+	if err != nil {
+		t.Fatalf("Error starting LDAP server: %s", err)
+	}
+
+	const bindDN = "cn=vpn,dc=example,dc=com"
+	const people = "ou=people,dc=example,dc=com"
+	const groups = "ou=groups,dc=example,dc=com"
+
+	server.SetPassword(bindDN, "secret")
+	server.Add("dc=example,dc=com", map[string][]string{"objectClass": {"domain"}, "dc": {"example"}})
+	server.Add(people, map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"people"}})
+	server.Add(groups, map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"groups"}})
+
+	settings := config.LDAPSettings{
+		URL:          server.URL(),
+		BindDN:       bindDN,
+		BindPassword: "secret",
+		UserBase:     people,
+		GroupBase:    groups,
+	}
+
+	backend, err := config.NewLDAPConfig(settings, config.NewMemoryConfig())
+
+	if err != nil {
+		server.Close()
+		t.Fatalf("Error connecting to LDAP server: %s", err)
+	}
+
+	users := make(map[string]bool)
+	addUser := func(user string) string {
+		dn := "uid=" + user + "," + people
+
+		if !users[user] {
+			server.Add(dn, map[string][]string{"objectClass": {"person", "ldapPublicKey"}, "uid": {user}})
+			users[user] = true
+		}
+
+		return dn
+	}
+
+	return &Fixture{
+		Backend: backend,
+		AddUser: func(user string) error {
+			addUser(user)
+			return nil
+		},
+		AddKey: func(user, keyId string, key []byte) (string, error) {
+			before, err := backend.FetchKeys(user)
+
+			if err != nil {
+				return "", err
+			}
+
+			server.AddValues(addUser(user), "sshPublicKey", string(key))
+			after, err := backend.FetchKeys(user)
+
+			if err != nil {
+				return "", err
+			}
+
+			// The backend derives the id from the key
+			for _, id := range after {
+				if !containsString(before, id) {
+					return id, nil
+				}
+			}
+
+			return "", fmt.Errorf("Key of %s not found after adding it", user)
+		},
+		AddToGroup: func(group string, members ...string) error {
+			dn := "cn=" + group + "," + groups
+			server.AddValues(dn, "objectClass", "groupOfNames")
+			server.AddValues(dn, "cn", group)
+
+			for _, member := range members {
+				server.AddValues(dn, "member", addUser(member))
+			}
+
+			return nil
+		},
+		Close: func() {
+			server.Close()
+		},
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Composite returns a fixture for a config.CompositeConfig with a separate config.MemoryConfig for files, groups and
+// keys, and one for network info and DNS
+func Composite(t *testing.T) *Fixture {
+	files := config.NewMemoryConfig()
+	groups := config.NewMemoryConfig()
+	keys := config.NewMemoryConfig()
+	network := config.NewMemoryConfig()
+	backend := &config.CompositeConfig{Files: files, Network: network, Groups: groups, Keys: keys, DNS: network}
+
+	delegates := map[string]*config.MemoryConfig{
+		"FetchFile":          files,
+		"ListFiles":          files,
+		"PutFile":            files,
+		"FetchNetworkInfo":   network,
+		"FetchGroup":         groups,
+		"FetchGroupsForUser": groups,
+		"FetchKeys":          keys,
+		"FetchKey":           keys,
+		"RegisterDNS":        network,
+		"UnregisterDNS":      network,
+	}
+
+	return &Fixture{
+		Backend: backend,
+		AddUser: func(user string) error {
+			keys.AddUser(user)
+			return nil
+		},
+		AddKey: func(user, keyId string, key []byte) (string, error) {
+			keys.AddKey(user, keyId, key)
+			return keyId, nil
+		},
+		AddToGroup: func(group string, users ...string) error {
+			groups.AddToGroup(group, users...)
+			return nil
+		},
+		Fail: func(method string, err error) {
+			delegates[method].Fail(method, err)
+		},
+	}
+}
+
+// Cached returns a fixture for a config.CachedConfig wrapping a config.MemoryConfig, with its cache in a new temporary
+// directory. Failures of requests that were not cached reach the caller.
+func Cached(t *testing.T) *Fixture {
+	root, err := ioutil.TempDir("", "conformance")
+
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	fixture := Memory(t)
+	fixture.Backend = config.NewCachedConfig(fixture.Backend, filepath.Join(root, "backend.cache"), time.Hour)
+	fixture.Close = func() {
+		os.RemoveAll(root)
+	}
+
+	return fixture
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"net"
+	"sort"
+)
+
+type networkPorts struct {
+	network net.IPNet
+	ports   []Port
+}
+
+// applyDenies removes denied networks and ports from routes. Denies that cannot be expressed by narrowing the routes are
+// returned so they can be enforced by the firewall ahead of the routes.
+func applyDenies(routes map[networkKey]*routePorts, denies []networkPorts) []UserRoute {
+	firewallDenies := make(map[networkKey]*routePorts)
+
+	for _, deny := range denies {
+		keys := make([]networkKey, 0, len(routes))
+
+		for key := range routes {
+			keys = append(keys, key)
+		}
+
+		for _, key := range keys {
+			network := toIPNet(key)
+			ports := routes[key]
+
+			if !overlaps(network, deny.network) {
+				continue
+			}
+
+			if containsNetwork(deny.network, network) {
+				if len(deny.ports) == 0 {
+					delete(routes, key)
+				} else if ports.all {
+					addRoute(deny.network, deny.ports, firewallDenies)
+				} else {
+					ports.ports = subtractPorts(mergePorts(ports.ports), mergePorts(deny.ports))
+
+					if len(ports.ports) == 0 {
+						delete(routes, key)
+					}
+				}
+			} else if len(deny.ports) == 0 {
+				delete(routes, key)
+
+				for _, remaining := range excludeNetwork(network, deny.network) {
+					if ports.all {
+						addRoute(remaining, nil, routes)
+					} else {
+						addRoute(remaining, ports.ports, routes)
+					}
+				}
+			} else {
+				addRoute(deny.network, deny.ports, firewallDenies)
+			}
+		}
+	}
+
+	rv := make([]UserRoute, 0, len(firewallDenies))
+
+	for key, ports := range firewallDenies {
+		rv = append(rv, UserRoute{Network: toIPNet(key), Ports: mergePorts(ports.ports)})
+	}
+
+	sort.Slice(rv, func(i int, j int) bool { return rv[i].Network.String() < rv[j].Network.String() })
+
+	return rv
+}
+
+// denyRoutes merges denies by network, for enforcement by the firewall without regard to routes
+func denyRoutes(denies []networkPorts) []UserRoute {
+	merged := make(map[networkKey]*routePorts, len(denies))
+
+	for _, deny := range denies {
+		addRoute(deny.network, deny.ports, merged)
+	}
+
+	rv := make([]UserRoute, 0, len(merged))
+
+	for key, ports := range merged {
+		route := UserRoute{Network: toIPNet(key)}
+
+		if !ports.all {
+			route.Ports = mergePorts(ports.ports)
+		}
+
+		rv = append(rv, route)
+	}
+
+	sort.Slice(rv, func(i int, j int) bool { return rv[i].Network.String() < rv[j].Network.String() })
+
+	return rv
+}
+
+func overlaps(a, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// containsNetwork checks whether every address in inner is also in outer
+func containsNetwork(outer, inner net.IPNet) bool {
+	outerMask, outerBits := outer.Mask.Size()
+	innerMask, innerBits := inner.Mask.Size()
+
+	return outerBits == innerBits && outerMask <= innerMask && outer.Contains(inner.IP)
+}
+
+// excludeNetwork splits network into the smallest set of networks covering it without exclude, which must be contained
+// by network
+func excludeNetwork(network, exclude net.IPNet) []net.IPNet {
+	ones, bits := network.Mask.Size()
+	excludeOnes, _ := exclude.Mask.Size()
+
+	ip := exclude.IP.To16()
+
+	if bits == 32 {
+		ip = exclude.IP.To4()
+	}
+
+	rv := make([]net.IPNet, 0, excludeOnes-ones)
+
+	for prefix := ones + 1; prefix <= excludeOnes; prefix++ {
+		mask := net.CIDRMask(prefix, bits)
+		sibling := make(net.IP, len(ip))
+		copy(sibling, ip.Mask(mask))
+
+		bit := prefix - 1
+		sibling[bit/8] ^= 0x80 >> uint(bit%8)
+
+		rv = append(rv, net.IPNet{IP: sibling, Mask: mask})
+	}
+
+	return rv
+}
+
+// subtractPorts removes the denied ports from ports, both must be merged
+func subtractPorts(ports []Port, denied []Port) []Port {
+	var rv []Port
+
+	for _, port := range ports {
+		remaining := []Port{port}
+
+		for _, deny := range denied {
+			if deny.Protocol != port.Protocol {
+				continue
+			}
+
+			next := remaining[:0:0]
+
+			for _, r := range remaining {
+				if deny.From == 0 {
+					continue
+				}
+
+				if r.From == 0 {
+					r.From = 1
+					r.To = 65535
+				}
+
+				if deny.To < r.From || deny.From > r.To {
+					next = append(next, r)
+					continue
+				}
+
+				if deny.From > r.From {
+					next = append(next, Port{Protocol: r.Protocol, From: r.From, To: deny.From - 1})
+				}
+
+				if deny.To < r.To {
+					next = append(next, Port{Protocol: r.Protocol, From: deny.To + 1, To: r.To})
+				}
+			}
+
+			remaining = next
+		}
+
+		rv = append(rv, remaining...)
+	}
+
+	return rv
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func parseNetwork(t *testing.T, cidr string) net.IPNet {
+	t.Helper()
+
+	_, network, err := net.ParseCIDR(cidr)
+
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", cidr, err)
+	}
+
+	return *network
+}
+
+func routesString(routes []UserRoute) string {
+	rv := make([]string, 0, len(routes))
+
+	for _, route := range routes {
+		rv = append(rv, route.String())
+	}
+
+	return strings.Join(rv, ", ")
+}
+
+func TestExcludeNetwork(t *testing.T) {
+	for _, test := range []struct {
+		network  string
+		exclude  string
+		expected string
+	}{
+		{"10.0.0.0/16", "10.0.0.0/16", ""},
+		{"10.0.0.0/16", "10.0.0.0/17", "10.0.128.0/17"},
+		{"10.0.0.0/16", "10.0.1.0/24", "10.0.128.0/17 10.0.64.0/18 10.0.32.0/19 10.0.16.0/20 10.0.8.0/21 10.0.4.0/22 10.0.2.0/23 10.0.0.0/24"},
+		{"10.0.0.0/30", "10.0.0.3/32", "10.0.0.0/31 10.0.0.2/32"},
+		{"fd00::/62", "fd00:0:0:1::/64", "fd00:0:0:2::/63 fd00::/64"},
+	} {
+		var networks []string
+
+		for _, network := range excludeNetwork(parseNetwork(t, test.network), parseNetwork(t, test.exclude)) {
+			networks = append(networks, network.String())
+		}
+
+		if strings.Join(networks, " ") != test.expected {
+			t.Errorf("excludeNetwork(%s, %s) = %q, expected %q", test.network, test.exclude, networks, test.expected)
+		}
+	}
+}
+
+func TestSubtractPorts(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		ports    []Port
+		denied   []Port
+		expected string
+	}{
+		{"disjoint", []Port{{TCP, 22, 22}}, []Port{{TCP, 443, 443}}, "22"},
+		{"exact", []Port{{TCP, 22, 22}}, []Port{{TCP, 22, 22}}, ""},
+		{"middle of range", []Port{{TCP, 8000, 8100}}, []Port{{TCP, 8050, 8059}}, "8000-8049 8060-8100"},
+		{"start of range", []Port{{TCP, 8000, 8100}}, []Port{{TCP, 7000, 8009}}, "8010-8100"},
+		{"several denies", []Port{{TCP, 1, 100}}, []Port{{TCP, 10, 19}, {TCP, 50, 100}}, "1-9 20-49"},
+		{"whole protocol", []Port{{UDP, 53, 53}, {UDP, 123, 123}}, []Port{{UDP, 0, 0}}, ""},
+		{"from every port", []Port{{TCP, 0, 0}}, []Port{{TCP, 22, 22}}, "1-21 23-65535"},
+		{"protocol mismatch", []Port{{TCP, 53, 53}, {ICMP, 0, 0}}, []Port{{UDP, 53, 53}}, "53 icmp"},
+		{"other protocol kept", []Port{{TCP, 53, 53}, {UDP, 53, 53}}, []Port{{UDP, 0, 0}}, "53"},
+	} {
+		if result := portsString(subtractPorts(test.ports, test.denied)); result != test.expected {
+			t.Errorf("%s: subtractPorts() = %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestApplyDenies(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		routes   []networkPorts
+		denies   []networkPorts
+		expected string // Remaining routes
+		firewall string // Denies left to the firewall
+	}{
+		{
+			name:     "whole route",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16")}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.0.0.0/8")}},
+			expected: "",
+		},
+		{
+			name:     "unrelated",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16")}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.2.0.0/16")}},
+			expected: "10.1.0.0/16",
+		},
+		{
+			name:     "split network",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/22"), ports: []Port{{TCP, 22, 22}}}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.1.1.0/24")}},
+			expected: "10.1.0.0/24 22, 10.1.2.0/23 22",
+		},
+		{
+			name: "split network keeps other routes",
+			routes: []networkPorts{
+				{network: parseNetwork(t, "10.1.0.0/23")},
+				{network: parseNetwork(t, "10.1.0.0/24"), ports: []Port{{TCP, 443, 443}}},
+			},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.1.1.0/24")}},
+			expected: "10.1.0.0/24",
+		},
+		{
+			name:     "port subtraction",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16"), ports: []Port{{TCP, 8000, 8100}, {UDP, 53, 53}}}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.0.0.0/8"), ports: []Port{{TCP, 8080, 8080}}}},
+			expected: "10.1.0.0/16 8000-8079 8081-8100 udp/53",
+		},
+		{
+			name:     "protocol mismatch",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16"), ports: []Port{{TCP, 53, 53}}}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16"), ports: []Port{{UDP, 53, 53}}}},
+			expected: "10.1.0.0/16 53",
+		},
+		{
+			name:     "every port denied",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16"), ports: []Port{{TCP, 22, 22}}}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16"), ports: []Port{{TCP, 0, 0}}}},
+			expected: "",
+		},
+		{
+			name:     "ports of all traffic",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16")}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16"), ports: []Port{{TCP, 22, 22}}}},
+			expected: "10.1.0.0/16",
+			firewall: "10.1.0.0/16 22",
+		},
+		{
+			name:     "ports of part of a route",
+			routes:   []networkPorts{{network: parseNetwork(t, "10.1.0.0/16"), ports: []Port{{TCP, 22, 22}}}},
+			denies:   []networkPorts{{network: parseNetwork(t, "10.1.2.0/24"), ports: []Port{{TCP, 22, 22}}}},
+			expected: "10.1.0.0/16 22",
+			firewall: "10.1.2.0/24 22",
+		},
+	} {
+		routes := make(map[networkKey]*routePorts)
+
+		for _, route := range test.routes {
+			addRoute(route.network, route.ports, routes)
+		}
+
+		firewall := applyDenies(routes, test.denies)
+
+		var remaining []UserRoute
+
+		for key, ports := range routes {
+			route := UserRoute{Network: toIPNet(key)}
+
+			if !ports.all {
+				route.Ports = mergePorts(ports.ports)
+			}
+
+			remaining = append(remaining, route)
+		}
+
+		sort.Slice(remaining, func(i int, j int) bool { return remaining[i].Network.String() < remaining[j].Network.String() })
+
+		if result := routesString(remaining); result != test.expected {
+			t.Errorf("%s: routes %q, expected %q", test.name, result, test.expected)
+		}
+
+		if result := routesString(firewall); result != test.firewall {
+			t.Errorf("%s: firewall denies %q, expected %q", test.name, result, test.firewall)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package config
+
+import (
+	"io"
+	"sort"
+	"strings"
+)
+
+// commentKey identifies a line of the canonical configuration by its section header and text, a line of "" is the
+// header itself
+type commentKey struct {
+	section string
+	line    string
+}
+
+type comments struct {
+	leading  []string
+	trailing string
+}
+
+// FormatConfig parses a single configuration file and returns it in canonical form. Comments are kept, include
+// statements are kept rather than followed, and statements that are not understood are kept unchanged.
+func FormatConfig(name string, reader io.Reader) (string, error) {
+	configFile := newConfigFile()
+	configFile.formatting = true
+
+	err := configFile.parse(OpenFile(name, reader), nil, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	return configFile.String(), nil
+}
+
+// recordComments stores the comments of a statement under the canonical form of the statement
+func (configFile *ConfigFile) recordComments(stmt *ConfigStatement) {
+	if len(stmt.Comments) == 0 && stmt.Comment == "" {
+		return
+	}
+
+	var key commentKey
+
+	if stmt.Word == "" {
+		key.section = sectionHeader(stmt.SectionType, stmt.SectionName)
+	} else if stmt.SectionType == "" {
+		key.line = strings.Join(append([]string{stmt.Word}, stmt.Fields...), " ")
+	} else {
+		key.section = sectionHeader(stmt.SectionType, stmt.SectionName)
+		key.line = canonicalLine(stmt)
+	}
+
+	entry := configFile.comments[key]
+
+	if entry == nil {
+		entry = new(comments)
+		configFile.comments[key] = entry
+	}
+
+	entry.leading = append(entry.leading, stmt.Comments...)
+
+	if entry.trailing == "" {
+		entry.trailing = stmt.Comment
+	} else if stmt.Comment != "" {
+		entry.leading = append(entry.leading, stmt.Comment)
+	}
+}
+
+// canonicalLine returns the statement as it is written by String, without indentation
+func canonicalLine(stmt *ConfigStatement) string {
+	var lines []string
+
+	// Statements with variables are written unchanged, see keepVerbatim, as are statements that are not understood
+	if line := strings.Join(append([]string{stmt.Word}, stmt.Fields...), " "); hasVariable(line) {
+		return line
+	}
+
+	switch stmt.SectionType {
+	case "global":
+		configFile := newConfigFile()
+
+		if isGlobal, err := parseGlobal(configFile, stmt); isGlobal && err == nil {
+			lines = configFile.globalLines()
+		} else if err == nil && parseSection(configFile.GlobalConfig, stmt) == nil {
+			lines = configFile.GlobalConfig.lines()
+		}
+	case "network":
+		alias := &NetworkAlias{Name: stmt.SectionName}
+
+		if parseNetworkSection(alias, stmt) == nil {
+			lines = alias.lines()
+		}
+	case "group", "user":
+		section := &SectionConfig{Type: GROUP}
+
+		if parseSection(section, stmt) == nil {
+			lines = section.lines()
+		}
+	}
+
+	// A statement listing several values is written one value per line, its comments are kept with the first
+	if len(lines) != 0 {
+		return lines[0]
+	}
+
+	return strings.Join(append([]string{stmt.Word}, stmt.Fields...), " ")
+}
+
+// keepVerbatim records a statement containing variables to be written unchanged, it cannot be parsed until they are
+// substituted. It returns false if the statement has no variables.
+func (configFile *ConfigFile) keepVerbatim(stmt *ConfigStatement) bool {
+	if !hasVariable(strings.Join(append([]string{stmt.Word}, stmt.Fields...), " ")) {
+		return false
+	}
+
+	configFile.addVerbatim(stmt)
+
+	return true
+}
+
+// addVerbatim records a statement to be written unchanged at the end of its section
+func (configFile *ConfigFile) addVerbatim(stmt *ConfigStatement) {
+	if configFile.verbatim == nil {
+		configFile.verbatim = make(map[string][]string)
+	}
+
+	header := sectionHeader(stmt.SectionType, stmt.SectionName)
+	configFile.verbatim[header] = append(configFile.verbatim[header], strings.Join(append([]string{stmt.Word}, stmt.Fields...), " "))
+}
+
+func sectionHeader(sectionType, name string) string {
+	if name == "" {
+		return sectionType
+	}
+
+	return sectionType + " " + name
+}
+
+// configWriter writes sections of the configuration along with their comments
+type configWriter struct {
+	builder  strings.Builder
+	comments map[commentKey]*comments
+	written  map[commentKey]bool // Comments are only written once for lines that are repeated
+	sections int
+}
+
+func (w *configWriter) line(section, line, indent string) {
+	key := commentKey{section: section, line: line}
+	entry := w.comments[key]
+
+	if line == "" {
+		line = section
+	}
+
+	if entry != nil && !w.written[key] {
+		w.written[key] = true
+
+		for _, comment := range entry.leading {
+			w.builder.WriteString(indent + comment + "\n")
+		}
+
+		if entry.trailing != "" {
+			line += " " + entry.trailing
+		}
+	}
+
+	w.builder.WriteString(indent + line + "\n")
+}
+
+func (w *configWriter) section(header string, lines []string) {
+	if w.sections > 0 {
+		w.builder.WriteString("\n")
+	}
+
+	w.sections++
+	w.line(header, "", "")
+
+	for _, line := range lines {
+		w.line(header, line, "\t")
+	}
+}
+
+func (config *ConfigFile) String() string {
+	w := &configWriter{comments: config.comments, written: make(map[commentKey]bool)}
+
+	if len(config.includeStmts) != 0 {
+		for _, include := range config.includeStmts {
+			w.line("", include, "")
+		}
+
+		w.sections++
+	}
+
+	globalLines := append(config.globalLines(), config.GlobalConfig.lines()...)
+	globalLines = append(globalLines, config.verbatim["global"]...)
+
+	if len(globalLines) != 0 || w.comments[commentKey{section: "global"}] != nil || !config.formatting {
+		w.section("global", globalLines)
+	}
+
+	networks := make([]*NetworkAlias, 0, len(config.Networks))
+
+	for _, network := range config.Networks {
+		networks = append(networks, network)
+	}
+
+	sort.Slice(networks, func(i int, j int) bool { return networks[i].Order < networks[j].Order })
+
+	for _, network := range networks {
+		w.section(network.header(), append(network.lines(), config.verbatim[network.header()]...))
+	}
+
+	for _, sections := range []map[string]*SectionConfig{config.Groups, config.Users} {
+		sorted := make([]*SectionConfig, 0, len(sections))
+
+		for _, section := range sections {
+			sorted = append(sorted, section)
+		}
+
+		sort.Slice(sorted, func(i int, j int) bool { return sorted[i].Order < sorted[j].Order })
+
+		for _, section := range sorted {
+			w.section(section.header(), append(section.lines(), config.verbatim[section.header()]...))
+		}
+	}
+
+	if len(config.trailer) != 0 {
+		if w.sections > 0 {
+			w.builder.WriteString("\n")
+		}
+
+		for _, comment := range config.trailer {
+			w.builder.WriteString(comment + "\n")
+		}
+	}
+
+	return w.builder.String()
+}
@@ -0,0 +1,265 @@
+package config
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// docsConf is the sample configuration of docs/configuration.md
+const docsConf = `global
+  net 169.254.121.0/24
+  route53 Z4C9QKLRTRVI8Q vpn.example.com
+  watch 5m
+  dns off
+
+group rds-access
+  dns on
+  subnet-0c02187459d3a72b2
+
+group ssh
+
+group customer-service
+  subnet-0c0897424d3a75b4
+
+user joe
+`
+
+const commentedConf = `# Tunnel settings
+global
+  port 443
+  proto tcp
+  keepalive 10 120
+  net 169.254.121.0/24 # the tunnel network
+  net6 fd00:1::/64
+  dns on
+
+# Databases reachable by analysts
+network databases
+  subnet-0c02187459d3a72b2 5432
+  10.20.0.0/16 5432 3306
+
+group platform
+  route 10.20.0.0/16 8000-8100 udp/53 icmp
+  nat on
+
+group platform-oncall
+  inherits platform
+  schedule sat,sun 00:00-24:00
+  subnets name:prod-* tag:Tier=db 5432
+  route fd00:2::/64
+  max-connections 2 reject
+  bandwidth 10mbit 2mbit
+  frobnicate 1 2 # not understood by this version
+  ip-pool 169.254.121.192/27
+
+user joe
+  deny databases # no production data
+  dns-server 10.0.0.2 10.0.0.3
+  dns-search example.com corp.example.com
+  tunnel full
+  session-timeout 8h
+  ip 169.254.121.130
+
+# Trailing comment
+`
+
+// expectSameConfig checks that two configurations have the same settings and sections
+func expectSameConfig(t *testing.T, name string, expected, actual *ConfigFile) {
+	t.Helper()
+
+	for _, field := range []struct {
+		name     string
+		expected interface{}
+		actual   interface{}
+	}{
+		{"WatchTime", expected.WatchTime, actual.WatchTime},
+		{"Network", expected.Network, actual.Network},
+		{"Network6", expected.Network6, actual.Network6},
+		{"Route53Zone", expected.Route53Zone, actual.Route53Zone},
+		{"DomainName", expected.DomainName, actual.DomainName},
+		{"Route53Weighted", expected.Route53Weighted, actual.Route53Weighted},
+		{"KeyStrength", expected.KeyStrength, actual.KeyStrength},
+		{"Server", expected.Server, actual.Server},
+		{"GlobalConfig", expected.GlobalConfig, actual.GlobalConfig},
+		{"Groups", expected.Groups, actual.Groups},
+		{"Users", expected.Users, actual.Users},
+		{"Networks", expected.Networks, actual.Networks},
+		{"Includes", expected.Includes, actual.Includes},
+	} {
+		if !reflect.DeepEqual(field.expected, field.actual) {
+			t.Errorf("%s: %s differs after formatting: %+v, expected %+v", name, field.name, field.actual, field.expected)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		conf string
+	}{
+		{"docs", docsConf},
+		{"commented", commentedConf},
+	} {
+		formatted, err := FormatConfig("vpn.conf", strings.NewReader(test.conf))
+
+		if err != nil {
+			t.Fatalf("%s: error formatting: %s", test.name, err)
+		}
+
+		original, err := ParseConfig(strings.NewReader(test.conf))
+
+		if err != nil {
+			t.Fatalf("%s: error parsing: %s", test.name, err)
+		}
+
+		reparsed, err := ParseConfig(strings.NewReader(formatted))
+
+		if err != nil {
+			t.Fatalf("%s: error parsing formatted config: %s\n%s", test.name, err, formatted)
+		}
+
+		expectSameConfig(t, test.name, original, reparsed)
+
+		again, err := FormatConfig("vpn.conf", strings.NewReader(formatted))
+
+		if err != nil {
+			t.Fatalf("%s: error formatting again: %s", test.name, err)
+		}
+
+		if again != formatted {
+			t.Errorf("%s: formatting is not idempotent:\n%s\nthen:\n%s", test.name, formatted, again)
+		}
+	}
+}
+
+func TestFormatNoTrailingNewline(t *testing.T) {
+	for _, conf := range []string{
+		"group devs\n  dns on\n  subnet-0abc 22",
+		"group devs\n  subnet-0abc 22\n# last comment",
+	} {
+		formatted, err := FormatConfig("vpn.conf", strings.NewReader(conf))
+
+		if err != nil {
+			t.Fatalf("Error formatting %q: %s", conf, err)
+		}
+
+		if !strings.Contains(formatted, "\tsubnet-0abc 22\n") {
+			t.Errorf("Expected the last statement of %q to be kept, got:\n%s", conf, formatted)
+		}
+
+		original, err := ParseConfig(strings.NewReader(conf))
+
+		if err != nil {
+			t.Fatalf("Error parsing %q: %s", conf, err)
+		}
+
+		if subnets := original.Groups["devs"].Subnets; len(subnets) != 1 {
+			t.Errorf("Expected the last statement of %q to be parsed, got subnets %v", conf, subnets)
+		}
+
+		reparsed, err := ParseConfig(strings.NewReader(formatted))
+
+		if err != nil {
+			t.Fatalf("Error parsing formatted config: %s\n%s", err, formatted)
+		}
+
+		expectSameConfig(t, "no trailing newline", original, reparsed)
+	}
+}
+
+func TestFormatKeepsComments(t *testing.T) {
+	formatted, err := FormatConfig("vpn.conf", strings.NewReader(commentedConf))
+
+	if err != nil {
+		t.Fatalf("Error formatting: %s", err)
+	}
+
+	for _, expected := range []string{
+		"# Tunnel settings\nglobal\n",
+		"\tnet 169.254.121.0/24 # the tunnel network\n",
+		"# Databases reachable by analysts\nnetwork databases\n",
+		"\tfrobnicate 1 2 # not understood by this version\n",
+		"\tdeny databases # no production data\n",
+		"\n# Trailing comment\n",
+	} {
+		if !strings.Contains(formatted, expected) {
+			t.Errorf("Expected %q in formatted config:\n%s", expected, formatted)
+		}
+	}
+}
+
+func TestFormatRoundTripIncludes(t *testing.T) {
+	backend := newIncludeBackend(t, map[string]string{
+		"vpn.conf":          "include users.conf\n# Groups are split by team\ninclude groups/*.conf\n\nglobal\n  net 169.254.121.0/24\n",
+		"users.conf":        "user joe\n  route 10.1.0.0/16 # office\n  frobnicate\n",
+		"groups/devs.conf":  "group devs\n  dns on\n  route 10.2.0.0/16 22\n",
+		"groups/other.conf": "group ops\n  nat off\n",
+	})
+
+	original, err := LoadConfig(backend, "vpn.conf")
+
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	for _, name := range []string{"vpn.conf", "users.conf", "groups/devs.conf", "groups/other.conf"} {
+		file, _, _ := backend.FetchFile(name, "")
+		formatted, err := FormatConfig(name, file)
+		file.Close()
+
+		if err != nil {
+			t.Fatalf("Error formatting %s: %s", name, err)
+		}
+
+		backend.PutFile(name, []byte(formatted))
+	}
+
+	vpnConf, _, _ := backend.FetchFile("vpn.conf", "")
+	formatted, _ := ioutil.ReadAll(vpnConf)
+	vpnConf.Close()
+
+	if !strings.HasPrefix(string(formatted), "include users.conf\n# Groups are split by team\ninclude groups/*.conf\n\nglobal\n") {
+		t.Errorf("Expected include statements to be kept, got:\n%s", formatted)
+	}
+
+	reparsed, err := LoadConfig(backend, "vpn.conf")
+
+	if err != nil {
+		t.Fatalf("Error loading formatted config: %s", err)
+	}
+
+	expectSameConfig(t, "includes", original, reparsed)
+}
+
+func TestFormatKeepsVariables(t *testing.T) {
+	conf := "global\n  net 169.254.121.0/24\n  route53 ${ROUTE53_ZONE} vpn.${DOMAIN}\n\ngroup devs\n  route   ${aws:vpc-cidr}   22\n  dns on\n  dns-search $${literal}\n"
+
+	formatted, err := FormatConfig("vpn.conf", strings.NewReader(conf))
+
+	if err != nil {
+		t.Fatalf("Error formatting: %s", err)
+	}
+
+	// Undefined variables are not an error, statements with variables are written unchanged apart from their spacing
+	for _, expected := range []string{
+		"\troute53 ${ROUTE53_ZONE} vpn.${DOMAIN}\n",
+		"\troute ${aws:vpc-cidr} 22\n",
+		"\tdns-search $${literal}\n",
+	} {
+		if !strings.Contains(formatted, expected) {
+			t.Errorf("Expected %q in formatted config:\n%s", expected, formatted)
+		}
+	}
+
+	again, err := FormatConfig("vpn.conf", strings.NewReader(formatted))
+
+	if err != nil {
+		t.Fatalf("Error formatting again: %s", err)
+	}
+
+	if again != formatted {
+		t.Errorf("Formatting is not idempotent:\n%s\nthen:\n%s", formatted, again)
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+type inheritReference struct {
+	group  string
+	parent string
+	stmt   *ConfigStatement
+}
+
+// appendGroup appends the inherited groups of group followed by group itself to sections, skipping groups that have
+// already been added. Groups outside of their schedule are skipped along with the groups they inherit, scheduled is true
+// if any group was skipped for this reason. Cycles are rejected by resolveInherits when the file is parsed.
+func (config *ConfigFile) appendGroup(sections []*SectionConfig, group *SectionConfig, now time.Time, added map[*SectionConfig]bool) ([]*SectionConfig, bool) {
+	if added[group] {
+		return sections, false
+	}
+
+	if !sectionActive(group, now) {
+		return sections, true
+	}
+
+	scheduled := false
+
+	for _, name := range group.Inherits {
+		parent := config.Groups[name]
+
+		if parent == nil {
+			continue
+		}
+
+		var skipped bool
+		sections, skipped = config.appendGroup(sections, parent, now, added)
+		scheduled = scheduled || skipped
+	}
+
+	added[group] = true
+
+	return append(sections, group), scheduled
+}
+
+// resolveInherits checks that every inherited group is defined and that no group inherits itself
+func (configFile *ConfigFile) resolveInherits() error {
+	parents := make(map[string][]inheritReference)
+
+	for _, ref := range configFile.inheritRefs {
+		if _, exists := configFile.Groups[ref.parent]; !exists {
+			return ref.stmt.Errorf("undefined group %s", ref.parent)
+		}
+
+		parents[ref.group] = append(parents[ref.group], ref)
+	}
+
+	done := make(map[string]bool)
+
+	var visit func(group string, path []string) error
+
+	visit = func(group string, path []string) error {
+		if done[group] {
+			return nil
+		}
+
+		path = append(path, group)
+
+		for _, ref := range parents[group] {
+			for _, name := range path {
+				if name == ref.parent {
+					return ref.stmt.Errorf("group %s inherits itself: %s", ref.parent, strings.Join(append(path, ref.parent), " -> "))
+				}
+			}
+
+			if err := visit(ref.parent, path); err != nil {
+				return err
+			}
+		}
+
+		done[group] = true
+
+		return nil
+	}
+
+	for _, ref := range configFile.inheritRefs {
+		if err := visit(ref.group, nil); err != nil {
+			return err
+		}
+	}
+
+	configFile.inheritRefs = nil
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInheritsCycle(t *testing.T) {
+	_, err := ParseConfig(strings.NewReader(`group a
+  inherits b
+
+group b
+  inherits a
+`))
+
+	if err == nil || !strings.Contains(err.Error(), "inherits itself: ") {
+		t.Fatalf("Expected a cycle error, got %v", err)
+	}
+}
+
+// inheritUserConfig parses conf and builds the config of joe as a member of groups on a Monday morning
+func inheritUserConfig(t *testing.T, conf string, groups ...string) (*UserConfig, error) {
+	t.Helper()
+
+	configFile, err := ParseConfig(strings.NewReader(conf))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	return configFile.GetUserConfig("joe", groups, &NetworkInfo{}, now)
+}
+
+func TestInheritsTransitive(t *testing.T) {
+	userConf, err := inheritUserConfig(t, `group c
+  route 10.3.0.0/16
+  dns-search c.example
+
+group b
+  inherits c
+  route 10.2.0.0/16
+  dns-search b.example
+
+group a
+  inherits b
+  route 10.1.0.0/16
+  dns-search a.example
+`, "a")
+
+	if err != nil {
+		t.Fatalf("Error getting config: %s", err)
+	}
+
+	if routes := routesString(userConf.Routes); routes != "10.1.0.0/16, 10.2.0.0/16, 10.3.0.0/16" {
+		t.Errorf("Expected the routes of every inherited group, got %q", routes)
+	}
+
+	// Inherited groups are applied first
+	if search := strings.Join(userConf.DNSSearch, " "); search != "c.example b.example a.example" {
+		t.Errorf("DNSSearch = %q, expected \"c.example b.example a.example\"", search)
+	}
+}
+
+func TestInheritsPrecedence(t *testing.T) {
+	userConf, err := inheritUserConfig(t, `group parent
+  dns on
+  nat off
+  dns-domain parent.example
+  max-connections 3 reject
+
+group child
+  inherits parent
+  dns off
+  nat on
+  dns-domain child.example
+`, "child")
+
+	if err != nil {
+		t.Fatalf("Error getting config: %s", err)
+	}
+
+	if userConf.DNSSetting != OFF || userConf.NATSetting != ALL || userConf.DNSDomain != "child.example" {
+		t.Errorf("Expected the settings of the child to take precedence, got dns %d, nat %d, domain %s", userConf.DNSSetting, userConf.NATSetting, userConf.DNSDomain)
+	}
+
+	// Settings the child does not set are inherited
+	if userConf.MaxConnections != 3 || userConf.ConnectionLimit != REJECT {
+		t.Errorf("Expected max-connections of the parent, got %d %s", userConf.MaxConnections, userConf.ConnectionLimit)
+	}
+}
+
+func TestInheritsSchedule(t *testing.T) {
+	// The parent only applies on weekends, the child at any time
+	userConf, err := inheritUserConfig(t, `group parent
+  schedule sat,sun 00:00-24:00
+  route 10.1.0.0/16
+
+group child
+  inherits parent
+  route 10.2.0.0/16
+`, "child")
+
+	if err != nil {
+		t.Fatalf("Error getting config: %s", err)
+	}
+
+	if routes := routesString(userConf.Routes); routes != "10.2.0.0/16" {
+		t.Errorf("Expected only the routes of the child outside the schedule of the parent, got %q", routes)
+	}
+
+	// A child outside of its schedule does not apply its parent either
+	_, err = inheritUserConfig(t, `group parent
+  route 10.1.0.0/16
+
+group child
+  inherits parent
+  schedule sat,sun 00:00-24:00
+  route 10.2.0.0/16
+`, "child")
+
+	if !errors.Is(err, ErrOutsideSchedule) {
+		t.Errorf("Expected joe to be outside the schedule of the child, got %v", err)
+	}
+}
+
+func TestInheritsDirectMember(t *testing.T) {
+	parentFirst := `group parent
+  route 10.1.0.0/16
+  dns-search parent.example
+
+group child
+  inherits parent
+  dns-search child.example
+`
+
+	childFirst := `group child
+  inherits parent
+  dns-search child.example
+
+group parent
+  route 10.1.0.0/16
+  dns-search parent.example
+`
+
+	for _, test := range []struct {
+		conf   string
+		groups []string
+	}{
+		{parentFirst, []string{"parent", "child"}},
+		{parentFirst, []string{"child", "parent"}},
+		{childFirst, []string{"parent", "child"}},
+		{childFirst, []string{"child", "parent"}},
+	} {
+		userConf, err := inheritUserConfig(t, test.conf, test.groups...)
+
+		if err != nil {
+			t.Fatalf("Error getting config: %s", err)
+		}
+
+		// The parent is applied once, ahead of the child
+		if search := strings.Join(userConf.DNSSearch, " "); search != "parent.example child.example" {
+			t.Errorf("DNSSearch of a member of %v = %q, expected \"parent.example child.example\"", test.groups, search)
+		}
+
+		if routes := routesString(userConf.Routes); routes != "10.1.0.0/16" {
+			t.Errorf("Routes of a member of %v = %q, expected \"10.1.0.0/16\"", test.groups, routes)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// ldapTimeout limits each request to the directory
+const ldapTimeout = 30 * time.Second
+
+const ldapPageSize = 500
+
+// LDAPSettings select the users, groups and keys of an LDAP directory
+type LDAPSettings struct {
+	URL             string // ldap:// or ldaps:// URL of the server
+	StartTLS        bool   // Upgrade an ldap:// connection with StartTLS
+	BindDN          string // Empty for an anonymous bind
+	BindPassword    string
+	UserBase        string // Base DN searched for users
+	UserFilter      string // Filter matching every user
+	UserAttribute   string // Attribute holding the user name
+	KeyAttribute    string // Attribute holding the public keys of a user, as PEM, OpenSSH or DER
+	GroupBase       string // Base DN searched for groups
+	GroupFilter     string // Filter matching every group
+	GroupAttribute  string // Attribute holding the group name
+	MemberAttribute string // Attribute holding the DN of each member of a group
+}
+
+// DefaultLDAPSettings are used for settings that are not set, they suit OpenLDAP and Active Directory
+var DefaultLDAPSettings = LDAPSettings{
+	UserFilter:      "(objectClass=person)",
+	UserAttribute:   "uid",
+	KeyAttribute:    "sshPublicKey",
+	GroupFilter:     "(|(objectClass=groupOfNames)(objectClass=group))",
+	GroupAttribute:  "cn",
+	MemberAttribute: "member",
+}
+
+// LDAPConfig reads users, groups and keys from an LDAP directory. Files, network info and DNS are provided by another
+// backend.
+type LDAPConfig struct {
+	settings LDAPSettings
+	files    ConfigurationBackend
+	lock     sync.Mutex
+	conn     *ldap.Conn
+}
+
+// ldapGroup is a group entry, with the normalized DN of each member
+type ldapGroup struct {
+	name    string
+	members []string
+}
+
+// NewLDAPConfig connects to the directory in settings, files provides everything else
+func NewLDAPConfig(settings LDAPSettings, files ConfigurationBackend) (*LDAPConfig, error) {
+	defaults := DefaultLDAPSettings
+
+	for _, setting := range []struct {
+		value        *string
+		defaultValue string
+	}{
+		{&settings.UserFilter, defaults.UserFilter},
+		{&settings.UserAttribute, defaults.UserAttribute},
+		{&settings.KeyAttribute, defaults.KeyAttribute},
+		{&settings.GroupFilter, defaults.GroupFilter},
+		{&settings.GroupAttribute, defaults.GroupAttribute},
+		{&settings.MemberAttribute, defaults.MemberAttribute},
+	} {
+		if *setting.value == "" {
+			*setting.value = setting.defaultValue
+		}
+	}
+
+	if settings.URL == "" {
+		return nil, errors.New("LDAP URL is not set")
+	}
+
+	if settings.UserBase == "" && settings.GroupBase == "" {
+		return nil, errors.New("LDAP user base and group base are not set")
+	} else if settings.UserBase == "" {
+		settings.UserBase = settings.GroupBase
+	} else if settings.GroupBase == "" {
+		settings.GroupBase = settings.UserBase
+	}
+
+	for _, filter := range []string{settings.UserFilter, settings.GroupFilter} {
+		if _, err := ldap.CompileFilter(filter); err != nil {
+			return nil, fmt.Errorf("Invalid LDAP filter %s: %w", filter, err)
+		}
+	}
+
+	config := &LDAPConfig{settings: settings, files: files}
+
+	if _, err := config.connect(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// connect returns the connection to the directory, connecting and binding if there is none
+func (c *LDAPConfig) connect() (*ldap.Conn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn != nil && !c.conn.IsClosing() {
+		return c.conn, nil
+	}
+
+	conn, err := ldap.DialURL(c.settings.URL)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %w", c.settings.URL, err)
+	}
+
+	conn.SetTimeout(ldapTimeout)
+
+	if c.settings.StartTLS {
+		serverURL, err := url.Parse(c.settings.URL)
+
+		if err == nil {
+			err = conn.StartTLS(&tls.Config{ServerName: serverURL.Hostname()})
+		}
+
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Error starting TLS with %s: %w", c.settings.URL, err)
+		}
+	}
+
+	if c.settings.BindDN != "" {
+		if err := conn.Bind(c.settings.BindDN, c.settings.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Error binding to %s as %s: %w", c.settings.URL, c.settings.BindDN, err)
+		}
+	}
+
+	c.conn = conn
+
+	return conn, nil
+}
+
+// disconnect closes conn, so that the next request connects again
+func (c *LDAPConfig) disconnect(conn *ldap.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conn.Close()
+
+	if c.conn == conn {
+		c.conn = nil
+	}
+}
+
+// search returns the entries below base matching filter, a base that does not exist has no entries. A request that fails
+// because the connection was lost is retried once on a new connection.
+func (c *LDAPConfig) search(base, filter string, attributes []string) ([]*ldap.Entry, error) {
+	for retry := true; ; retry = false {
+		conn, err := c.connect()
+
+		if err != nil {
+			return nil, err
+		}
+
+		request := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout/time.Second), false, filter, attributes, nil)
+		result, err := conn.SearchWithPaging(request, ldapPageSize)
+
+		if err == nil {
+			return result.Entries, nil
+		}
+
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+
+		if retry && (conn.IsClosing() || ldap.IsErrorWithCode(err, ldap.ErrorNetwork)) {
+			logger.Warnf("Lost connection to %s, reconnecting: %s", c.settings.URL, err)
+			c.disconnect(conn)
+			continue
+		}
+
+		return nil, fmt.Errorf("Error searching %s for %s: %w", base, filter, err)
+	}
+}
+
+// fetchUser returns the entry of a user, or nil if the user does not exist
+func (c *LDAPConfig) fetchUser(user string, attributes ...string) (*ldap.Entry, error) {
+	filter := fmt.Sprintf("(&%s(%s=%s))", c.settings.UserFilter, c.settings.UserAttribute, ldap.EscapeFilter(user))
+	entries, err := c.search(c.settings.UserBase, filter, append(attributes, c.settings.UserAttribute))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) > 1 {
+		return nil, fmt.Errorf("User %s matches %d entries in %s", user, len(entries), c.settings.UserBase)
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	return entries[0], nil
+}
+
+// fetchGroups returns every group, by normalized DN
+func (c *LDAPConfig) fetchGroups() (map[string]*ldapGroup, error) {
+	entries, err := c.search(c.settings.GroupBase, c.settings.GroupFilter, []string{c.settings.GroupAttribute, c.settings.MemberAttribute})
+
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*ldapGroup, len(entries))
+
+	for _, entry := range entries {
+		name := entry.GetEqualFoldAttributeValue(c.settings.GroupAttribute)
+
+		if name == "" {
+			continue
+		}
+
+		group := &ldapGroup{name: name}
+
+		for _, member := range entry.GetEqualFoldAttributeValues(c.settings.MemberAttribute) {
+			group.members = append(group.members, normalizeDN(member))
+		}
+
+		groups[normalizeDN(entry.DN)] = group
+	}
+
+	return groups, nil
+}
+
+// normalizeDN returns a DN in a form that can be compared, with lower case attributes and values
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+
+	rdns := make([]string, len(parsed.RDNs))
+
+	for i, rdn := range parsed.RDNs {
+		attributes := make([]string, len(rdn.Attributes))
+
+		for j, attribute := range rdn.Attributes {
+			attributes[j] = strings.ToLower(attribute.Type) + "=" + strings.ToLower(attribute.Value)
+		}
+
+		sort.Strings(attributes)
+		rdns[i] = strings.Join(attributes, "+")
+	}
+
+	return strings.Join(rdns, ",")
+}
+
+// FetchGroup returns the users in a group and in the groups nested in it
+func (c *LDAPConfig) FetchGroup(name string) ([]string, error) {
+	groups, err := c.fetchGroups()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var queue []string
+
+	for dn, group := range groups {
+		if strings.EqualFold(group.name, name) {
+			queue = append(queue, dn)
+		}
+	}
+
+	if len(queue) == 0 {
+		return nil, nil
+	}
+
+	visited := make(map[string]bool)
+	members := make(map[string]bool)
+
+	for len(queue) != 0 {
+		dn := queue[0]
+		queue = queue[1:]
+
+		if visited[dn] {
+			continue
+		}
+
+		visited[dn] = true
+
+		for _, member := range groups[dn].members {
+			if groups[member] != nil {
+				queue = append(queue, member)
+			} else {
+				members[member] = true
+			}
+		}
+	}
+
+	users := []string{}
+
+	if len(members) == 0 {
+		return users, nil
+	}
+
+	entries, err := c.search(c.settings.UserBase, c.settings.UserFilter, []string{c.settings.UserAttribute})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Members that are not users, such as entries outside the user base, are ignored
+	for _, entry := range entries {
+		if user := entry.GetEqualFoldAttributeValue(c.settings.UserAttribute); user != "" && members[normalizeDN(entry.DN)] {
+			users = append(users, user)
+		}
+	}
+
+	sort.Strings(users)
+
+	return users, nil
+}
+
+// FetchGroupsForUser returns the groups a user is a member of, directly or through nested groups
+func (c *LDAPConfig) FetchGroupsForUser(user string) ([]string, error) {
+	entry, err := c.fetchUser(user)
+
+	if entry == nil {
+		return nil, err
+	}
+
+	groups, err := c.fetchGroups()
+
+	if err != nil {
+		return nil, err
+	}
+
+	memberOf := map[string]bool{normalizeDN(entry.DN): true}
+	var names []string
+
+	for added := true; added; {
+		added = false
+
+		for dn, group := range groups {
+			if memberOf[dn] {
+				continue
+			}
+
+			for _, member := range group.members {
+				if memberOf[member] {
+					memberOf[dn] = true
+					names = append(names, group.name)
+					added = true
+					break
+				}
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// userKeys returns the public keys of a user as PEM, by key id, or nil if the user does not exist. Values of the key
+// attribute that are not RSA public keys are ignored.
+func (c *LDAPConfig) userKeys(user string) (map[string][]byte, error) {
+	entry, err := c.fetchUser(user, c.settings.KeyAttribute)
+
+	if entry == nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+
+	for _, value := range entry.GetEqualFoldRawAttributeValues(c.settings.KeyAttribute) {
+		key, err := ldapPublicKey(value)
+
+		if err != nil {
+			logger.Warnf("Ignoring %s of %s: %s", c.settings.KeyAttribute, entry.DN, err)
+			continue
+		}
+
+		// Key ids must be unique across users, so the user is part of the hash
+		hash := sha256.Sum256(append([]byte(user+"\n"), key...))
+		keys[hex.EncodeToString(hash[:12])] = key
+	}
+
+	return keys, nil
+}
+
+// ldapPublicKey converts a PEM, OpenSSH or DER RSA public key to PEM
+func ldapPublicKey(value []byte) ([]byte, error) {
+	var der []byte
+
+	if block, _ := pem.Decode(value); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("PEM block is %s, not PUBLIC KEY", block.Type)
+		}
+
+		der = block.Bytes
+	} else if sshKey, _, _, _, err := ssh.ParseAuthorizedKey(value); err == nil {
+		cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+
+		if !ok {
+			return nil, fmt.Errorf("Unsupported key type %s", sshKey.Type())
+		}
+
+		if der, err = x509.MarshalPKIXPublicKey(cryptoKey.CryptoPublicKey()); err != nil {
+			return nil, err
+		}
+	} else {
+		der = value
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+
+	if err != nil {
+		return nil, errors.New("Value is not a PEM, OpenSSH or DER public key")
+	}
+
+	if _, ok := key.(*rsa.PublicKey); !ok {
+		return nil, errors.New("Key is not an RSA key")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func (c *LDAPConfig) FetchKeys(user string) ([]string, error) {
+	keys, err := c.userKeys(user)
+
+	if keys == nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(keys))
+
+	for id := range keys {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (c *LDAPConfig) FetchKey(user, key string) ([]byte, error) {
+	keys, err := c.userKeys(user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys[key], nil
+}
+
+func (c *LDAPConfig) FetchFile(path string, ifNotTag string) (io.ReadCloser, string, error) {
+	return c.files.FetchFile(path, ifNotTag)
+}
+
+func (c *LDAPConfig) ListFiles(pattern string) ([]string, error) {
+	return c.files.ListFiles(pattern)
+}
+
+func (c *LDAPConfig) PutFile(path string, data []byte) error {
+	return c.files.PutFile(path, data)
+}
+
+func (c *LDAPConfig) FetchNetworkInfo() (*NetworkInfo, error) {
+	return c.files.FetchNetworkInfo()
+}
+
+func (c *LDAPConfig) RegisterDNS(zone, name string, weighted bool) error {
+	return c.files.RegisterDNS(zone, name, weighted)
+}
+
+func (c *LDAPConfig) UnregisterDNS() error {
+	return c.files.UnregisterDNS()
+}
+
+// LookupVariable provides the variables of the backend holding the files
+func (c *LDAPConfig) LookupVariable(name string) (string, bool, error) {
+	if resolver, ok := c.files.(VariableResolver); ok {
+		return resolver.LookupVariable(name)
+	}
+
+	return "", false, nil
+}
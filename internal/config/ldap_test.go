@@ -0,0 +1,189 @@
+package config_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/amadigan/openvpn-aws/internal/config/conformance"
+	"github.com/amadigan/openvpn-aws/internal/config/ldaptest"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	ldapPeople = "ou=people,dc=example,dc=com"
+	ldapGroups = "ou=groups,dc=example,dc=com"
+)
+
+// newLDAPConfig starts a directory with the people and groups units, returning it with a backend that reads it
+func newLDAPConfig(t *testing.T) (*ldaptest.Server, *config.LDAPConfig) {
+	server, err := ldaptest.NewServer()
+
+	if err != nil {
+		t.Fatalf("Error starting LDAP server: %s", err)
+	}
+
+	server.Add(ldapPeople, map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"people"}})
+	server.Add(ldapGroups, map[string][]string{"objectClass": {"organizationalUnit"}, "ou": {"groups"}})
+
+	backend, err := config.NewLDAPConfig(config.LDAPSettings{URL: server.URL(), UserBase: ldapPeople, GroupBase: ldapGroups}, config.NewMemoryConfig())
+
+	if err != nil {
+		server.Close()
+		t.Fatalf("Error connecting to LDAP server: %s", err)
+	}
+
+	return server, backend
+}
+
+func addLDAPUser(server *ldaptest.Server, user string, keys ...string) string {
+	dn := "uid=" + user + "," + ldapPeople
+	server.Add(dn, map[string][]string{"objectClass": {"person", "ldapPublicKey"}, "uid": {user}, "sshPublicKey": keys})
+
+	return dn
+}
+
+func addLDAPGroup(server *ldaptest.Server, group string, members ...string) string {
+	dn := "cn=" + group + "," + ldapGroups
+	server.Add(dn, map[string][]string{"objectClass": {"groupOfNames"}, "cn": {group}, "member": members})
+
+	return dn
+}
+
+// rsaPublicKey returns a new key as PEM and in the OpenSSH authorized keys format
+func rsaPublicKey(t *testing.T) (pemKey []byte, sshKey []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), ssh.MarshalAuthorizedKey(publicKey)
+}
+
+// keyId returns the id the LDAP backend derives from a key of user
+func keyId(user string, pemKey []byte) string {
+	hash := sha256.Sum256(append([]byte(user+"\n"), pemKey...))
+	return hex.EncodeToString(hash[:12])
+}
+
+func TestLDAPConformance(t *testing.T) {
+	conformance.Run(t, conformance.LDAP)
+}
+
+func TestLDAPNestedGroups(t *testing.T) {
+	server, backend := newLDAPConfig(t)
+	defer server.Close()
+
+	alice := addLDAPUser(server, "alice")
+	bob := addLDAPUser(server, "bob")
+	addLDAPUser(server, "carol")
+
+	oncall := addLDAPGroup(server, "oncall", bob)
+	engineering := addLDAPGroup(server, "engineering", alice, oncall, "uid=printer,ou=devices,dc=example,dc=com")
+
+	// A cycle of nested groups must not loop forever
+	addLDAPGroup(server, "staff", engineering, "cn=everyone,"+ldapGroups)
+	addLDAPGroup(server, "everyone", "cn=staff,"+ldapGroups)
+
+	members, err := backend.FetchGroup("engineering")
+
+	if err != nil {
+		t.Fatalf("FetchGroup returned error %s", err)
+	}
+
+	if strings.Join(members, " ") != "alice bob" {
+		t.Errorf("FetchGroup(engineering) returned %q, expected [alice bob]", members)
+	}
+
+	if members, _ = backend.FetchGroup("everyone"); strings.Join(members, " ") != "alice bob" {
+		t.Errorf("FetchGroup(everyone) returned %q, expected [alice bob]", members)
+	}
+
+	groups, err := backend.FetchGroupsForUser("bob")
+
+	if err != nil {
+		t.Fatalf("FetchGroupsForUser returned error %s", err)
+	}
+
+	if strings.Join(groups, " ") != "engineering everyone oncall staff" {
+		t.Errorf("FetchGroupsForUser(bob) returned %q, expected [engineering everyone oncall staff]", groups)
+	}
+
+	if groups, _ = backend.FetchGroupsForUser("carol"); len(groups) != 0 {
+		t.Errorf("FetchGroupsForUser(carol) returned %q, expected no groups", groups)
+	}
+}
+
+func TestLDAPKeys(t *testing.T) {
+	server, backend := newLDAPConfig(t)
+	defer server.Close()
+
+	laptop, laptopSSH := rsaPublicKey(t)
+	phone, phoneSSH := rsaPublicKey(t)
+
+	// The laptop key is given twice in different formats, the certificate is not a public key
+	addLDAPUser(server, "alice", string(laptop), string(laptopSSH), string(phoneSSH), "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n")
+
+	// The same key held by another user has another id
+	addLDAPUser(server, "bob", string(laptop))
+
+	ids, err := backend.FetchKeys("alice")
+
+	if err != nil {
+		t.Fatalf("FetchKeys returned error %s", err)
+	}
+
+	expected := []string{keyId("alice", laptop), keyId("alice", phone)}
+
+	if expected[1] < expected[0] {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+
+	if strings.Join(ids, " ") != strings.Join(expected, " ") {
+		t.Errorf("FetchKeys(alice) returned %q, expected %q", ids, expected)
+	}
+
+	if key, err := backend.FetchKey("alice", keyId("alice", phone)); !bytes.Equal(key, phone) || err != nil {
+		t.Errorf("FetchKey of the OpenSSH key returned %q, %v, expected the key as PEM", key, err)
+	}
+
+	if ids, _ = backend.FetchKeys("bob"); len(ids) != 1 || ids[0] != keyId("bob", laptop) || ids[0] == keyId("alice", laptop) {
+		t.Errorf("FetchKeys(bob) returned %q, expected [%s]", ids, keyId("bob", laptop))
+	}
+
+	if key, err := backend.FetchKey("bob", keyId("alice", laptop)); key != nil || err != nil {
+		t.Errorf("FetchKey of another user's key id returned %q, %v, expected nil, nil", key, err)
+	}
+}
+
+func TestLDAPReconnect(t *testing.T) {
+	server, backend := newLDAPConfig(t)
+	defer server.Close()
+
+	addLDAPUser(server, "alice")
+	server.Disconnect()
+
+	if keys, err := backend.FetchKeys("alice"); keys == nil || err != nil {
+		t.Errorf("FetchKeys after the connection was lost returned %q, %v, expected an empty list", keys, err)
+	}
+}
@@ -0,0 +1,470 @@
+// Package ldaptest is an in-process LDAP server for testing the LDAP backend. It supports simple binds and searches of
+// the entries it is given, with the common filters. Values are compared without regard to case.
+package ldaptest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+const (
+	applicationBindRequest    = 0
+	applicationBindResponse   = 1
+	applicationUnbindRequest  = 2
+	applicationSearchRequest  = 3
+	applicationSearchEntry    = 4
+	applicationSearchDone     = 5
+	applicationExtendedResult = 24
+)
+
+const (
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+	resultUnwillingToPerform = 53
+)
+
+const (
+	scopeBase     = 0
+	scopeOneLevel = 1
+)
+
+// Server is an LDAP server listening on the loopback interface
+type Server struct {
+	listener  net.Listener
+	lock      sync.Mutex
+	entries   map[string]*entry // By normalized DN
+	passwords map[string]string // By normalized DN
+	conns     map[net.Conn]bool
+	binds     int
+}
+
+type entry struct {
+	dn         string
+	attributes map[string][]string // By lower case name
+	names      map[string]string   // Name of each attribute as it was added
+}
+
+// NewServer starts a server without entries
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		listener:  listener,
+		entries:   make(map[string]*entry),
+		passwords: make(map[string]string),
+		conns:     make(map[net.Conn]bool),
+	}
+
+	go server.accept()
+
+	return server, nil
+}
+
+// URL returns the ldap:// URL of the server
+func (s *Server) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// Close stops the server and closes every connection
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+// Disconnect closes every connection, as if the server had restarted
+func (s *Server) Disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Binds returns the number of successful binds
+func (s *Server) Binds() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.binds
+}
+
+// Add adds or replaces an entry
+func (s *Server) Add(dn string, attributes map[string][]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e := &entry{dn: dn, attributes: make(map[string][]string), names: make(map[string]string)}
+	s.entries[normalizeDN(dn)] = e
+
+	for name, values := range attributes {
+		e.add(name, values...)
+	}
+}
+
+// AddValues adds values to an attribute of an entry, creating the entry if it does not exist
+func (s *Server) AddValues(dn, attribute string, values ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e := s.entries[normalizeDN(dn)]
+
+	if e == nil {
+		e = &entry{dn: dn, attributes: make(map[string][]string), names: make(map[string]string)}
+		s.entries[normalizeDN(dn)] = e
+	}
+
+	e.add(attribute, values...)
+}
+
+// Delete removes an entry
+func (s *Server) Delete(dn string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.entries, normalizeDN(dn))
+}
+
+// SetPassword allows a simple bind as dn with password
+func (s *Server) SetPassword(dn, password string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.passwords[normalizeDN(dn)] = password
+}
+
+func (e *entry) add(name string, values ...string) {
+	key := strings.ToLower(name)
+
+	if _, exists := e.names[key]; !exists {
+		e.names[key] = name
+	}
+
+	e.attributes[key] = append(e.attributes[key], values...)
+}
+
+// normalizeDN returns a lower case DN without spaces around its components, escaped commas are not supported
+func normalizeDN(dn string) string {
+	parts := strings.Split(strings.ToLower(dn), ",")
+
+	for i, part := range parts {
+		if equals := strings.IndexByte(part, '='); equals != -1 {
+			part = strings.TrimSpace(part[:equals]) + "=" + strings.TrimSpace(part[equals+1:])
+		}
+
+		parts[i] = strings.TrimSpace(part)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		request, err := ber.ReadPacket(conn)
+
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+
+		id, _ := request.Children[0].Value.(int64)
+		op := request.Children[1]
+
+		if op.ClassType != ber.ClassApplication {
+			return
+		}
+
+		var responses []*ber.Packet
+
+		switch op.Tag {
+		case applicationBindRequest:
+			responses = []*ber.Packet{s.bind(op)}
+		case applicationUnbindRequest:
+			return
+		case applicationSearchRequest:
+			responses = s.search(op)
+		default:
+			// Extended operations such as StartTLS, and changes to the directory, are not supported
+			responses = []*ber.Packet{result(applicationExtendedResult, resultUnwillingToPerform, "operation not supported")}
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+			envelope.AppendChild(response)
+
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// result returns an LDAPResult with an application tag
+func result(tag ber.Tag, code int64, message string) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+
+	return packet
+}
+
+func (s *Server) bind(op *ber.Packet) *ber.Packet {
+	if len(op.Children) != 3 || op.Children[2].ClassType != ber.ClassContext || op.Children[2].Tag != 0 {
+		return result(applicationBindResponse, resultProtocolError, "only simple binds are supported")
+	}
+
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if expected, exists := s.passwords[normalizeDN(dn)]; (dn != "" || password != "") && (!exists || expected != password) {
+		return result(applicationBindResponse, resultInvalidCredentials, "invalid credentials")
+	}
+
+	s.binds++
+
+	return result(applicationBindResponse, resultSuccess, "")
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) != 8 {
+		return []*ber.Packet{result(applicationSearchDone, resultProtocolError, "invalid search request")}
+	}
+
+	base, _ := op.Children[0].Value.(string)
+	scope, _ := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+	var requested []string
+
+	for _, attribute := range op.Children[7].Children {
+		if name, ok := attribute.Value.(string); ok {
+			requested = append(requested, strings.ToLower(name))
+		}
+	}
+
+	base = normalizeDN(base)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.entries[base] == nil {
+		return []*ber.Packet{result(applicationSearchDone, resultNoSuchObject, "no such object "+base)}
+	}
+
+	var responses []*ber.Packet
+
+	for dn, e := range s.entries {
+		if !inScope(dn, base, scope) {
+			continue
+		}
+
+		matched, err := e.matches(filter)
+
+		if err != nil {
+			return []*ber.Packet{result(applicationSearchDone, resultProtocolError, err.Error())}
+		}
+
+		if matched {
+			responses = append(responses, e.packet(requested))
+		}
+	}
+
+	return append(responses, result(applicationSearchDone, resultSuccess, ""))
+}
+
+func inScope(dn, base string, scope int64) bool {
+	if dn == base {
+		return scope != scopeOneLevel
+	}
+
+	if !strings.HasSuffix(dn, ","+base) {
+		return false
+	}
+
+	switch scope {
+	case scopeBase:
+		return false
+	case scopeOneLevel:
+		return !strings.Contains(strings.TrimSuffix(dn, ","+base), ",")
+	default:
+		return true
+	}
+}
+
+// packet returns a SearchResultEntry with the requested attributes, all attributes if none were requested
+func (e *entry) packet(requested []string) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationSearchEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+
+	for key, values := range e.attributes {
+		if len(requested) != 0 && !contains(requested, key) && !contains(requested, "*") {
+			continue
+		}
+
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.names[key], "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+
+	packet.AppendChild(attributes)
+
+	return packet
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches evaluates a search filter against the entry
+func (e *entry) matches(filter *ber.Packet) (bool, error) {
+	if filter.ClassType != ber.ClassContext {
+		return false, fmt.Errorf("invalid filter")
+	}
+
+	switch filter.Tag {
+	case 0, 1: // and, or
+		for _, child := range filter.Children {
+			matched, err := e.matches(child)
+
+			if err != nil {
+				return false, err
+			}
+
+			if matched == (filter.Tag == 1) {
+				return matched, nil
+			}
+		}
+
+		return filter.Tag == 0, nil
+	case 2: // not
+		if len(filter.Children) != 1 {
+			return false, fmt.Errorf("invalid not filter")
+		}
+
+		matched, err := e.matches(filter.Children[0])
+
+		return !matched, err
+	case 3, 5, 6, 8: // equality, greater or equal, less or equal, approximate
+		if len(filter.Children) != 2 {
+			return false, fmt.Errorf("invalid attribute value assertion")
+		}
+
+		name, _ := filter.Children[0].Value.(string)
+		expected := strings.ToLower(string(filter.Children[1].ByteValue))
+
+		for _, value := range e.attributes[strings.ToLower(name)] {
+			value = strings.ToLower(value)
+
+			if (filter.Tag == 5 && value >= expected) || (filter.Tag == 6 && value <= expected) || value == expected {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	case 4: // substrings
+		if len(filter.Children) != 2 {
+			return false, fmt.Errorf("invalid substrings filter")
+		}
+
+		name, _ := filter.Children[0].Value.(string)
+
+		for _, value := range e.attributes[strings.ToLower(name)] {
+			if matchSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	case 7: // present
+		return len(e.attributes[strings.ToLower(filter.Data.String())]) != 0, nil
+	default:
+		return false, fmt.Errorf("unsupported filter %d", filter.Tag)
+	}
+}
+
+func matchSubstrings(value string, substrings []*ber.Packet) bool {
+	for _, substring := range substrings {
+		part := strings.ToLower(substring.Data.String())
+
+		switch substring.Tag {
+		case 0: // initial
+			if !strings.HasPrefix(value, part) {
+				return false
+			}
+
+			value = value[len(part):]
+		case 1: // any
+			index := strings.Index(value, part)
+
+			if index == -1 {
+				return false
+			}
+
+			value = value[index+len(part):]
+		case 2: // final
+			if !strings.HasSuffix(value, part) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -25,16 +25,15 @@ func (c *LocalConfig) FetchFile(path string, ifNotTag string) (io.ReadCloser, st
 	info, err := os.Stat(path)
 
 	if err != nil {
-		logger.Errorf("Error retrieving %s: %s", path, err)
-
 		if errors.Is(err, os.ErrNotExist) {
 			return nil, "", nil
 		} else {
+			logger.Errorf("Error retrieving %s: %s", path, err)
 			return nil, "", err
 		}
 	}
 
-	tag := strconv.FormatInt(info.ModTime().UnixNano(), 10)
+	tag := localTag(info)
 
 	if tag == ifNotTag {
 		return nil, tag, nil
@@ -43,11 +42,10 @@ func (c *LocalConfig) FetchFile(path string, ifNotTag string) (io.ReadCloser, st
 	file, err := os.Open(path)
 
 	if err != nil {
-		logger.Errorf("Error retrieving %s: %s", path, err)
-
 		if errors.Is(err, os.ErrNotExist) {
 			return nil, "", nil
 		} else {
+			logger.Errorf("Error retrieving %s: %s", path, err)
 			return nil, "", err
 		}
 	}
@@ -55,39 +53,87 @@ func (c *LocalConfig) FetchFile(path string, ifNotTag string) (io.ReadCloser, st
 	return file, tag, nil
 }
 
+// localTag returns the tag of a file, the size is included as a file may be rewritten within the resolution of the
+// modification time
+func localTag(info os.FileInfo) string {
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10) + "-" + strconv.FormatInt(info.Size(), 10)
+}
+
+func (c *LocalConfig) ListFiles(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(c.Root, filepath.FromSlash(pattern)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(matches))
+
+	for _, match := range matches {
+		info, err := os.Stat(match)
+
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		rel, err := filepath.Rel(c.Root, match)
+
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+
+	return paths, nil
+}
+
 func (c *LocalConfig) PutFile(path string, data []byte) error {
 	path = filepath.Join(c.Root, path)
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Unable to create directory for %s: %w", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 
 	if err != nil {
 		return fmt.Errorf("Unable to write to file %s: %w", path, err)
 	}
 
-	defer file.Close()
-
 	_, err = file.Write(data)
 
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
 	return err
 }
 
 func (c *LocalConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 	file, _, err := c.FetchFile("netinfo", "")
 
-	if file == nil {
+	if err != nil {
 		return nil, err
 	}
 
-	defer file.Close()
-	reader := bufio.NewReader(file)
-
 	info := &NetworkInfo{
-		Subnets: make(map[string]net.IPNet),
+		Subnets:     make(map[string]net.IPNet),
+		SubnetsIPv6: make(map[string][]net.IPNet),
+		SubnetTags:  make(map[string]map[string]string),
+	}
+
+	// Without a netinfo file, there are no subnets
+	if file == nil {
+		return info, nil
 	}
 
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
 	for line, err := reader.ReadString('\n'); err == nil; line, err = reader.ReadString('\n') {
 		fields := strings.Fields(line)
 
-		if len(fields) != 2 {
+		if len(fields) < 2 || ((fields[0] == "nat" || fields[0] == "vpc") && len(fields) != 2) {
 			continue
 		}
 
@@ -96,9 +142,14 @@ func (c *LocalConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 		netStr := fields[1]
 
 		if strings.IndexRune(netStr, '/') < 0 {
-			network := new(net.IPNet)
+			network = new(net.IPNet)
 
 			network.IP = net.ParseIP(netStr)
+
+			if ip4 := network.IP.To4(); ip4 != nil {
+				network.IP = ip4
+			}
+
 			bits := len(network.IP) * 8
 			network.Mask = net.CIDRMask(bits, bits)
 		} else {
@@ -111,8 +162,15 @@ func (c *LocalConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 
 		if fields[0] == "nat" {
 			info.NAT = append(info.NAT, *network)
+		} else if fields[0] == "vpc" {
+			info.VPC = append(info.VPC, *network)
+		} else if network.IP.To4() == nil {
+			// A subnet may have an IPv4 line and IPv6 lines, the tags of every line apply
+			info.SubnetsIPv6[fields[0]] = append(info.SubnetsIPv6[fields[0]], *network)
+			addTags(info, fields[0], parseTags(fields[2:]))
 		} else {
 			info.Subnets[fields[0]] = *network
+			addTags(info, fields[0], parseTags(fields[2:]))
 		}
 	}
 
@@ -123,12 +181,25 @@ func (c *LocalConfig) FetchNetworkInfo() (*NetworkInfo, error) {
 	return info, err
 }
 
+// addTags merges tags into the tags of subnet
+func addTags(info *NetworkInfo, subnet string, tags map[string]string) {
+	if existing, exists := info.SubnetTags[subnet]; exists {
+		for key, value := range tags {
+			existing[key] = value
+		}
+	} else {
+		info.SubnetTags[subnet] = tags
+	}
+}
+
 func (c *LocalConfig) FetchGroup(name string) ([]string, error) {
 	file, _, err := c.FetchFile("groups", "")
 
-	if file == nil {
+	if err != nil {
 		logger.Errorf("Failed to open groups file: %s", err)
 		return nil, err
+	} else if file == nil {
+		return nil, nil
 	}
 
 	defer file.Close()
@@ -136,7 +207,7 @@ func (c *LocalConfig) FetchGroup(name string) ([]string, error) {
 
 	for line, err := reader.ReadString('\n'); err == nil; line, err = reader.ReadString('\n') {
 		fields := strings.Fields(line)
-		if fields[0] == name {
+		if len(fields) != 0 && fields[0] == name {
 			return fields[1:], nil
 		}
 	}
@@ -163,6 +234,10 @@ func (c *LocalConfig) FetchGroupsForUser(user string) ([]string, error) {
 	for line, err := reader.ReadString('\n'); err == nil; line, err = reader.ReadString('\n') {
 		fields := strings.Fields(line)
 
+		if len(fields) == 0 {
+			continue
+		}
+
 		for _, name := range fields[1:] {
 			if name == user {
 				groups = append(groups, fields[0])
@@ -221,3 +296,34 @@ func (c *LocalConfig) RegisterDNS(zone, name string, weighted bool) error {
 func (c *LocalConfig) UnregisterDNS() error {
 	return nil
 }
+
+// WriteFileAtomic replaces path with data, readable only by the owner. The file is written to a temporary file in the
+// same directory and renamed, so that path is never partially written.
+func WriteFileAtomic(path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %w", path, err)
+	}
+
+	_, err = tmpFile.Write(data)
+
+	if err == nil {
+		err = tmpFile.Chmod(0600)
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Error writing %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,435 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MemoryConfig is a ConfigurationBackend that holds its files, users, groups, keys and network info in memory. It is
+// scripted with its methods, and failures may be injected for any method of ConfigurationBackend.
+type MemoryConfig struct {
+	lock       sync.Mutex
+	files      map[string]memoryFile
+	nextTag    int
+	users      map[string]map[string][]byte // Keys by id, by user
+	groups     map[string][]string          // Members by group
+	netinfo    NetworkInfo
+	failures   map[string]error
+	registered *memoryRegistration
+	budget     int // Lookups of a reload through ReloadBackend, 0 for no limit
+	spent      int
+}
+
+type memoryFile struct {
+	data []byte
+	tag  string
+}
+
+type memoryRegistration struct {
+	zone     string
+	name     string
+	weighted bool
+}
+
+// NewMemoryConfig returns an empty backend
+func NewMemoryConfig() *MemoryConfig {
+	return &MemoryConfig{
+		files:    make(map[string]memoryFile),
+		users:    make(map[string]map[string][]byte),
+		groups:   make(map[string][]string),
+		netinfo:  NetworkInfo{Subnets: make(map[string]net.IPNet), SubnetsIPv6: make(map[string][]net.IPNet), SubnetTags: make(map[string]map[string]string)},
+		failures: make(map[string]error),
+	}
+}
+
+// Fail makes every call to method, such as "FetchKeys", return err. A nil err removes the failure.
+func (c *MemoryConfig) Fail(method string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err == nil {
+		delete(c.failures, method)
+	} else {
+		c.failures[method] = err
+	}
+}
+
+// SetBudget limits the group, user and key lookups of each reload made through ReloadBackend, 0 removes the limit
+func (c *MemoryConfig) SetBudget(budget int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.budget = budget
+}
+
+// BeginReload restores the budget
+func (c *MemoryConfig) BeginReload() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.spent = 0
+}
+
+// EndReload has nothing to do
+func (c *MemoryConfig) EndReload() {}
+
+// ReloadBackend returns a view of the backend that counts lookups against the budget of the current reload
+func (c *MemoryConfig) ReloadBackend() ConfigurationBackend {
+	return &memoryReloadView{c}
+}
+
+// spend counts a lookup against the budget, returning an error wrapping ErrThrottled if the budget is spent
+func (c *MemoryConfig) spend() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.budget != 0 && c.spent == c.budget {
+		return fmt.Errorf("%w: budget of %d lookups for this reload is spent", ErrThrottled, c.budget)
+	}
+
+	c.spent++
+
+	return nil
+}
+
+// AddUser creates a user without keys, adding a user that exists has no effect
+func (c *MemoryConfig) AddUser(user string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, exists := c.users[user]; !exists {
+		c.users[user] = make(map[string][]byte)
+	}
+}
+
+// RemoveUser deletes a user along with their keys and group memberships
+func (c *MemoryConfig) RemoveUser(user string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.users, user)
+
+	for group := range c.groups {
+		c.removeMember(group, user)
+	}
+}
+
+// AddKey adds or replaces a public key of a user, creating the user if needed
+func (c *MemoryConfig) AddKey(user, keyId string, key []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, exists := c.users[user]; !exists {
+		c.users[user] = make(map[string][]byte)
+	}
+
+	c.users[user][keyId] = append([]byte(nil), key...)
+}
+
+// RemoveKey deletes a public key of a user
+func (c *MemoryConfig) RemoveKey(user, keyId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.users[user], keyId)
+}
+
+// AddToGroup adds users to a group, creating the group and the users if needed
+func (c *MemoryConfig) AddToGroup(group string, users ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	members, exists := c.groups[group]
+
+	if !exists {
+		members = []string{}
+	}
+
+	for _, user := range users {
+		if _, exists := c.users[user]; !exists {
+			c.users[user] = make(map[string][]byte)
+		}
+
+		if !containsString(members, user) {
+			members = append(members, user)
+		}
+	}
+
+	c.groups[group] = members
+}
+
+// RemoveFromGroup removes a user from a group, the group remains when it is empty
+func (c *MemoryConfig) RemoveFromGroup(group, user string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.removeMember(group, user)
+}
+
+func (c *MemoryConfig) removeMember(group, user string) {
+	members := c.groups[group]
+
+	for i, member := range members {
+		if member == user {
+			c.groups[group] = append(members[:i:i], members[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetNetworkInfo replaces the network info returned by FetchNetworkInfo
+func (c *MemoryConfig) SetNetworkInfo(netinfo NetworkInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.netinfo = netinfo
+}
+
+// DeleteFile removes a file, deleting a file that does not exist has no effect
+func (c *MemoryConfig) DeleteFile(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.files, cleanPath(path))
+}
+
+// Registration returns the DNS name registered with RegisterDNS, registered is false if there is none
+func (c *MemoryConfig) Registration() (zone, name string, weighted bool, registered bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.registered == nil {
+		return "", "", false, false
+	}
+
+	return c.registered.zone, c.registered.name, c.registered.weighted, true
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+func (c *MemoryConfig) FetchFile(name string, ifNotTag string) (io.ReadCloser, string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["FetchFile"]; err != nil {
+		return nil, "", err
+	}
+
+	file, exists := c.files[cleanPath(name)]
+
+	if !exists {
+		return nil, "", nil
+	}
+
+	if file.tag == ifNotTag {
+		return nil, file.tag, nil
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(file.data)), file.tag, nil
+}
+
+func (c *MemoryConfig) ListFiles(pattern string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["ListFiles"]; err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+
+	for name := range c.files {
+		matched, err := path.Match(pattern, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			paths = append(paths, name)
+		}
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func (c *MemoryConfig) PutFile(name string, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["PutFile"]; err != nil {
+		return err
+	}
+
+	c.nextTag++
+	c.files[cleanPath(name)] = memoryFile{data: append([]byte(nil), data...), tag: strconv.Itoa(c.nextTag)}
+
+	return nil
+}
+
+func (c *MemoryConfig) FetchNetworkInfo() (*NetworkInfo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["FetchNetworkInfo"]; err != nil {
+		return nil, err
+	}
+
+	netinfo := c.netinfo
+
+	return &netinfo, nil
+}
+
+func (c *MemoryConfig) FetchGroup(name string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["FetchGroup"]; err != nil {
+		return nil, err
+	}
+
+	members, exists := c.groups[name]
+
+	if !exists {
+		return nil, nil
+	}
+
+	return append([]string{}, members...), nil
+}
+
+func (c *MemoryConfig) FetchGroupsForUser(user string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["FetchGroupsForUser"]; err != nil {
+		return nil, err
+	}
+
+	var groups []string
+
+	for group, members := range c.groups {
+		if containsString(members, user) {
+			groups = append(groups, group)
+		}
+	}
+
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+func (c *MemoryConfig) FetchKeys(user string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["FetchKeys"]; err != nil {
+		return nil, err
+	}
+
+	keys, exists := c.users[user]
+
+	if !exists {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(keys))
+
+	for id := range keys {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (c *MemoryConfig) FetchKey(user, key string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["FetchKey"]; err != nil {
+		return nil, err
+	}
+
+	data, exists := c.users[user][key]
+
+	if !exists {
+		return nil, nil
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+func (c *MemoryConfig) RegisterDNS(zone, name string, weighted bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["RegisterDNS"]; err != nil {
+		return err
+	}
+
+	c.registered = &memoryRegistration{zone: zone, name: name, weighted: weighted}
+
+	return nil
+}
+
+func (c *MemoryConfig) UnregisterDNS() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.failures["UnregisterDNS"]; err != nil {
+		return err
+	}
+
+	c.registered = nil
+
+	return nil
+}
+
+// memoryReloadView is the view of a MemoryConfig used by reloads, its lookups are counted against the budget
+type memoryReloadView struct {
+	*MemoryConfig
+}
+
+func (c *memoryReloadView) FetchGroup(name string) ([]string, error) {
+	if err := c.spend(); err != nil {
+		return nil, err
+	}
+
+	return c.MemoryConfig.FetchGroup(name)
+}
+
+func (c *memoryReloadView) FetchGroupsForUser(user string) ([]string, error) {
+	if err := c.spend(); err != nil {
+		return nil, err
+	}
+
+	return c.MemoryConfig.FetchGroupsForUser(user)
+}
+
+func (c *memoryReloadView) FetchKeys(user string) ([]string, error) {
+	if err := c.spend(); err != nil {
+		return nil, err
+	}
+
+	return c.MemoryConfig.FetchKeys(user)
+}
+
+func (c *memoryReloadView) FetchKey(user, key string) ([]byte, error) {
+	if err := c.spend(); err != nil {
+		return nil, err
+	}
+
+	return c.MemoryConfig.FetchKey(user, key)
+}
@@ -10,9 +10,12 @@ import (
 
 type Parser struct {
 	reader      *bufio.Reader
+	file        string
 	sectionType string
 	sectionName string
 	line        int
+	comments    []string
+	variables   VariableResolver // nil if variables are not substituted
 }
 
 type ConfigStatement struct {
@@ -20,11 +23,34 @@ type ConfigStatement struct {
 	SectionName string
 	Word        string
 	Fields      []string
+	File        string
 	Line        int
+	Comments    []string // Comment lines preceding the statement
+	Comment     string   // Comment following the statement on the same line
 }
 
 func Open(data io.Reader) *Parser {
-	return &Parser{reader: bufio.NewReader(data)}
+	return OpenFile("config", data)
+}
+
+// OpenFile opens a parser on data, using file as the name reported in errors
+func OpenFile(file string, data io.Reader) *Parser {
+	return &Parser{reader: bufio.NewReader(data), file: file}
+}
+
+// Errorf returns an error prefixed with the file and line of the statement
+func (stmt *ConfigStatement) Errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s:%d "+format, append([]interface{}{stmt.File, stmt.Line}, a...)...)
+}
+
+// SetVariables enables the substitution of ${name} variables with the values provided by variables
+func (p *Parser) SetVariables(variables VariableResolver) {
+	p.variables = variables
+}
+
+// Comments returns the comment lines that have been read without a statement following them
+func (p *Parser) Comments() []string {
+	return p.comments
 }
 
 func (p *Parser) Read() (*ConfigStatement, error) {
@@ -33,29 +59,45 @@ func (p *Parser) Read() (*ConfigStatement, error) {
 		p.line++
 
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			// The last line of a file may not end with a newline
+			if !errors.Is(err, io.EOF) {
+				return nil, err
+			} else if line == "" {
 				return nil, nil
 			}
-			return nil, err
 		}
 
 		line = strings.TrimSuffix(line, "\n")
 
 		ind := strings.IndexRune(line, '#')
+		var comment string
 
 		if ind != -1 {
+			comment = strings.TrimSpace(line[ind:])
 			line = line[:ind]
 		}
 
+		line, err = p.substitute(line)
+
+		if err != nil {
+			return nil, err
+		}
+
 		fields := strings.Fields(line)
 
 		if len(fields) == 0 {
+			if comment != "" {
+				p.comments = append(p.comments, comment)
+			}
 			continue
 		}
 
+		comments := p.comments
+		p.comments = nil
+
 		if line[0] == ' ' || line[0] == '\t' {
 			if p.sectionType == "" {
-				return nil, fmt.Errorf("config:%d illegal line %s outside section", p.line, line)
+				return nil, fmt.Errorf("%s:%d illegal line %s outside section", p.file, p.line, line)
 			}
 
 			return &ConfigStatement{
@@ -63,19 +105,28 @@ func (p *Parser) Read() (*ConfigStatement, error) {
 				SectionName: p.sectionName,
 				Word:        fields[0],
 				Fields:      fields[1:],
+				File:        p.file,
 				Line:        p.line,
+				Comments:    comments,
+				Comment:     comment,
 			}, nil
 		} else {
 			stmt := new(ConfigStatement)
+			stmt.File = p.file
 			stmt.Line = p.line
-			if fields[0] == "global" {
+			stmt.Comments = comments
+			stmt.Comment = comment
+			if fields[0] == "include" {
+				stmt.Word = fields[0]
+				stmt.Fields = fields[1:]
+			} else if fields[0] == "global" {
 				stmt.SectionType = "global"
 				stmt.SectionName = ""
 			} else if len(fields) == 2 {
 				stmt.SectionType = fields[0]
 				stmt.SectionName = fields[1]
 			} else {
-				return nil, fmt.Errorf("config:%d illegal section declaration %s", p.line, line)
+				return nil, fmt.Errorf("%s:%d illegal section declaration %s", p.file, p.line, line)
 			}
 
 			p.sectionType = stmt.SectionType
@@ -83,8 +134,5 @@ func (p *Parser) Read() (*ConfigStatement, error) {
 
 			return stmt, nil
 		}
-
 	}
-
-	return nil, nil
 }
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrOutsideSchedule is wrapped by the error of GetUserConfig when a user only has access at other times
+var ErrOutsideSchedule = errors.New("outside of their access schedule")
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule is a window of time on certain days of the week, a window that ends before it starts continues past midnight
+type Schedule struct {
+	Days     [7]bool // Indexed by time.Weekday
+	Start    int     // Minutes after midnight
+	End      int     // Minutes after midnight, up to 24:00
+	Location *time.Location
+}
+
+// Active checks whether t falls within the schedule
+func (s Schedule) Active(t time.Time) bool {
+	t = t.In(s.Location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if s.Start < s.End {
+		return s.Days[day] && minute >= s.Start && minute < s.End
+	}
+
+	return (s.Days[day] && minute >= s.Start) || (s.Days[(day+6)%7] && minute < s.End)
+}
+
+// next returns the first time after t at which the schedule may open or close, which is when the local time passes the
+// start or end of the window, or when the location changes its offset from UTC
+func (s Schedule) next(t time.Time) time.Time {
+	local := t.In(s.Location)
+	var rv time.Time
+
+	for offset := 0; offset <= 7 && rv.IsZero(); offset++ {
+		for _, minute := range []int{s.Start, s.End} {
+			for _, boundary := range localTimes(local.Year(), local.Month(), local.Day()+offset, minute, s.Location) {
+				if boundary.After(t) && (rv.IsZero() || boundary.Before(rv)) {
+					rv = boundary
+				}
+			}
+		}
+	}
+
+	if transition := offsetChange(t, rv, s.Location); !transition.IsZero() {
+		return transition
+	}
+
+	return rv
+}
+
+// localTimes returns the times at which the local time in location is minute on a day. There are none when the clocks
+// skip over it, and two when the clocks are turned back over it.
+func localTimes(year int, month time.Month, day, minute int, location *time.Location) []time.Time {
+	wall := time.Date(year, month, day, minute/60, minute%60, 0, 0, time.UTC)
+	var rv []time.Time
+
+	// Offsets change at most once within a few days, so the offsets a day and a half away are the only candidates
+	for _, nearby := range []time.Time{wall.Add(-36 * time.Hour), wall.Add(36 * time.Hour)} {
+		_, offset := nearby.In(location).Zone()
+		candidate := wall.Add(-time.Duration(offset) * time.Second)
+
+		if _, actual := candidate.In(location).Zone(); actual == offset && (len(rv) == 0 || !rv[0].Equal(candidate)) {
+			rv = append(rv, candidate)
+		}
+	}
+
+	return rv
+}
+
+// offsetChange returns the first time after t and no later than until at which location changes its offset from UTC,
+// or the zero time if it does not change
+func offsetChange(t, until time.Time, location *time.Location) time.Time {
+	if until.IsZero() {
+		return until
+	}
+
+	_, before := t.In(location).Zone()
+
+	if _, after := until.In(location).Zone(); after == before {
+		return time.Time{}
+	}
+
+	low, high := t.Unix(), until.Unix()
+
+	for high-low > 1 {
+		middle := low + (high-low)/2
+
+		if _, offset := time.Unix(middle, 0).In(location).Zone(); offset == before {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+
+	return time.Unix(high, 0)
+}
+
+func (s Schedule) String() string {
+	days := ""
+
+	for start := 0; start < 7; start++ {
+		if !s.Days[start] || (start > 0 && s.Days[start-1]) {
+			continue
+		}
+
+		end := start
+
+		for end < 6 && s.Days[end+1] {
+			end++
+		}
+
+		if days != "" {
+			days += ","
+		}
+
+		days += weekdays[start]
+
+		if end != start {
+			days += "-" + weekdays[end]
+		}
+	}
+
+	if days == "sun-sat" {
+		days = "daily"
+	}
+
+	rv := fmt.Sprintf("%s %02d:%02d-%02d:%02d", days, s.Start/60, s.Start%60, s.End/60, s.End%60)
+
+	if s.Location != nil && s.Location != time.UTC {
+		rv += " " + s.Location.String()
+	}
+
+	return rv
+}
+
+// sectionActive checks whether any of the section's schedules are active, sections without a schedule are always active
+func sectionActive(section *SectionConfig, t time.Time) bool {
+	if len(section.Schedules) == 0 {
+		return true
+	}
+
+	for _, schedule := range section.Schedules {
+		if schedule.Active(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextScheduleChange returns the first time after t at which any schedule opens or closes, or the zero time if there
+// are no schedules
+func (config *ConfigFile) NextScheduleChange(t time.Time) time.Time {
+	var rv time.Time
+
+	check := func(section *SectionConfig) {
+		for _, schedule := range section.Schedules {
+			next := schedule.next(t)
+
+			if rv.IsZero() || next.Before(rv) {
+				rv = next
+			}
+		}
+	}
+
+	for _, section := range config.Groups {
+		check(section)
+	}
+
+	for _, section := range config.Users {
+		check(section)
+	}
+
+	return rv
+}
+
+func parseSchedule(stmt *ConfigStatement) (schedule Schedule, err error) {
+	if len(stmt.Fields) != 2 && len(stmt.Fields) != 3 {
+		return schedule, stmt.Errorf("schedule must have 2 or 3 arguments")
+	}
+
+	if stmt.Fields[0] == "daily" || stmt.Fields[0] == "*" {
+		for day := range schedule.Days {
+			schedule.Days[day] = true
+		}
+	} else {
+		for _, dayRange := range strings.Split(stmt.Fields[0], ",") {
+			first, last := dayRange, dayRange
+
+			if dash := strings.IndexRune(dayRange, '-'); dash != -1 {
+				first, last = dayRange[:dash], dayRange[dash+1:]
+			}
+
+			start := parseWeekday(first)
+			end := parseWeekday(last)
+
+			if start < 0 || end < 0 {
+				return schedule, stmt.Errorf("invalid schedule days %s", stmt.Fields[0])
+			}
+
+			for day := start; ; day = (day + 1) % 7 {
+				schedule.Days[day] = true
+
+				if day == end {
+					break
+				}
+			}
+		}
+	}
+
+	times := strings.Split(stmt.Fields[1], "-")
+
+	if len(times) != 2 {
+		return schedule, stmt.Errorf("invalid schedule time range %s", stmt.Fields[1])
+	}
+
+	schedule.Start, err = parseTimeOfDay(times[0])
+
+	if err != nil || schedule.Start == 24*60 {
+		return schedule, stmt.Errorf("invalid schedule start time %s", times[0])
+	}
+
+	schedule.End, err = parseTimeOfDay(times[1])
+
+	if err != nil || schedule.End == schedule.Start {
+		return schedule, stmt.Errorf("invalid schedule end time %s", times[1])
+	}
+
+	schedule.Location = time.UTC
+
+	if len(stmt.Fields) == 3 {
+		schedule.Location, err = time.LoadLocation(stmt.Fields[2])
+
+		if err != nil {
+			return schedule, stmt.Errorf("unknown time zone %s: %w", stmt.Fields[2], err)
+		}
+	}
+
+	return schedule, nil
+}
+
+func parseWeekday(name string) int {
+	name = strings.ToLower(name)
+
+	for index, day := range weekdays {
+		if name == day || name == strings.ToLower(time.Weekday(index).String()) {
+			return index
+		}
+	}
+
+	return -1
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	colon := strings.IndexRune(value, ':')
+
+	if colon == -1 {
+		return 0, fmt.Errorf("invalid time %s", value)
+	}
+
+	hour, err := strconv.Atoi(value[:colon])
+
+	if err != nil {
+		return 0, err
+	}
+
+	minute, err := strconv.Atoi(value[colon+1:])
+
+	if err != nil {
+		return 0, err
+	}
+
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %s", value)
+	}
+
+	return hour*60 + minute, nil
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+
+	if err != nil {
+		t.Skipf("Time zone %s is not available: %s", name, err)
+	}
+
+	return location
+}
+
+func weekdaySchedule(start, end int, location *time.Location) Schedule {
+	schedule := Schedule{Start: start, End: end, Location: location}
+
+	for day := time.Monday; day <= time.Friday; day++ {
+		schedule.Days[day] = true
+	}
+
+	return schedule
+}
+
+func dailySchedule(start, end int, location *time.Location) Schedule {
+	schedule := Schedule{Start: start, End: end, Location: location}
+
+	for day := range schedule.Days {
+		schedule.Days[day] = true
+	}
+
+	return schedule
+}
+
+func TestScheduleActive(t *testing.T) {
+	schedule := weekdaySchedule(9*60, 17*60, time.UTC)
+
+	for _, test := range []struct {
+		time   string
+		active bool
+	}{
+		{"2026-10-19T08:59:00Z", false}, // Monday
+		{"2026-10-19T09:00:00Z", true},
+		{"2026-10-19T16:59:59Z", true},
+		{"2026-10-19T17:00:00Z", false},
+		{"2026-10-24T12:00:00Z", false}, // Saturday
+	} {
+		now, _ := time.Parse(time.RFC3339, test.time)
+
+		if active := schedule.Active(now); active != test.active {
+			t.Errorf("Active(%s) = %t, expected %t", test.time, active, test.active)
+		}
+	}
+}
+
+func TestScheduleActiveOvernight(t *testing.T) {
+	// Friday nights only, continuing into Saturday morning
+	schedule := Schedule{Start: 22 * 60, End: 6 * 60, Location: time.UTC}
+	schedule.Days[time.Friday] = true
+
+	for _, test := range []struct {
+		time   string
+		active bool
+	}{
+		{"2026-10-23T21:59:00Z", false}, // Friday
+		{"2026-10-23T22:00:00Z", true},
+		{"2026-10-24T05:59:00Z", true}, // Saturday
+		{"2026-10-24T06:00:00Z", false},
+		{"2026-10-24T23:00:00Z", false},
+		{"2026-10-23T03:00:00Z", false}, // Friday morning belongs to Thursday night
+	} {
+		now, _ := time.Parse(time.RFC3339, test.time)
+
+		if active := schedule.Active(now); active != test.active {
+			t.Errorf("Active(%s) = %t, expected %t", test.time, active, test.active)
+		}
+	}
+}
+
+func TestScheduleActiveLocation(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	schedule := weekdaySchedule(9*60, 17*60, newYork)
+
+	// 13:00 UTC is 09:00 in New York during daylight saving time, and 08:00 after it ends
+	if now, _ := time.Parse(time.RFC3339, "2026-10-30T13:00:00Z"); !schedule.Active(now) {
+		t.Errorf("Expected schedule to be active at %s", now)
+	}
+
+	if now, _ := time.Parse(time.RFC3339, "2026-11-02T13:00:00Z"); schedule.Active(now) {
+		t.Errorf("Expected schedule to be inactive at %s", now)
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+
+	for _, test := range []struct {
+		name     string
+		schedule Schedule
+		time     string
+		next     string
+	}{
+		{"before start", weekdaySchedule(9*60, 17*60, time.UTC), "2026-10-19T08:00:00Z", "2026-10-19T09:00:00Z"},
+		{"during window", weekdaySchedule(9*60, 17*60, time.UTC), "2026-10-19T09:00:00Z", "2026-10-19T17:00:00Z"},
+		{"after end", weekdaySchedule(9*60, 17*60, time.UTC), "2026-10-19T17:00:00Z", "2026-10-20T09:00:00Z"},
+		{"overnight", weekdaySchedule(22*60, 6*60, time.UTC), "2026-10-19T23:00:00Z", "2026-10-20T06:00:00Z"},
+		{"end of day", weekdaySchedule(20*60, 24*60, time.UTC), "2026-10-19T21:00:00Z", "2026-10-20T00:00:00Z"},
+		{"location", weekdaySchedule(9*60, 17*60, newYork), "2026-10-19T12:00:00Z", "2026-10-19T13:00:00Z"},
+
+		// Clocks in New York skip from 02:00 to 03:00 on 2026-03-08, a window ending at 02:30 closes at 03:00 EDT
+		{"spring forward", weekdaySchedule(60, 150, newYork), "2026-03-08T06:30:00Z", "2026-03-08T07:00:00Z"},
+		{"after spring forward", weekdaySchedule(60, 150, newYork), "2026-03-08T07:00:00Z", "2026-03-09T05:00:00Z"},
+
+		// Clocks in New York are turned back from 02:00 to 01:00 on 2026-11-01, so 01:30 happens twice
+		{"fall back first 01:30", weekdaySchedule(0, 90, newYork), "2026-11-01T05:00:00Z", "2026-11-01T05:30:00Z"},
+		{"fall back turned back", weekdaySchedule(0, 90, newYork), "2026-11-01T05:30:00Z", "2026-11-01T06:00:00Z"},
+		{"fall back second 01:30", weekdaySchedule(0, 90, newYork), "2026-11-01T06:00:00Z", "2026-11-01T06:30:00Z"},
+	} {
+		now, _ := time.Parse(time.RFC3339, test.time)
+		expected, _ := time.Parse(time.RFC3339, test.next)
+
+		if next := test.schedule.next(now); !next.Equal(expected) {
+			t.Errorf("%s: next(%s) = %s, expected %s", test.name, test.time, next.UTC().Format(time.RFC3339), test.next)
+		}
+	}
+}
+
+func TestScheduleNextMatchesActive(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	schedules := []Schedule{
+		dailySchedule(60, 150, newYork),
+		dailySchedule(0, 90, newYork),
+		dailySchedule(90, 120, newYork),
+		dailySchedule(22*60, 6*60, newYork),
+		weekdaySchedule(9*60, 17*60, newYork),
+	}
+
+	// Between one transition and the next, the schedule must not change
+	for _, start := range []string{"2026-03-06T00:00:00Z", "2026-10-30T00:00:00Z"} {
+		for _, schedule := range schedules {
+			now, _ := time.Parse(time.RFC3339, start)
+			end := now.Add(96 * time.Hour)
+
+			for now.Before(end) {
+				next := schedule.next(now)
+				active := schedule.Active(now)
+
+				for check := now.Add(time.Minute); check.Before(next); check = check.Add(time.Minute) {
+					if schedule.Active(check) != active {
+						t.Fatalf("%s changed at %s, before next(%s) = %s", schedule, check, now, next)
+					}
+				}
+
+				now = next
+			}
+		}
+	}
+}
+
+func TestNextScheduleChange(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`group day
+  schedule mon-fri 09:00-17:00
+
+user joe
+  schedule daily 12:00-13:00
+`))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	now, _ := time.Parse(time.RFC3339, "2026-10-19T10:00:00Z")
+	expected, _ := time.Parse(time.RFC3339, "2026-10-19T12:00:00Z")
+
+	if next := conf.NextScheduleChange(now); !next.Equal(expected) {
+		t.Errorf("NextScheduleChange(%s) = %s, expected %s", now, next, expected)
+	}
+
+	conf, _ = ParseConfig(strings.NewReader("group day\n"))
+
+	if next := conf.NextScheduleChange(now); !next.IsZero() {
+		t.Errorf("Expected no schedule change without schedules, got %s", next)
+	}
+}
+
+func TestGetUserConfigOutsideSchedule(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`group day
+  schedule mon-fri 09:00-17:00
+
+user joe
+  schedule daily 12:00-13:00
+`))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	netinfo := &NetworkInfo{}
+	saturday, _ := time.Parse(time.RFC3339, "2026-10-24T10:00:00Z")
+
+	for _, test := range []struct {
+		user    string
+		groups  []string
+		outside bool
+	}{
+		{"ann", []string{"day"}, true},
+		{"joe", nil, true},
+		{"bob", []string{"other"}, false},
+	} {
+		_, err := conf.GetUserConfig(test.user, test.groups, netinfo, saturday)
+
+		if err == nil {
+			t.Errorf("Expected %s to be denied", test.user)
+		} else if errors.Is(err, ErrOutsideSchedule) != test.outside {
+			t.Errorf("errors.Is(%q, ErrOutsideSchedule) != %t", err, test.outside)
+		}
+	}
+}
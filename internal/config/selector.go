@@ -0,0 +1,122 @@
+package config
+
+import (
+	"path"
+	"strings"
+)
+
+// TagMatch matches subnets having the tag Key with a value matching the glob Pattern
+type TagMatch struct {
+	Key     string
+	Pattern string
+}
+
+// SubnetSelector selects every subnet matching all of its tags
+type SubnetSelector struct {
+	Tags  []TagMatch
+	Ports []Port
+}
+
+func (match TagMatch) String() string {
+	if match.Key == "Name" {
+		return "name:" + match.Pattern
+	}
+
+	return "tag:" + match.Key + "=" + match.Pattern
+}
+
+func (selector SubnetSelector) String() string {
+	rv := "subnets"
+
+	for _, tag := range selector.Tags {
+		rv += " " + tag.String()
+	}
+
+	if len(selector.Ports) != 0 {
+		rv += " " + portsString(selector.Ports)
+	}
+
+	return rv
+}
+
+// matches checks whether the tags of a subnet satisfy the selector
+func (selector SubnetSelector) matches(tags map[string]string) bool {
+	for _, tag := range selector.Tags {
+		value, exists := tags[tag.Key]
+
+		if !exists {
+			return false
+		}
+
+		if matched, _ := path.Match(tag.Pattern, value); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// expand returns the networks of every subnet in netinfo matching the selector
+func (selector SubnetSelector) expand(netinfo *NetworkInfo) []networkPorts {
+	var rv []networkPorts
+
+	for id, tags := range netinfo.SubnetTags {
+		if !selector.matches(tags) {
+			continue
+		}
+
+		for _, network := range netinfo.subnetNetworks(id) {
+			rv = append(rv, networkPorts{network: network, ports: selector.Ports})
+		}
+	}
+
+	return rv
+}
+
+// parseSelector parses fields of the form tag:Key=pattern or name:pattern, followed by ports
+func parseSelector(stmt *ConfigStatement, fields []string) (selector SubnetSelector, err error) {
+	var index int
+
+	for index = 0; index < len(fields); index++ {
+		field := fields[index]
+
+		if strings.HasPrefix(field, "name:") {
+			selector.Tags = append(selector.Tags, TagMatch{Key: "Name", Pattern: field[len("name:"):]})
+		} else if strings.HasPrefix(field, "tag:") {
+			equal := strings.IndexRune(field, '=')
+
+			if equal == -1 || equal == len("tag:") {
+				return selector, stmt.Errorf("invalid tag selector %s", field)
+			}
+
+			selector.Tags = append(selector.Tags, TagMatch{Key: field[len("tag:"):equal], Pattern: field[equal+1:]})
+		} else {
+			break
+		}
+
+		if _, err := path.Match(selector.Tags[len(selector.Tags)-1].Pattern, ""); err != nil {
+			return selector, stmt.Errorf("invalid pattern in %s: %w", field, err)
+		}
+	}
+
+	if len(selector.Tags) == 0 {
+		return selector, stmt.Errorf("subnets must have at least one tag: or name: selector")
+	}
+
+	selector.Ports, err = parsePorts(stmt, fields[index:])
+
+	return selector, err
+}
+
+// parseTags parses tags of the form Key=value
+func parseTags(fields []string) map[string]string {
+	tags := make(map[string]string, len(fields))
+
+	for _, field := range fields {
+		if equal := strings.IndexRune(field, '='); equal > 0 {
+			tags[field[:equal]] = field[equal+1:]
+		}
+	}
+
+	return tags
+}
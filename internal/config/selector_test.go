@@ -0,0 +1,92 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func taggedNetinfo(t *testing.T) *NetworkInfo {
+	return &NetworkInfo{
+		Subnets: map[string]net.IPNet{
+			"subnet-a": parseNetwork(t, "10.1.1.0/24"),
+			"subnet-b": parseNetwork(t, "10.1.2.0/24"),
+			"subnet-c": parseNetwork(t, "10.1.3.0/24"),
+		},
+		SubnetTags: map[string]map[string]string{
+			"subnet-a": {"Name": "prod-private-a", "Tier": "db", "Team": "data"},
+			"subnet-b": {"Name": "prod-private-b", "Tier": "app", "Team": "data"},
+			"subnet-c": {"Name": "dev-private-a", "Tier": "db"},
+		},
+	}
+}
+
+func TestSubnetSelectors(t *testing.T) {
+	netinfo := taggedNetinfo(t)
+
+	for _, test := range []struct {
+		rules    string
+		expected string
+	}{
+		{"subnets tag:Tier=db", "10.1.1.0/24, 10.1.3.0/24"},
+		{"subnets name:prod-private-*", "10.1.1.0/24, 10.1.2.0/24"},
+		{"subnets name:prod-private-* tag:Tier=db 5432", "10.1.1.0/24 5432"},
+		{"subnets tag:Team=data tag:Tier=app", "10.1.2.0/24"},
+		{"subnets name:*-private-? tag:Team=*", "10.1.1.0/24, 10.1.2.0/24"},
+		{"subnets tag:Tier=db\n  deny subnets name:dev-*", "10.1.1.0/24"},
+		{"subnets tag:Tier=db\n  deny subnets tag:Tier=db 22", "10.1.1.0/24, 10.1.3.0/24"},
+		// A selector without a match still stops every subnet from being routed
+		{"subnets tag:Tier=cache", ""},
+	} {
+		conf, err := ParseConfig(strings.NewReader("group devs\n  " + test.rules + "\n"))
+
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", test.rules, err)
+			continue
+		}
+
+		userConf, err := conf.GetUserConfig("joe", []string{"devs"}, netinfo, time.Now())
+
+		if err != nil {
+			t.Errorf("Error getting config for %q: %s", test.rules, err)
+			continue
+		}
+
+		if routes := routesString(userConf.Routes); routes != test.expected {
+			t.Errorf("Routes for %q are %q, expected %q", test.rules, routes, test.expected)
+		}
+	}
+}
+
+func TestSubnetSelectorNoMatch(t *testing.T) {
+	netinfo := taggedNetinfo(t)
+	conf := "group devs\n  subnets tag:Tier=db\n  subnets tag:Tier=cache 6379\n\nuser joe\n  deny subnets name:staging-*\n"
+
+	if _, err := ParseConfig(strings.NewReader(conf)); err != nil {
+		t.Errorf("Expected a selector without a match to be accepted, got %s", err)
+	}
+
+	_, errs := ParseConfigStrict(strings.NewReader(conf), netinfo)
+
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %q", errs)
+	}
+
+	for i, expected := range []string{
+		"config:3 subnets tag:Tier=cache 6379 does not match any subnet",
+		"config:6 subnets name:staging-* does not match any subnet",
+	} {
+		if errs[i].Error() != expected {
+			t.Errorf("Expected error %q, got %q", expected, errs[i])
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, rule := range []string{"subnets", "subnets 22", "subnets tag:Tier", "subnets tag:=db", "subnets name:[a", "subnets tag:Tier=db ssh"} {
+		if _, err := ParseConfig(strings.NewReader("group devs\n  " + rule + "\n")); err == nil {
+			t.Errorf("Expected an error parsing %q", rule)
+		}
+	}
+}
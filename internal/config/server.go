@@ -0,0 +1,207 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ServerSettings are the options of the OpenVPN server, set in the global section
+type ServerSettings struct {
+	Port              int
+	Proto             string // udp or tcp
+	DataCiphers       []string
+	KeepaliveInterval int    // Seconds between pings
+	KeepaliveTimeout  int    // Seconds without a ping before a client is disconnected
+	MTU               int    // 0 for the OpenVPN default
+	Compress          string // off, lz4 or lz4-v2
+	StaticAddresses   bool   // The upper half of the tunnel network is reserved for ip and ip-pool statements
+}
+
+// DefaultServerSettings are used for options missing from the global section, they match the client profile served by
+// the web UI
+var DefaultServerSettings = ServerSettings{
+	Port:              1194,
+	Proto:             "udp",
+	DataCiphers:       []string{"AES-256-GCM"},
+	KeepaliveInterval: 10,
+	KeepaliveTimeout:  60,
+	Compress:          "lz4",
+}
+
+var allowedCiphers = []string{"AES-256-GCM", "AES-192-GCM", "AES-128-GCM", "CHACHA20-POLY1305"}
+
+// ServerOptions returns the server settings of the configuration, with defaults for options that are not set
+func (config *ConfigFile) ServerOptions() ServerSettings {
+	rv := config.Server
+	defaults := DefaultServerSettings
+
+	if rv.Port == 0 {
+		rv.Port = defaults.Port
+	}
+
+	if rv.Proto == "" {
+		rv.Proto = defaults.Proto
+	}
+
+	if len(rv.DataCiphers) == 0 {
+		rv.DataCiphers = defaults.DataCiphers
+	}
+
+	if rv.KeepaliveInterval == 0 {
+		rv.KeepaliveInterval = defaults.KeepaliveInterval
+		rv.KeepaliveTimeout = defaults.KeepaliveTimeout
+	}
+
+	if rv.Compress == "" {
+		rv.Compress = defaults.Compress
+	}
+
+	rv.StaticAddresses = config.HasStaticAddresses()
+
+	return rv
+}
+
+// serverLines returns the server settings that are set, as written in the global section
+func (settings ServerSettings) serverLines() []string {
+	var rv []string
+
+	if settings.Port != 0 {
+		rv = append(rv, fmt.Sprintf("port %d", settings.Port))
+	}
+
+	if settings.Proto != "" {
+		rv = append(rv, fmt.Sprintf("proto %s", settings.Proto))
+	}
+
+	if len(settings.DataCiphers) != 0 {
+		rv = append(rv, fmt.Sprintf("data-ciphers %s", strings.Join(settings.DataCiphers, ":")))
+	}
+
+	if settings.KeepaliveInterval != 0 {
+		rv = append(rv, fmt.Sprintf("keepalive %d %d", settings.KeepaliveInterval, settings.KeepaliveTimeout))
+	}
+
+	if settings.MTU != 0 {
+		rv = append(rv, fmt.Sprintf("mtu %d", settings.MTU))
+	}
+
+	if settings.Compress != "" {
+		rv = append(rv, fmt.Sprintf("compress %s", settings.Compress))
+	}
+
+	return rv
+}
+
+// parseServerOption parses a server setting of the global section. An option may be repeated with the same value, a
+// different value is an error.
+func parseServerOption(configFile *ConfigFile, stmt *ConfigStatement) (isServer bool, err error) {
+	settings := configFile.Server
+
+	switch stmt.Word {
+	case "port":
+		if len(stmt.Fields) != 1 {
+			return true, stmt.Errorf("port must have exactly one argument")
+		}
+
+		settings.Port, err = strconv.Atoi(stmt.Fields[0])
+
+		if err != nil || settings.Port < 1 || settings.Port > 65535 {
+			return true, stmt.Errorf("invalid port %s", stmt.Fields[0])
+		}
+	case "proto":
+		if len(stmt.Fields) != 1 {
+			return true, stmt.Errorf("proto must have exactly one argument")
+		}
+
+		if stmt.Fields[0] != "udp" && stmt.Fields[0] != "tcp" {
+			return true, stmt.Errorf("proto must be 'udp' or 'tcp'")
+		}
+
+		settings.Proto = stmt.Fields[0]
+	case "data-ciphers":
+		if len(stmt.Fields) == 0 {
+			return true, stmt.Errorf("data-ciphers must have at least one argument")
+		}
+
+		settings.DataCiphers = nil
+
+		for _, field := range stmt.Fields {
+			for _, cipher := range strings.Split(field, ":") {
+				cipher = strings.ToUpper(cipher)
+
+				if !containsString(allowedCiphers, cipher) {
+					return true, stmt.Errorf("unsupported cipher %s, must be one of %s", cipher, strings.Join(allowedCiphers, ", "))
+				}
+
+				settings.DataCiphers = append(settings.DataCiphers, cipher)
+			}
+		}
+	case "keepalive":
+		if len(stmt.Fields) != 2 {
+			return true, stmt.Errorf("keepalive must have exactly 2 arguments")
+		}
+
+		settings.KeepaliveInterval, err = strconv.Atoi(stmt.Fields[0])
+
+		if err != nil || settings.KeepaliveInterval < 1 {
+			return true, stmt.Errorf("invalid keepalive interval %s", stmt.Fields[0])
+		}
+
+		settings.KeepaliveTimeout, err = strconv.Atoi(stmt.Fields[1])
+
+		if err != nil || settings.KeepaliveTimeout < 2*settings.KeepaliveInterval {
+			return true, stmt.Errorf("keepalive timeout %s must be at least twice the interval", stmt.Fields[1])
+		}
+	case "mtu":
+		if len(stmt.Fields) != 1 {
+			return true, stmt.Errorf("mtu must have exactly one argument")
+		}
+
+		settings.MTU, err = strconv.Atoi(stmt.Fields[0])
+
+		if err != nil || settings.MTU < 576 || settings.MTU > 9000 {
+			return true, stmt.Errorf("invalid mtu %s, must be between 576 and 9000", stmt.Fields[0])
+		}
+	case "compress":
+		if len(stmt.Fields) != 1 {
+			return true, stmt.Errorf("compress must have exactly one argument")
+		}
+
+		switch stmt.Fields[0] {
+		case "off", "lz4", "lz4-v2":
+			settings.Compress = stmt.Fields[0]
+		default:
+			return true, stmt.Errorf("compress must be 'off', 'lz4' or 'lz4-v2'")
+		}
+	default:
+		return false, nil
+	}
+
+	if first := configFile.serverStmts[stmt.Word]; first != nil {
+		if previous := configFile.Server.serverLine(stmt.Word); previous != settings.serverLine(stmt.Word) {
+			return true, stmt.Errorf("%s conflicts with %s at %s:%d", stmt.Word, previous, first.File, first.Line)
+		}
+	} else {
+		if configFile.serverStmts == nil {
+			configFile.serverStmts = make(map[string]*ConfigStatement)
+		}
+
+		configFile.serverStmts[stmt.Word] = stmt
+	}
+
+	configFile.Server = settings
+
+	return true, nil
+}
+
+// serverLine returns the line setting option, or an empty string if it is not set
+func (settings ServerSettings) serverLine(option string) string {
+	for _, line := range settings.serverLines() {
+		if strings.HasPrefix(line, option+" ") {
+			return line
+		}
+	}
+
+	return ""
+}
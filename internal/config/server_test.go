@@ -0,0 +1,96 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServerOptions(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`global
+  port 443
+  proto tcp
+  data-ciphers aes-256-gcm:CHACHA20-POLY1305
+  mtu 1400
+  compress off
+  port 443
+`))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	settings := conf.ServerOptions()
+
+	if settings.Port != 443 || settings.Proto != "tcp" || settings.MTU != 1400 || settings.Compress != "off" {
+		t.Errorf("Unexpected settings %+v", settings)
+	}
+
+	if strings.Join(settings.DataCiphers, ":") != "AES-256-GCM:CHACHA20-POLY1305" {
+		t.Errorf("Unexpected ciphers %q", settings.DataCiphers)
+	}
+
+	// Options that are not set use the defaults
+	if settings.KeepaliveInterval != 10 || settings.KeepaliveTimeout != 60 {
+		t.Errorf("Unexpected keepalive %d %d", settings.KeepaliveInterval, settings.KeepaliveTimeout)
+	}
+
+	conf, err = ParseConfig(strings.NewReader("global\n  dns on\n"))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	if settings := conf.ServerOptions(); strings.Join(settings.serverLines(), "\n") != strings.Join(DefaultServerSettings.serverLines(), "\n") {
+		t.Errorf("Expected the default settings, got %+v", settings)
+	}
+}
+
+func TestServerOptionsInvalid(t *testing.T) {
+	for _, test := range []struct {
+		conf     string
+		expected string
+	}{
+		{"port 0", "config:2 invalid port 0"},
+		{"port 1194 1195", "config:2 port must have exactly one argument"},
+		{"proto sctp", "config:2 proto must be 'udp' or 'tcp'"},
+		{"data-ciphers BF-CBC", "config:2 unsupported cipher BF-CBC"},
+		{"keepalive 10 15", "config:2 keepalive timeout 15 must be at least twice the interval"},
+		{"mtu 100", "config:2 invalid mtu 100"},
+		{"compress lzo", "config:2 compress must be 'off', 'lz4' or 'lz4-v2'"},
+	} {
+		_, err := parseGlobalSection(test.conf)
+
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error starting with %q, got %v", test.conf, test.expected, err)
+		}
+	}
+}
+
+func TestServerOptionsConflict(t *testing.T) {
+	for _, test := range []struct {
+		conf     string
+		expected string
+	}{
+		{"port 1194\n  port 443", "config:3 port conflicts with port 1194 at config:2"},
+		{"proto udp\n  proto tcp", "config:3 proto conflicts with proto udp at config:2"},
+		{"data-ciphers AES-256-GCM\n  data-ciphers AES-128-GCM", "config:3 data-ciphers conflicts with data-ciphers AES-256-GCM at config:2"},
+		{"keepalive 10 60\n  keepalive 10 120", "config:3 keepalive conflicts with keepalive 10 60 at config:2"},
+		{"compress lz4\n  compress off", "config:3 compress conflicts with compress lz4 at config:2"},
+	} {
+		_, err := parseGlobalSection(test.conf)
+
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("%q: expected an error starting with %q, got %v", test.conf, test.expected, err)
+		}
+	}
+
+	// Repeating an option with the same value is not a conflict
+	if _, err := parseGlobalSection("data-ciphers aes-256-gcm\n  data-ciphers AES-256-GCM"); err != nil {
+		t.Errorf("Expected repeated data-ciphers to be accepted, got %s", err)
+	}
+}
+
+// parseGlobalSection parses a configuration with statements in its global section
+func parseGlobalSection(statements string) (*ConfigFile, error) {
+	return ParseConfig(strings.NewReader("global\n  " + statements + "\n"))
+}
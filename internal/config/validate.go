@@ -0,0 +1,286 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+type unknownStatementError struct {
+	stmt *ConfigStatement
+}
+
+func (e *unknownStatementError) Error() string {
+	return e.stmt.Errorf("unknown statement %s", e.stmt.Word).Error()
+}
+
+// validator collects problems that are ignored when parsing normally
+type validator struct {
+	problems  []error
+	sections  map[string]*ConfigStatement
+	subnets   []*ConfigStatement
+	selectors []selectorReference
+	networks  map[string][]networkReference
+	order     []string
+}
+
+type selectorReference struct {
+	selector SubnetSelector
+	stmt     *ConfigStatement
+}
+
+// networkReference is an allowed network in a section, either a network or a subnet to be looked up in NetworkInfo
+type networkReference struct {
+	network *net.IPNet
+	subnet  string
+	ports   []Port // empty for all traffic
+	stmt    *ConfigStatement
+}
+
+// ParseConfigStrict parses a single configuration file, returning every problem found. Subnets are checked against netinfo
+// unless it is nil. The configuration is nil if it could not be parsed.
+func ParseConfigStrict(reader io.Reader, netinfo *NetworkInfo) (*ConfigFile, []error) {
+	configFile := newConfigFile()
+	configFile.validator = newValidator()
+	configFile.variables = NewVariableResolver(nil)
+
+	err := configFile.parse(configFile.open("config", reader), nil, nil)
+
+	return configFile.finishValidation(err, netinfo)
+}
+
+// LoadConfigStrict fetches and parses the configuration file at path and every file it includes, returning every
+// problem found. Subnets are checked against netinfo unless it is nil. The configuration is nil if it could not be parsed.
+func LoadConfigStrict(backend ConfigurationBackend, path string, netinfo *NetworkInfo) (*ConfigFile, []error) {
+	configFile := newConfigFile()
+	configFile.validator = newValidator()
+	configFile.variables = NewVariableResolver(backend)
+
+	err := configFile.load(backend, path, nil)
+
+	return configFile.finishValidation(err, netinfo)
+}
+
+func newValidator() *validator {
+	return &validator{
+		sections: make(map[string]*ConfigStatement),
+		networks: make(map[string][]networkReference),
+	}
+}
+
+func (configFile *ConfigFile) finishValidation(err error, netinfo *NetworkInfo) (*ConfigFile, []error) {
+	v := configFile.validator
+	configFile.validator = nil
+
+	if err == nil {
+		err = configFile.resolve()
+	}
+
+	if err != nil {
+		return nil, append(v.problems, err)
+	}
+
+	v.checkOverlaps(netinfo)
+
+	if configFile.Network6 == nil {
+		v.checkIPv6Routes()
+	}
+
+	if netinfo != nil {
+		v.checkSubnets(netinfo)
+	}
+
+	return configFile, v.problems
+}
+
+// unknownStatement reports a statement that is not understood, it is an error in strict mode and a warning otherwise
+func (configFile *ConfigFile) unknownStatement(err *unknownStatementError) {
+	if configFile.validator != nil {
+		configFile.validator.problems = append(configFile.validator.problems, err)
+	} else {
+		logger.Warnf("Ignoring %s", err)
+	}
+}
+
+func (v *validator) declareSection(stmt *ConfigStatement) {
+	key := stmt.SectionType
+
+	if stmt.SectionName != "" {
+		key += " " + stmt.SectionName
+	}
+
+	if first := v.sections[key]; first != nil {
+		v.problems = append(v.problems, stmt.Errorf("duplicate section %s, first declared at %s:%d", key, first.File, first.Line))
+	} else {
+		v.sections[key] = stmt
+	}
+}
+
+// record notes the networks and subnets used by a statement that has been parsed successfully
+func (v *validator) record(stmt *ConfigStatement) {
+	if stmt.Word == "" {
+		return
+	}
+
+	key := stmt.SectionType + " " + stmt.SectionName
+	fields := stmt.Fields
+	word := stmt.Word
+
+	// Network sections hold routes without the route keyword
+	if stmt.SectionType == "network" && word != "subnets" && !isSubnetId(word) {
+		fields = append([]string{word}, fields...)
+		word = "route"
+	}
+
+	if word == "deny" && len(fields) != 0 {
+		if isSubnetId(fields[0]) {
+			v.subnets = append(v.subnets, stmt)
+		} else if fields[0] == "subnets" {
+			v.recordSelector(stmt, fields[1:])
+		}
+	} else if isSubnetId(word) {
+		v.subnets = append(v.subnets, stmt)
+		ports, _ := parsePorts(stmt, fields)
+		v.addNetwork(key, networkReference{subnet: subnetName(stmt), ports: ports, stmt: stmt})
+	} else if word == "subnets" {
+		v.recordSelector(stmt, fields)
+	} else if word == "route" {
+		route, err := parseRouteFields(stmt, fields)
+
+		if err == nil && route.Alias == "" {
+			network := route.Network
+			v.addNetwork(key, networkReference{network: &network, ports: route.Ports, stmt: stmt})
+		}
+	}
+}
+
+func (v *validator) recordSelector(stmt *ConfigStatement, fields []string) {
+	selector, err := parseSelector(stmt, fields)
+
+	if err == nil {
+		v.selectors = append(v.selectors, selectorReference{selector: selector, stmt: stmt})
+	}
+}
+
+func (v *validator) addNetwork(key string, ref networkReference) {
+	if _, exists := v.networks[key]; !exists {
+		v.order = append(v.order, key)
+	}
+
+	v.networks[key] = append(v.networks[key], ref)
+}
+
+// subnetName returns the subnet id referenced by a statement
+func subnetName(stmt *ConfigStatement) string {
+	if isSubnetId(stmt.Word) {
+		return stmt.Word
+	} else if len(stmt.Fields) != 0 && isSubnetId(stmt.Fields[0]) {
+		return stmt.Fields[0]
+	}
+
+	return ""
+}
+
+func (v *validator) checkSubnets(netinfo *NetworkInfo) {
+	for _, stmt := range v.subnets {
+		name := subnetName(stmt)
+
+		if netinfo.subnetNetworks(name) == nil {
+			v.problems = append(v.problems, stmt.Errorf("%s does not exist", name))
+		}
+	}
+
+	for _, ref := range v.selectors {
+		if len(ref.selector.expand(netinfo)) == 0 {
+			v.problems = append(v.problems, ref.stmt.Errorf("%s does not match any subnet", ref.selector.String()))
+		}
+	}
+}
+
+// checkOverlaps reports networks in the same section that are duplicated or contained by one another, for some of the
+// same ports
+func (v *validator) checkOverlaps(netinfo *NetworkInfo) {
+	for _, key := range v.order {
+		refs := v.networks[key]
+
+		for i, ref := range refs {
+			network := ref.resolve(netinfo)
+
+			if network == nil {
+				continue
+			}
+
+			for _, other := range refs[:i] {
+				otherNetwork := other.resolve(netinfo)
+
+				if otherNetwork == nil || !overlaps(*network, *otherNetwork) || !portsOverlap(ref.ports, other.ports) {
+					continue
+				}
+
+				var message string
+
+				if network.String() == otherNetwork.String() {
+					message = fmt.Sprintf("%s duplicates %s", ref.String(), other.String())
+				} else {
+					message = fmt.Sprintf("%s overlaps %s", ref.String(), other.String())
+				}
+
+				v.problems = append(v.problems, ref.stmt.Errorf("%s at %s:%d", message, other.stmt.File, other.stmt.Line))
+			}
+		}
+	}
+}
+
+// portsOverlap checks whether two port lists allow any of the same traffic, an empty list allows all traffic
+func portsOverlap(a, b []Port) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+
+	for _, portA := range a {
+		for _, portB := range b {
+			if portA.Protocol != portB.Protocol {
+				continue
+			}
+
+			if portA.From == 0 || portB.From == 0 || (portA.From <= portB.To && portB.From <= portA.To) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkIPv6Routes reports IPv6 networks, which are not pushed to clients unless the tunnel has an IPv6 network
+func (v *validator) checkIPv6Routes() {
+	for _, key := range v.order {
+		for _, ref := range v.networks[key] {
+			if ref.network != nil && ref.network.IP.To4() == nil {
+				v.problems = append(v.problems, ref.stmt.Errorf("%s is an IPv6 network, but net6 is not set", ref.network.String()))
+			}
+		}
+	}
+}
+
+func (ref networkReference) resolve(netinfo *NetworkInfo) *net.IPNet {
+	if ref.network != nil {
+		return ref.network
+	}
+
+	if netinfo != nil {
+		if network, exists := netinfo.Subnets[ref.subnet]; exists {
+			return &network
+		}
+	}
+
+	return nil
+}
+
+func (ref networkReference) String() string {
+	if ref.network != nil {
+		return ref.network.String()
+	}
+
+	return ref.subnet
+}
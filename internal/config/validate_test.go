@@ -0,0 +1,68 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestValidateUnknownSubnets(t *testing.T) {
+	_, known, _ := net.ParseCIDR("10.0.1.0/24")
+	netinfo := &NetworkInfo{Subnets: map[string]net.IPNet{"subnet-known": *known}}
+
+	_, errs := ParseConfigStrict(strings.NewReader(`network office
+  subnet-missing
+  subnet-known
+
+group devs
+  subnet-absent 22
+  route office
+`), netinfo)
+
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %q", errs)
+	}
+
+	for i, subnet := range []string{"subnet-missing", "subnet-absent"} {
+		if !strings.Contains(errs[i].Error(), subnet) {
+			t.Errorf("Expected error %d to name %s, got %s", i, subnet, errs[i])
+		}
+	}
+}
+
+func TestValidateOverlaps(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	netinfo := &NetworkInfo{Subnets: map[string]net.IPNet{"subnet-a": *subnet}}
+
+	for _, test := range []struct {
+		name     string
+		rules    string
+		expected string // empty if there is no problem
+	}{
+		{"different ports", "route 10.0.0.0/16 tcp/22\n  route 10.0.1.0/24 tcp/443", ""},
+		{"different protocols", "route 10.0.0.0/16 udp/53\n  route 10.0.1.0/24 53", ""},
+		{"disjoint ranges", "route 10.0.0.0/16 8000-8099\n  route 10.0.1.0/24 8100-8199", ""},
+		{"disjoint networks", "route 10.0.0.0/24\n  route 10.0.1.0/24", ""},
+		{"same port", "route 10.0.0.0/16 22 443\n  route 10.0.1.0/24 443",
+			"config:3 10.0.1.0/24 overlaps 10.0.0.0/16 at config:2"},
+		{"overlapping ranges", "route 10.0.0.0/16 8000-8099\n  route 10.0.1.0/24 8050-8150",
+			"config:3 10.0.1.0/24 overlaps 10.0.0.0/16 at config:2"},
+		{"all traffic", "route 10.0.0.0/16\n  route 10.0.1.0/24 tcp/443",
+			"config:3 10.0.1.0/24 overlaps 10.0.0.0/16 at config:2"},
+		{"whole protocol", "route 10.0.0.0/16 udp\n  route 10.0.1.0/24 udp/53",
+			"config:3 10.0.1.0/24 overlaps 10.0.0.0/16 at config:2"},
+		{"duplicate", "route 10.0.1.0/24 22\n  route 10.0.1.0/24 22",
+			"config:3 10.0.1.0/24 duplicates 10.0.1.0/24 at config:2"},
+		{"subnet with other ports", "subnet-a 22\n  route 10.0.0.0/16 443", ""},
+		{"subnet with same port", "subnet-a 22\n  route 10.0.0.0/16 22",
+			"config:3 10.0.0.0/16 overlaps subnet-a at config:2"},
+	} {
+		_, errs := ParseConfigStrict(strings.NewReader("group devs\n  "+test.rules+"\n"), netinfo)
+
+		if test.expected == "" && len(errs) != 0 {
+			t.Errorf("%s: expected no problems, got %q", test.name, errs)
+		} else if test.expected != "" && (len(errs) != 1 || errs[0].Error() != test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, errs)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// VariableResolver provides the values of ${name} variables in configuration files
+type VariableResolver interface {
+	// LookupVariable returns the value of a variable, exists is false if the variable is not defined
+	LookupVariable(name string) (value string, exists bool, err error)
+}
+
+// environmentVariables resolves variables from the process environment, and names with a prefix such as aws: from the
+// backend
+type environmentVariables struct {
+	backend ConfigurationBackend
+}
+
+// NewVariableResolver returns a resolver for environment variables and the variables provided by backend, which may be nil
+func NewVariableResolver(backend ConfigurationBackend) VariableResolver {
+	return &environmentVariables{backend: backend}
+}
+
+func (v *environmentVariables) LookupVariable(name string) (string, bool, error) {
+	if strings.IndexRune(name, ':') != -1 {
+		if resolver, ok := v.backend.(VariableResolver); ok {
+			return resolver.LookupVariable(name)
+		}
+
+		return "", false, nil
+	}
+
+	value, exists := os.LookupEnv(name)
+
+	return value, exists, nil
+}
+
+// hasVariable checks whether a line contains a ${name} variable
+func hasVariable(line string) bool {
+	return strings.Contains(line, "${")
+}
+
+// substitute replaces each ${name} in line with its value. $${ is a literal ${, any other $ is kept as written.
+func (p *Parser) substitute(line string) (string, error) {
+	if p.variables == nil || strings.IndexByte(line, '$') == -1 {
+		return line, nil
+	}
+
+	var rv strings.Builder
+
+	for {
+		dollar := strings.IndexByte(line, '$')
+
+		if dollar == -1 || dollar == len(line)-1 {
+			rv.WriteString(line)
+			break
+		}
+
+		rv.WriteString(line[:dollar])
+
+		if strings.HasPrefix(line[dollar+1:], "${") {
+			rv.WriteString("${")
+			line = line[dollar+3:]
+			continue
+		} else if line[dollar+1] != '{' {
+			rv.WriteByte('$')
+			line = line[dollar+1:]
+			continue
+		}
+
+		end := strings.IndexByte(line[dollar:], '}')
+
+		if end == -1 {
+			return "", fmt.Errorf("%s:%d unterminated variable %s", p.file, p.line, line[dollar:])
+		}
+
+		name := line[dollar+2 : dollar+end]
+
+		if name == "" {
+			return "", fmt.Errorf("%s:%d empty variable name", p.file, p.line)
+		}
+
+		value, exists, err := p.variables.LookupVariable(name)
+
+		if err != nil {
+			return "", fmt.Errorf("%s:%d error resolving variable %s: %w", p.file, p.line, name, err)
+		}
+
+		if !exists {
+			return "", fmt.Errorf("%s:%d undefined variable %s", p.file, p.line, name)
+		}
+
+		rv.WriteString(value)
+		line = line[dollar+end+1:]
+	}
+
+	return rv.String(), nil
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// variableBackend is a backend providing aws: variables
+type variableBackend struct {
+	*MemoryConfig
+	variables map[string]string
+	err       error
+}
+
+func (b *variableBackend) LookupVariable(name string) (string, bool, error) {
+	if b.err != nil {
+		return "", false, b.err
+	}
+
+	value, exists := b.variables[name]
+
+	return value, exists, nil
+}
+
+func newVariableBackend() *variableBackend {
+	return &variableBackend{
+		MemoryConfig: NewMemoryConfig(),
+		variables:    map[string]string{"aws:region": "us-east-1", "aws:vpc-cidr": "10.180.0.0/16"},
+	}
+}
+
+// substituteLine reads the statement on the second line of a file, after a section header
+func substituteLine(resolver VariableResolver, line string) (string, error) {
+	parser := OpenFile("vpn.conf", strings.NewReader("global\n  "+line+"\n"))
+	parser.SetVariables(resolver)
+
+	for {
+		stmt, err := parser.Read()
+
+		if err != nil {
+			return "", err
+		}
+
+		if stmt.Line == 2 {
+			return strings.Join(append([]string{stmt.Word}, stmt.Fields...), " "), nil
+		}
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	os.Setenv("OPENVPN_AWS_TEST_DOMAIN", "example.com")
+	os.Setenv("OPENVPN_AWS_TEST_EMPTY", "")
+	os.Setenv("OPENVPN_AWS_TEST_ROUTES", "10.1.0.0/16 22")
+	defer os.Unsetenv("OPENVPN_AWS_TEST_DOMAIN")
+	defer os.Unsetenv("OPENVPN_AWS_TEST_EMPTY")
+	defer os.Unsetenv("OPENVPN_AWS_TEST_ROUTES")
+
+	resolver := NewVariableResolver(newVariableBackend())
+
+	for _, test := range []struct {
+		line     string
+		expected string
+	}{
+		{"route53 Z4C9 vpn.${OPENVPN_AWS_TEST_DOMAIN}", "route53 Z4C9 vpn.example.com"},
+		{"route ${aws:vpc-cidr} 22", "route 10.180.0.0/16 22"},
+		{"route ${OPENVPN_AWS_TEST_ROUTES}", "route 10.1.0.0/16 22"},
+		{"dns-domain ${aws:region}.${OPENVPN_AWS_TEST_DOMAIN}${OPENVPN_AWS_TEST_EMPTY}", "dns-domain us-east-1.example.com"},
+		{"dns-search $${literal}", "dns-search ${literal}"},
+		{"dns-search $$$${OPENVPN_AWS_TEST_DOMAIN}", "dns-search $$${OPENVPN_AWS_TEST_DOMAIN}"},
+		{"dns-search $$ a$b $", "dns-search $$ a$b $"},
+		{"dns-search $${OPENVPN_AWS_TEST_DOMAIN} ${OPENVPN_AWS_TEST_DOMAIN}", "dns-search ${OPENVPN_AWS_TEST_DOMAIN} example.com"},
+	} {
+		line, err := substituteLine(resolver, test.line)
+
+		if err != nil {
+			t.Errorf("Error substituting %q: %s", test.line, err)
+		} else if line != test.expected {
+			t.Errorf("substitute(%q) = %q, expected %q", test.line, line, test.expected)
+		}
+	}
+}
+
+func TestSubstituteErrors(t *testing.T) {
+	os.Unsetenv("OPENVPN_AWS_TEST_UNDEFINED")
+
+	backend := newVariableBackend()
+	resolver := NewVariableResolver(backend)
+
+	for _, test := range []struct {
+		line     string
+		expected string
+	}{
+		{"route ${OPENVPN_AWS_TEST_UNDEFINED}", "vpn.conf:2 undefined variable OPENVPN_AWS_TEST_UNDEFINED"},
+		{"route ${aws:subnet-id}", "vpn.conf:2 undefined variable aws:subnet-id"},
+		{"route ${aws:vpc-cidr 22", "vpn.conf:2 unterminated variable ${aws:vpc-cidr 22"},
+		{"route ${} 22", "vpn.conf:2 empty variable name"},
+	} {
+		_, err := substituteLine(resolver, test.line)
+
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("Expected error %q substituting %q, got %v", test.expected, test.line, err)
+		}
+	}
+
+	// Without a backend providing variables, names with a prefix are undefined
+	if _, err := substituteLine(NewVariableResolver(nil), "route ${aws:vpc-cidr}"); err == nil || err.Error() != "vpn.conf:2 undefined variable aws:vpc-cidr" {
+		t.Errorf("Expected aws:vpc-cidr to be undefined, got %v", err)
+	}
+
+	backend.err = errors.New("connection refused")
+
+	if _, err := substituteLine(resolver, "route ${aws:vpc-cidr}"); err == nil || !errors.Is(err, backend.err) || !strings.HasPrefix(err.Error(), "vpn.conf:2 error resolving variable aws:vpc-cidr") {
+		t.Errorf("Expected the backend error to be returned, got %v", err)
+	}
+}
+
+func TestLoadConfigVariables(t *testing.T) {
+	backend := newVariableBackend()
+	backend.PutFile("vpn.conf", []byte("global\n  net 169.254.121.0/24\n\ngroup devs\n  route ${aws:vpc-cidr} 22\n"))
+
+	conf, err := LoadConfig(backend, "vpn.conf")
+
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+
+	if routes := conf.Groups["devs"].Routes; len(routes) != 1 || routes[0].String() != "10.180.0.0/16 22" {
+		t.Errorf("Unexpected routes %v", routes)
+	}
+
+	backend.PutFile("vpn.conf", []byte("global\n  net 169.254.121.0/24\n\ngroup devs\n  route ${aws:vpc-id}\n"))
+
+	if _, err = LoadConfig(backend, "vpn.conf"); err == nil || err.Error() != "vpn.conf:5 undefined variable aws:vpc-id" {
+		t.Errorf("Expected an undefined variable error, got %v", err)
+	}
+}
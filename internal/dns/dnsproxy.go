@@ -4,59 +4,60 @@ import (
 	"context"
 	"github.com/amadigan/openvpn-aws/internal/log"
 	"github.com/miekg/dns"
+	"net"
 	"time"
 )
 
 var logger = log.New("dns")
 
 type DNSProxy struct {
-	udp *handler
-	tcp *handler
+	handlers []*handler
 }
 
-func StartProxy(addr string) (*DNSProxy, error) {
-	addr = addr + ":53"
+// StartProxy listens on port 53 of each address with UDP and TCP, and forwards queries to the servers in /etc/resolv.conf
+func StartProxy(addrs ...string) (*DNSProxy, error) {
 	clientConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
 
 	if err != nil {
 		return nil, err
 	}
 
-	proxy := new(DNSProxy)
-
-	proxy.udp = &handler{servers: make([]string, len(clientConfig.Servers)), client: new(dns.Client)}
+	servers := make([]string, len(clientConfig.Servers))
 
 	for k, v := range clientConfig.Servers {
-		proxy.udp.servers[k] = v + ":53"
+		servers[k] = net.JoinHostPort(v, "53")
 	}
 
-	proxy.tcp = &handler{servers: proxy.udp.servers, client: &dns.Client{Net: "tcp"}}
+	proxy := new(DNSProxy)
 
-	err = proxy.udp.serve(addr, "udp")
+	for _, addr := range addrs {
+		for _, network := range []string{"udp", "tcp"} {
+			h := &handler{servers: servers, client: &dns.Client{Net: network}}
 
-	if err != nil {
-		return nil, err
-	}
+			err = h.serve(net.JoinHostPort(addr, "53"), network)
 
-	err = proxy.tcp.serve(addr, "tcp")
+			if err != nil {
+				proxy.Stop()
+				return nil, err
+			}
 
-	if err != nil {
-		proxy.udp.stop()
-		return nil, err
+			proxy.handlers = append(proxy.handlers, h)
+		}
 	}
 
 	return proxy, nil
 }
 
 func (proxy *DNSProxy) Stop() error {
-	udpErr := proxy.udp.stop()
-	tcpErr := proxy.tcp.stop()
+	var rv error
 
-	if udpErr != nil {
-		return udpErr
+	for _, h := range proxy.handlers {
+		if err := h.stop(); err != nil && rv == nil {
+			rv = err
+		}
 	}
 
-	return tcpErr
+	return rv
 }
 
 type handler struct {
@@ -79,7 +80,7 @@ func (h *handler) ServeDNS(w dns.ResponseWriter, msg *dns.Msg) {
 			w.WriteMsg(r)
 			break
 		} else {
-			logger.Error("Error: %s", err)
+			logger.Errorf("Error: %s", err)
 		}
 	}
 
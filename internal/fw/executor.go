@@ -0,0 +1,32 @@
+package fw
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Executor runs the commands that configure the firewall, it may be replaced to observe the commands without root
+type Executor interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+type systemExecutor struct{}
+
+// SystemExecutor runs commands on the host
+var SystemExecutor Executor = systemExecutor{}
+
+func (systemExecutor) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func run(executor Executor, name string, a ...string) error {
+	logger.Debugf("Running %s %s", name, strings.Join(a, " "))
+	out, err := executor.Run(name, a...)
+
+	if err != nil {
+		return fmt.Errorf("Failed to execute %s %s: %s (%w)", name, strings.Join(a, " "), out, err)
+	}
+
+	return nil
+}
@@ -3,12 +3,10 @@ package fw
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"github.com/amadigan/openvpn-aws/internal/log"
 	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,15 +17,29 @@ var logger = log.New("firewall")
 type Firewall struct {
 	vpnInterface string
 	wanInterface string
+	ipv6         bool // Rules for IPv6 networks are added with ip6tables, they are ignored when false
+	executor     Executor
 	userChains   map[string][]chainRule
 	chainlock    sync.RWMutex
 	connections  map[userAddress]string
 	connlock     sync.Mutex
+	shaper       *shaper
 }
 
+// maxMultiport is the number of ports accepted by the iptables multiport match, a range counts as two ports
+const maxMultiport = 15
+
 type FirewallRule struct {
-	Network net.IPNet
-	Port    uint16
+	Network  net.IPNet
+	Protocol string      // tcp, udp, icmp or empty for all protocols
+	Ports    []PortRange // empty for all
+	Deny     bool        // Drop matching traffic, deny rules are placed ahead of all other rules
+	Drop     bool        // Drop matching traffic in order, so that the rules ahead of it take precedence
+}
+
+type PortRange struct {
+	From uint16
+	To   uint16
 }
 
 type userAddress struct {
@@ -37,27 +49,24 @@ type userAddress struct {
 }
 
 type chainRule struct {
-	ip   [16]byte
-	size int    // Size of the IP in bytes, 4 or 16
-	mask int    // Bits of the mask
-	port uint16 // 0 for all
+	ip       [16]byte
+	size     int    // Size of the IP in bytes, 4 or 16
+	mask     int    // Bits of the mask
+	protocol string // empty for all
+	ports    string // iptables port list, empty for all
+	deny     bool
 }
 
-func InitFirewall(vpnInterface string) (*Firewall, error) {
-	err := iptables("--policy", "FORWARD", "DROP")
+// InitFirewall enables forwarding and sets up the global rules, IPv6 traffic is only forwarded when ipv6 is true
+func InitFirewall(vpnInterface string, ipv6 bool) (*Firewall, error) {
+	err := enableForwarding("/proc/sys/net/ipv4/ip_forward")
 
 	if err != nil {
 		return nil, err
 	}
 
-	bs, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
-
-	if err != nil {
-		return nil, err
-	}
-
-	if len(bs) == 0 || bs[0] != '1' {
-		err = ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+	if ipv6 {
+		err = enableForwarding("/proc/sys/net/ipv6/conf/all/forwarding")
 
 		if err != nil {
 			return nil, err
@@ -70,25 +79,61 @@ func InitFirewall(vpnInterface string) (*Firewall, error) {
 		return nil, err
 	}
 
-	err = iptables("--table", "nat", "--append", "POSTROUTING", "--out-interface", *wanInterface, "--jump", "MASQUERADE")
+	fw := NewFirewall(vpnInterface, *wanInterface, ipv6, SystemExecutor)
 
-	if err != nil {
-		return nil, err
+	for _, v6 := range []bool{false, true} {
+		if v6 && !ipv6 {
+			break
+		}
+
+		err = fw.iptablesFor(v6, "--policy", "FORWARD", "DROP")
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = fw.iptablesFor(v6, "--table", "nat", "--append", "POSTROUTING", "--out-interface", fw.wanInterface, "--jump", "MASQUERADE")
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = fw.iptablesFor(v6, "--append", "FORWARD", "--match", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "--jump", "ACCEPT")
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = iptables("--append", "FORWARD", "--match", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "--jump", "ACCEPT")
+	return fw, nil
+}
+
+func enableForwarding(path string) error {
+	bs, err := ioutil.ReadFile(path)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	if len(bs) == 0 || bs[0] != '1' {
+		return ioutil.WriteFile(path, []byte("1"), 0644)
+	}
+
+	return nil
+}
+
+// NewFirewall creates a firewall that runs its commands with executor, without changing the system's global rules
+func NewFirewall(vpnInterface, wanInterface string, ipv6 bool, executor Executor) *Firewall {
 	fw := new(Firewall)
 	fw.vpnInterface = vpnInterface
-	fw.wanInterface = *wanInterface
+	fw.wanInterface = wanInterface
+	fw.ipv6 = ipv6
+	fw.executor = executor
 	fw.userChains = make(map[string][]chainRule)
 	fw.connections = make(map[userAddress]string)
+	fw.shaper = newShaper(vpnInterface, executor)
 
-	return fw, nil
+	return fw
 }
 
 func to16(ip net.IP) (ip16 [16]byte) {
@@ -96,18 +141,26 @@ func to16(ip net.IP) (ip16 [16]byte) {
 	return ip16
 }
 
-func (fw *Firewall) ConnectUser(user string, ip net.IPNet) error {
+func newUserAddress(ip net.IPNet) userAddress {
 	addr := userAddress{ip: to16(ip.IP)}
-
 	addr.mask, addr.size = ip.Mask.Size()
 
+	return addr
+}
+
+// ConnectUser sends traffic from ip through the chain of user and limits its bandwidth, a zero limit is unlimited. The
+// addresses of one session share its limit.
+func (fw *Firewall) ConnectUser(user string, session uint64, ip net.IPNet, limit Bandwidth) error {
+	addr := newUserAddress(ip)
+
 	fw.connlock.Lock()
 	defer fw.connlock.Unlock()
 
 	existingUser, exists := fw.connections[addr]
+	v6 := addr.size == 128
 
 	if exists {
-		err := iptables("--delete", "FORWARD", "--in-interface", fw.vpnInterface, "--source", ip.String(), "--jump", "user-"+existingUser)
+		err := fw.iptablesFor(v6, "--delete", "FORWARD", "--in-interface", fw.vpnInterface, "--source", ip.String(), "--jump", "user-"+existingUser)
 
 		if err != nil {
 			return err
@@ -116,13 +169,17 @@ func (fw *Firewall) ConnectUser(user string, ip net.IPNet) error {
 
 	fw.connections[addr] = user
 
-	return iptables("--append", "FORWARD", "--in-interface", fw.vpnInterface, "--source", ip.String(), "--jump", "user-"+user)
+	err := fw.iptablesFor(v6, "--append", "FORWARD", "--in-interface", fw.vpnInterface, "--source", ip.String(), "--jump", "user-"+user)
+
+	if err != nil {
+		return err
+	}
+
+	return fw.shaper.limit(session, addr, ip.IP, limit)
 }
 
 func (fw *Firewall) DisconnectUser(user string, ip net.IPNet) error {
-	addr := userAddress{ip: to16(ip.IP)}
-
-	addr.mask, addr.size = ip.Mask.Size()
+	addr := newUserAddress(ip)
 
 	fw.connlock.Lock()
 	defer fw.connlock.Unlock()
@@ -131,30 +188,57 @@ func (fw *Firewall) DisconnectUser(user string, ip net.IPNet) error {
 
 	if existingUser == user {
 		delete(fw.connections, addr)
-		return iptables("--delete", "FORWARD", "--in-interface", fw.vpnInterface, "--source", ip.String(), "--jump", "user-"+user)
+		err := fw.iptablesFor(addr.size == 128, "--delete", "FORWARD", "--in-interface", fw.vpnInterface, "--source", ip.String(), "--jump", "user-"+user)
+
+		if err != nil {
+			return err
+		}
+
+		return fw.shaper.release(addr)
 	}
 
 	return nil
 }
 
 func (fw *Firewall) UpdateUser(user string, rules []FirewallRule) error {
-	chainRules := make(map[chainRule]bool)
+	chainRules := make([]chainRule, 0, len(rules))
+	added := make(map[chainRule]bool, len(rules))
+
+	addEntry := func(entry chainRule) {
+		if !added[entry] {
+			added[entry] = true
+			chainRules = append(chainRules, entry)
+		}
+	}
+
+	for _, deny := range []bool{true, false} {
+		for _, rule := range rules {
+			if rule.Deny != deny || (rule.Network.IP.To4() == nil && !fw.ipv6) {
+				continue
+			}
 
-	for _, rule := range rules {
-		entry := chainRule{ip: to16(rule.Network.IP)}
-		entry.size, entry.mask = rule.Network.Mask.Size()
-		entry.port = rule.Port
-		chainRules[entry] = true
+			entry := chainRule{ip: to16(rule.Network.IP), protocol: rule.Protocol, deny: rule.Deny || rule.Drop}
+			entry.size, entry.mask = rule.Network.Mask.Size()
+
+			if len(rule.Ports) == 0 {
+				addEntry(entry)
+			}
+
+			for _, ports := range multiportLists(rule.Ports) {
+				entry.ports = ports
+				addEntry(entry)
+			}
+		}
 	}
 
 	fw.chainlock.RLock()
-	current := fw.userChains[user]
+	current, exists := fw.userChains[user]
 
-	update := (current == nil && len(rules) != 0) || len(current) != len(rules)
+	update := exists != (rules != nil) || len(current) != len(chainRules)
 
 	if !update {
-		for _, entry := range current {
-			if !chainRules[entry] {
+		for index, entry := range current {
+			if chainRules[index] != entry {
 				update = true
 				break
 			}
@@ -167,9 +251,9 @@ func (fw *Firewall) UpdateUser(user string, rules []FirewallRule) error {
 		return nil
 	}
 
-	if current == nil {
+	if !exists {
 		logger.Infof("Adding user %s", user)
-	} else if len(rules) == 0 {
+	} else if rules == nil {
 		logger.Infof("Deleting user %s", user)
 	} else {
 		logger.Infof("Updating rules for user %s", user)
@@ -178,150 +262,163 @@ func (fw *Firewall) UpdateUser(user string, rules []FirewallRule) error {
 	fw.chainlock.Lock()
 	defer fw.chainlock.Unlock()
 
-	current = fw.userChains[user]
+	_, exists = fw.userChains[user]
 
 	chain := "user-" + user
 
 	if rules == nil {
-		if current != nil {
+		if exists {
 			delete(fw.userChains, user)
 			return fw.dropChain(chain)
 		} else {
 			return nil
 		}
-	} else if current == nil {
-		err := fw.createChain(chain)
-
-		if err != nil {
-			return err
-		}
+	}
 
-		current = make([]chainRule, len(chainRules), len(chainRules))
-		var index int
+	var err error
 
-		for entry, _ := range chainRules {
-			current[index] = entry
-			index++
-			err = fw.addRule(chain, entry)
+	// Rules are rebuilt in order, deny rules must remain ahead of the rules they override
+	if exists {
+		err = fw.flushChain(chain)
+	} else {
+		err = fw.createChain(chain)
+	}
 
-			if err != nil {
-				return err
-			}
-		}
+	if err != nil {
+		return err
+	}
 
-		fw.userChains[user] = current
-	} else {
-		toDelete := make([]int, 0, len(current))
+	for _, entry := range chainRules {
+		err = fw.addRule(chain, entry)
 
-		for index, entry := range current {
-			if chainRules[entry] {
-				delete(chainRules, entry)
-			} else {
-				toDelete = append(toDelete, index)
-			}
+		if err != nil {
+			fw.userChains[user] = nil
+			return err
 		}
+	}
 
-		var deletePointer int
-
-		for entry, _ := range chainRules {
-			if deletePointer < len(toDelete) {
-				rulenum := toDelete[deletePointer]
-				deletePointer++
-				fw.replaceRule(chain, rulenum, entry)
-				current[rulenum] = entry
-			} else {
-				fw.addRule(chain, entry)
-				current = append(current, entry)
-			}
-		}
+	fw.userChains[user] = chainRules
 
-		for i := len(toDelete) - 1; i >= deletePointer; i-- {
-			rulenum := toDelete[deletePointer]
-			fw.deleteRule(chain, rulenum)
-			copy(current[rulenum:], current[rulenum+1:])
-		}
+	return nil
+}
+
+// eachTable runs a command with iptables, and with ip6tables when IPv6 is enabled
+func (fw *Firewall) eachTable(a ...string) error {
+	err := fw.iptables(a...)
 
-		fw.userChains[user] = current
+	if err == nil && fw.ipv6 {
+		err = fw.ip6tables(a...)
 	}
 
-	return nil
+	return err
 }
 
 func (fw *Firewall) createChain(chain string) error {
-	return iptables("--new-chain", chain)
+	return fw.eachTable("--new-chain", chain)
+}
+
+func (fw *Firewall) flushChain(chain string) error {
+	return fw.eachTable("--flush", chain)
 }
 
 func (fw *Firewall) dropChain(chain string) error {
-	err := iptables("--flush", chain)
+	err := fw.flushChain(chain)
 
 	if err != nil {
 		return err
 	}
 
-	return iptables("--delete-chain", chain)
+	return fw.eachTable("--delete-chain", chain)
 }
 
 func (fw *Firewall) addRule(chain string, rule chainRule) error {
+	return fw.iptablesFor(rule.mask == 128, append([]string{"--append", chain}, fw.ruleSpec(rule)...)...)
+}
+
+func (fw *Firewall) ruleSpec(rule chainRule) []string {
 	network := net.IPNet{IP: rule.ip[:], Mask: net.CIDRMask(rule.size, rule.mask)}
 
-	if rule.port == 0 {
-		return iptables(
-			"--append", chain,
-			"--destination", network.String(),
-			"--in-interface", fw.vpnInterface,
-			"--match", "conntrack",
-			"--ctstate", "NEW",
-			"--jump", "ACCEPT")
-	} else {
-		return iptables(
-			"--append", chain,
-			"--destination", network.String(),
-			"--in-interface", fw.vpnInterface,
-			"--protocol", "tcp",
-			"--match", "tcp",
-			"--dport", strconv.FormatUint(uint64(rule.port), 10),
-			"--match", "conntrack", "--ctstate", "NEW",
-			"--jump", "ACCEPT")
+	spec := []string{
+		"--destination", network.String(),
+		"--in-interface", fw.vpnInterface,
 	}
-}
 
-func (fw *Firewall) deleteRule(chain string, rule int) error {
-	return iptables("--delete", chain, strconv.Itoa(rule))
+	if rule.protocol != "" {
+		protocol := rule.protocol
+
+		if protocol == "icmp" && rule.mask == 128 {
+			protocol = "ipv6-icmp"
+		}
+
+		spec = append(spec, "--protocol", protocol)
+
+		if strings.ContainsRune(rule.ports, ',') {
+			spec = append(spec, "--match", "multiport", "--dports", rule.ports)
+		} else if rule.ports != "" {
+			spec = append(spec, "--match", rule.protocol, "--dport", rule.ports)
+		}
+	}
+
+	target := "ACCEPT"
+
+	if rule.deny {
+		target = "DROP"
+	}
+
+	return append(spec, "--match", "conntrack", "--ctstate", "NEW", "--jump", target)
 }
 
-func (fw *Firewall) replaceRule(chain string, index int, rule chainRule) error {
-	network := net.IPNet{IP: rule.ip[:], Mask: net.CIDRMask(rule.size, rule.mask)}
+// multiportLists renders port ranges as iptables port lists, each small enough for a single multiport match
+func multiportLists(ranges []PortRange) []string {
+	var lists []string
+	var list string
+	var size int
 
-	if rule.port == 0 {
-		return iptables(
-			"--replace", chain, strconv.Itoa(index),
-			"--destination", network.String(),
-			"--in-interface", fw.vpnInterface,
-			"--match", "conntrack",
-			"--ctstate", "NEW",
-			"--jump", "ACCEPT")
-	} else {
-		return iptables(
-			"--append", chain, strconv.Itoa(index),
-			"--destination", network.String(),
-			"--in-interface", fw.vpnInterface,
-			"--protocol", "tcp",
-			"--match", "tcp",
-			"--dport", strconv.FormatUint(uint64(rule.port), 10),
-			"--match", "conntrack", "--ctstate", "NEW",
-			"--jump", "ACCEPT")
+	for _, r := range ranges {
+		portSpec := strconv.FormatUint(uint64(r.From), 10)
+		portSize := 1
+
+		if r.To != r.From {
+			portSpec += ":" + strconv.FormatUint(uint64(r.To), 10)
+			portSize = 2
+		}
+
+		if size+portSize > maxMultiport {
+			lists = append(lists, list)
+			list = ""
+			size = 0
+		}
+
+		if list != "" {
+			list += ","
+		}
+
+		list += portSpec
+		size += portSize
+	}
+
+	if list != "" {
+		lists = append(lists, list)
 	}
+
+	return lists
 }
 
-func iptables(a ...string) (err error) {
-	logger.Debugf("Running %s", strings.Join(a, " "))
-	out, err := exec.Command("iptables", a...).CombinedOutput()
+func (fw *Firewall) iptables(a ...string) error {
+	return run(fw.executor, "iptables", a...)
+}
 
-	if err != nil {
-		return fmt.Errorf("Failed to execute %s: %s (%w)", strings.Join(a, " "), out, err)
+func (fw *Firewall) ip6tables(a ...string) error {
+	return run(fw.executor, "ip6tables", a...)
+}
+
+// iptablesFor runs ip6tables for IPv6 rules and iptables otherwise
+func (fw *Firewall) iptablesFor(ipv6 bool, a ...string) error {
+	if ipv6 {
+		return fw.ip6tables(a...)
 	}
 
-	return nil
+	return fw.iptables(a...)
 }
 
 func getDefaultRoute() (*string, error) {
@@ -341,16 +438,10 @@ func getDefaultRoute() (*string, error) {
 		return nil, err
 	}
 
-	for {
-		line, err := reader.ReadString('\n')
-
-		if err != nil {
-			return nil, err
-		}
-
+	for line, err := reader.ReadString('\n'); err == nil; line, err = reader.ReadString('\n') {
 		fields := strings.Fields(line)
 
-		if fields[1] == "00000000" {
+		if len(fields) > 1 && fields[1] == "00000000" {
 			return &fields[0], nil
 		}
 	}
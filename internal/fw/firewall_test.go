@@ -0,0 +1,276 @@
+package fw
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingExecutor records the commands run by the firewall instead of running them
+type recordingExecutor struct {
+	lock     sync.Mutex
+	commands []string
+}
+
+func (e *recordingExecutor) Run(name string, args ...string) ([]byte, error) {
+	e.lock.Lock()
+	e.commands = append(e.commands, name+" "+strings.Join(args, " "))
+	e.lock.Unlock()
+
+	return nil, nil
+}
+
+// take returns the commands run since the last call
+func (e *recordingExecutor) take() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	rv := e.commands
+	e.commands = nil
+
+	return rv
+}
+
+func expectCommands(t *testing.T, commands []string, expected ...string) {
+	t.Helper()
+
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected commands:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(commands, "\n"))
+	}
+}
+
+func parseNetwork(t *testing.T, cidr string) net.IPNet {
+	ip, network, err := net.ParseCIDR(cidr)
+
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", cidr, err)
+	}
+
+	network.IP = ip
+
+	return *network
+}
+
+func TestUpdateUser(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", true, executor)
+
+	rules := []FirewallRule{
+		{Network: parseNetwork(t, "10.1.0.0/16")},
+		{Network: parseNetwork(t, "10.1.2.0/24"), Protocol: "tcp", Ports: []PortRange{{22, 22}}, Deny: true},
+		{Network: parseNetwork(t, "fd00::/64"), Protocol: "icmp"},
+	}
+
+	if err := firewall.UpdateUser("joe", rules); err != nil {
+		t.Fatalf("Error adding user: %s", err)
+	}
+
+	// Deny rules come first, IPv6 rules only go to ip6tables
+	expectCommands(t, executor.take(),
+		"iptables --new-chain user-joe",
+		"ip6tables --new-chain user-joe",
+		"iptables --append user-joe --destination 10.1.2.0/24 --in-interface tun0 --protocol tcp --match tcp --dport 22 --match conntrack --ctstate NEW --jump DROP",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --match conntrack --ctstate NEW --jump ACCEPT",
+		"ip6tables --append user-joe --destination fd00::/64 --in-interface tun0 --protocol ipv6-icmp --match conntrack --ctstate NEW --jump ACCEPT",
+	)
+
+	if err := firewall.UpdateUser("joe", rules); err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	expectCommands(t, executor.take())
+
+	if err := firewall.UpdateUser("joe", rules[:1]); err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --flush user-joe",
+		"ip6tables --flush user-joe",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --match conntrack --ctstate NEW --jump ACCEPT",
+	)
+
+	if err := firewall.UpdateUser("joe", nil); err != nil {
+		t.Fatalf("Error deleting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --flush user-joe",
+		"ip6tables --flush user-joe",
+		"iptables --delete-chain user-joe",
+		"ip6tables --delete-chain user-joe",
+	)
+}
+
+func TestUpdateUserWithoutIPv6(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", false, executor)
+
+	rules := []FirewallRule{
+		{Network: parseNetwork(t, "10.1.0.0/16"), Protocol: "udp", Ports: []PortRange{{53, 53}, {8000, 8100}}},
+		{Network: parseNetwork(t, "fd00::/64")},
+	}
+
+	if err := firewall.UpdateUser("joe", rules); err != nil {
+		t.Fatalf("Error adding user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --new-chain user-joe",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --protocol udp --match multiport --dports 53,8000:8100 --match conntrack --ctstate NEW --jump ACCEPT",
+	)
+}
+
+func TestConnectUser(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", true, executor)
+	ip := parseNetwork(t, "169.254.121.2/32")
+
+	if err := firewall.ConnectUser("joe", 1, ip, Bandwidth{}); err != nil {
+		t.Fatalf("Error connecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(), "iptables --append FORWARD --in-interface tun0 --source 169.254.121.2/32 --jump user-joe")
+
+	// The address was handed to another session
+	if err := firewall.ConnectUser("ann", 2, ip, Bandwidth{}); err != nil {
+		t.Fatalf("Error connecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --delete FORWARD --in-interface tun0 --source 169.254.121.2/32 --jump user-joe",
+		"iptables --append FORWARD --in-interface tun0 --source 169.254.121.2/32 --jump user-ann",
+	)
+
+	// The late disconnect of the previous session leaves the address alone
+	if err := firewall.DisconnectUser("joe", ip); err != nil {
+		t.Fatalf("Error disconnecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take())
+
+	if err := firewall.DisconnectUser("ann", ip); err != nil {
+		t.Fatalf("Error disconnecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(), "iptables --delete FORWARD --in-interface tun0 --source 169.254.121.2/32 --jump user-ann")
+}
+
+func TestMultiportLists(t *testing.T) {
+	var ports []PortRange
+
+	for port := uint16(1); port <= 16; port++ {
+		ports = append(ports, PortRange{port, port})
+	}
+
+	for _, test := range []struct {
+		name     string
+		ranges   []PortRange
+		expected []string
+	}{
+		{"empty", nil, nil},
+		{"single", []PortRange{{22, 22}}, []string{"22"}},
+		{"fifteen ports", ports[:15], []string{"1,2,3,4,5,6,7,8,9,10,11,12,13,14,15"}},
+		{"sixteen ports", ports, []string{"1,2,3,4,5,6,7,8,9,10,11,12,13,14,15", "16"}},
+		// A range counts as two ports, so it does not fit after fourteen ports
+		{"range at limit", append(ports[:14:14], PortRange{8000, 8100}), []string{"1,2,3,4,5,6,7,8,9,10,11,12,13,14", "8000:8100"}},
+		{"ranges", []PortRange{{1, 2}, {3, 4}, {5, 6}, {7, 8}, {9, 10}, {11, 12}, {13, 14}, {15, 15}, {16, 17}},
+			[]string{"1:2,3:4,5:6,7:8,9:10,11:12,13:14,15", "16:17"}},
+	} {
+		lists := multiportLists(test.ranges)
+
+		if strings.Join(lists, " ") != strings.Join(test.expected, " ") || len(lists) != len(test.expected) {
+			t.Errorf("%s: multiportLists() = %q, expected %q", test.name, lists, test.expected)
+		}
+	}
+}
+
+func TestUpdateUserSplitsMultiport(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", false, executor)
+
+	var ports []PortRange
+
+	for port := uint16(8001); port <= 8014; port++ {
+		ports = append(ports, PortRange{port, port})
+	}
+
+	ports = append(ports, PortRange{9000, 9100})
+
+	if err := firewall.UpdateUser("joe", []FirewallRule{{Network: parseNetwork(t, "10.1.0.0/16"), Protocol: "tcp", Ports: ports}}); err != nil {
+		t.Fatalf("Error adding user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --new-chain user-joe",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --protocol tcp --match multiport --dports 8001,8002,8003,8004,8005,8006,8007,8008,8009,8010,8011,8012,8013,8014 --match conntrack --ctstate NEW --jump ACCEPT",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --protocol tcp --match tcp --dport 9000:9100 --match conntrack --ctstate NEW --jump ACCEPT",
+	)
+}
+
+func TestUpdateUserRebuildsChain(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", false, executor)
+
+	allow := FirewallRule{Network: parseNetwork(t, "10.1.0.0/16")}
+	deny := FirewallRule{Network: parseNetwork(t, "10.1.2.0/24"), Protocol: "tcp", Ports: []PortRange{{22, 22}}, Deny: true}
+
+	if err := firewall.UpdateUser("joe", []FirewallRule{allow}); err != nil {
+		t.Fatalf("Error adding user: %s", err)
+	}
+
+	executor.take()
+
+	// A deny added later must still be placed ahead of the allow rule it overrides
+	if err := firewall.UpdateUser("joe", []FirewallRule{allow, deny}); err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --flush user-joe",
+		"iptables --append user-joe --destination 10.1.2.0/24 --in-interface tun0 --protocol tcp --match tcp --dport 22 --match conntrack --ctstate NEW --jump DROP",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --match conntrack --ctstate NEW --jump ACCEPT",
+	)
+
+	// The order of the rules given does not matter
+	if err := firewall.UpdateUser("joe", []FirewallRule{deny, allow}); err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	expectCommands(t, executor.take())
+
+	if err := firewall.UpdateUser("joe", []FirewallRule{allow}); err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --flush user-joe",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --match conntrack --ctstate NEW --jump ACCEPT",
+	)
+}
+
+func TestUpdateUserDropInOrder(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", false, executor)
+
+	rules := []FirewallRule{
+		{Network: parseNetwork(t, "10.1.0.0/16")},
+		{Network: parseNetwork(t, "10.0.0.0/8"), Drop: true},
+		{Network: parseNetwork(t, "10.1.2.0/24"), Deny: true},
+		{Network: parseNetwork(t, "0.0.0.0/0")},
+	}
+
+	if err := firewall.UpdateUser("joe", rules); err != nil {
+		t.Fatalf("Error adding user: %s", err)
+	}
+
+	// Deny rules are placed first, drop rules stay behind the rules given ahead of them
+	expectCommands(t, executor.take(),
+		"iptables --new-chain user-joe",
+		"iptables --append user-joe --destination 10.1.2.0/24 --in-interface tun0 --match conntrack --ctstate NEW --jump DROP",
+		"iptables --append user-joe --destination 10.1.0.0/16 --in-interface tun0 --match conntrack --ctstate NEW --jump ACCEPT",
+		"iptables --append user-joe --destination 10.0.0.0/8 --in-interface tun0 --match conntrack --ctstate NEW --jump DROP",
+		"iptables --append user-joe --destination 0.0.0.0/0 --in-interface tun0 --match conntrack --ctstate NEW --jump ACCEPT",
+	)
+}
@@ -0,0 +1,292 @@
+package fw
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Bandwidth limits the traffic of a client in bits per second, 0 is unlimited
+type Bandwidth struct {
+	Down uint64 // Traffic sent to the client
+	Up   uint64 // Traffic sent by the client
+}
+
+// shaper limits the bandwidth of client sessions with traffic control on the tunnel interface. Traffic to a session is
+// shaped by an HTB class, traffic from a session is policed on ingress. Each limited session has its own class and police
+// action, shared by the filters of its IPv4 and IPv6 addresses so that a dual-stack session gets the limit only once.
+type shaper struct {
+	device    string
+	executor  Executor
+	lock      sync.Mutex
+	started   bool
+	sessions  map[uint64]*shapedSession
+	addresses map[userAddress]uint64 // Session shaping each address
+	nextId    uint16
+	freeIds   []uint16
+}
+
+type shapedSession struct {
+	id        uint16 // Class minor number and police action index
+	limit     Bandwidth
+	addresses map[userAddress]net.IP
+}
+
+// maxShaperId keeps the filter priorities of both address families of a session, 2*id and 2*id+1, within 16 bits
+const maxShaperId = 0x7fff
+
+func newShaper(device string, executor Executor) *shaper {
+	return &shaper{
+		device:    device,
+		executor:  executor,
+		sessions:  make(map[uint64]*shapedSession),
+		addresses: make(map[userAddress]uint64),
+		nextId:    1,
+	}
+}
+
+func (s *shaper) tc(a ...string) error {
+	return run(s.executor, "tc", a...)
+}
+
+// start adds the root and ingress queueing disciplines, traffic not matching a filter is not limited
+func (s *shaper) start() error {
+	if s.started {
+		return nil
+	}
+
+	err := s.tc("qdisc", "replace", "dev", s.device, "root", "handle", "1:", "htb")
+
+	if err != nil {
+		return err
+	}
+
+	err = s.tc("qdisc", "replace", "dev", s.device, "handle", "ffff:", "ingress")
+
+	if err != nil {
+		return err
+	}
+
+	s.started = true
+
+	return nil
+}
+
+// limit shapes the traffic of ip as part of session, replacing the limit of the other addresses of the session when it
+// differs. A zero limit removes the limit of the session.
+func (s *shaper) limit(session uint64, addr userAddress, ip net.IP, limit Bandwidth) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The address was handed to a new session, the old one no longer uses it
+	if owner, exists := s.addresses[addr]; exists && owner != session {
+		if err := s.releaseAddress(addr); err != nil {
+			return err
+		}
+	}
+
+	addresses := map[userAddress]net.IP{addr: ip}
+
+	if shaped := s.sessions[session]; shaped != nil {
+		if shaped.limit == limit {
+			if _, exists := shaped.addresses[addr]; exists {
+				return nil
+			}
+
+			return s.addFilters(session, shaped, addr, ip)
+		}
+
+		for otherAddr, otherIP := range shaped.addresses {
+			addresses[otherAddr] = otherIP
+		}
+
+		if err := s.removeSession(session, shaped); err != nil {
+			return err
+		}
+	}
+
+	if limit.Down == 0 && limit.Up == 0 {
+		return nil
+	}
+
+	if err := s.start(); err != nil {
+		return err
+	}
+
+	var id uint16
+
+	if len(s.freeIds) != 0 {
+		id = s.freeIds[len(s.freeIds)-1]
+		s.freeIds = s.freeIds[:len(s.freeIds)-1]
+	} else if s.nextId <= maxShaperId {
+		id = s.nextId
+		s.nextId++
+	} else {
+		return fmt.Errorf("Unable to limit bandwidth of %s, too many clients", ip)
+	}
+
+	shaped := &shapedSession{id: id, limit: limit, addresses: make(map[userAddress]net.IP)}
+	s.sessions[session] = shaped
+
+	if limit.Down != 0 {
+		rate := fmt.Sprintf("%dbit", limit.Down)
+
+		err := s.tc("class", "replace", "dev", s.device, "parent", "1:", "classid", shaped.classId(), "htb", "rate", rate)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit.Up != 0 {
+		rate := fmt.Sprintf("%dbit", limit.Up)
+		burst := fmt.Sprintf("%d", burstSize(limit.Up))
+
+		err := s.tc("actions", "replace", "action", "police", "rate", rate, "burst", burst, "drop", "index", shaped.index())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for sessionAddr, sessionIP := range addresses {
+		if err := s.addFilters(session, shaped, sessionAddr, sessionIP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// release stops shaping the traffic of addr, removing the limit of its session once the session has no addresses left
+func (s *shaper) release(addr userAddress) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.releaseAddress(addr)
+}
+
+func (s *shaper) releaseAddress(addr userAddress) error {
+	session, exists := s.addresses[addr]
+
+	if !exists {
+		return nil
+	}
+
+	shaped := s.sessions[session]
+	err := s.removeFilters(shaped, addr)
+
+	delete(shaped.addresses, addr)
+	delete(s.addresses, addr)
+
+	if len(shaped.addresses) == 0 {
+		if removeErr := s.removeSession(session, shaped); removeErr != nil {
+			err = removeErr
+		}
+	}
+
+	return err
+}
+
+// addFilters directs the traffic of ip to the class and police action of a session
+func (s *shaper) addFilters(session uint64, shaped *shapedSession, addr userAddress, ip net.IP) error {
+	shaped.addresses[addr] = ip
+	s.addresses[addr] = session
+
+	host, protocol, match, prio := shaped.filter(ip)
+
+	if shaped.limit.Down != 0 {
+		err := s.tc("filter", "add", "dev", s.device, "parent", "1:", "protocol", protocol, "prio", prio, "u32", "match", match, "dst", host, "flowid", shaped.classId())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if shaped.limit.Up != 0 {
+		err := s.tc("filter", "add", "dev", s.device, "parent", "ffff:", "protocol", protocol, "prio", prio, "u32", "match", match, "src", host, "flowid", ":1", "action", "police", "index", shaped.index())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeFilters deletes the filters of an address, filters are removed by their priority
+func (s *shaper) removeFilters(shaped *shapedSession, addr userAddress) error {
+	_, protocol, _, prio := shaped.filter(shaped.addresses[addr])
+	var rv error
+
+	if shaped.limit.Up != 0 {
+		rv = s.tc("filter", "del", "dev", s.device, "parent", "ffff:", "protocol", protocol, "prio", prio)
+	}
+
+	if shaped.limit.Down != 0 {
+		if err := s.tc("filter", "del", "dev", s.device, "parent", "1:", "protocol", protocol, "prio", prio); err != nil {
+			rv = err
+		}
+	}
+
+	return rv
+}
+
+// removeSession deletes the filters, class and police action of a session
+func (s *shaper) removeSession(session uint64, shaped *shapedSession) error {
+	var rv error
+
+	for addr := range shaped.addresses {
+		if err := s.removeFilters(shaped, addr); err != nil {
+			rv = err
+		}
+
+		delete(s.addresses, addr)
+	}
+
+	if shaped.limit.Up != 0 {
+		if err := s.tc("actions", "del", "action", "police", "index", shaped.index()); err != nil {
+			rv = err
+		}
+	}
+
+	if shaped.limit.Down != 0 {
+		if err := s.tc("class", "del", "dev", s.device, "classid", shaped.classId()); err != nil {
+			rv = err
+		}
+	}
+
+	delete(s.sessions, session)
+	s.freeIds = append(s.freeIds, shaped.id)
+
+	return rv
+}
+
+func (shaped *shapedSession) classId() string {
+	return fmt.Sprintf("1:%x", shaped.id)
+}
+
+func (shaped *shapedSession) index() string {
+	return fmt.Sprintf("%d", shaped.id)
+}
+
+// filter returns the host, protocol, u32 match and priority of the filters of ip. Filters of one priority must share a
+// protocol, so IPv6 addresses have the priority after that of IPv4 addresses.
+func (shaped *shapedSession) filter(ip net.IP) (host, protocol, match, prio string) {
+	if ip.To4() != nil {
+		return ip.String() + "/32", "ip", "ip", fmt.Sprintf("%d", 2*uint32(shaped.id))
+	}
+
+	return ip.String() + "/128", "ipv6", "ip6", fmt.Sprintf("%d", 2*uint32(shaped.id)+1)
+}
+
+// burstSize returns the bytes that may be received at once by the policer, 100ms of traffic but at least one packet
+func burstSize(rate uint64) uint64 {
+	burst := rate / 8 / 10
+
+	if burst < 1600 {
+		burst = 1600
+	}
+
+	return burst
+}
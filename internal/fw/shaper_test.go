@@ -0,0 +1,126 @@
+package fw
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestShaperLimit(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", false, executor)
+	ip := parseNetwork(t, "169.254.121.2/32")
+
+	if err := firewall.ConnectUser("joe", 1, ip, Bandwidth{Down: 20000000, Up: 8000000}); err != nil {
+		t.Fatalf("Error connecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --append FORWARD --in-interface tun0 --source 169.254.121.2/32 --jump user-joe",
+		"tc qdisc replace dev tun0 root handle 1: htb",
+		"tc qdisc replace dev tun0 handle ffff: ingress",
+		"tc class replace dev tun0 parent 1: classid 1:1 htb rate 20000000bit",
+		"tc actions replace action police rate 8000000bit burst 100000 drop index 1",
+		"tc filter add dev tun0 parent 1: protocol ip prio 2 u32 match ip dst 169.254.121.2/32 flowid 1:1",
+		"tc filter add dev tun0 parent ffff: protocol ip prio 2 u32 match ip src 169.254.121.2/32 flowid :1 action police index 1",
+	)
+
+	if err := firewall.DisconnectUser("joe", ip); err != nil {
+		t.Fatalf("Error disconnecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --delete FORWARD --in-interface tun0 --source 169.254.121.2/32 --jump user-joe",
+		"tc filter del dev tun0 parent ffff: protocol ip prio 2",
+		"tc filter del dev tun0 parent 1: protocol ip prio 2",
+		"tc actions del action police index 1",
+		"tc class del dev tun0 classid 1:1",
+	)
+
+	// The freed id is reused, the queueing disciplines are only added once
+	ip = parseNetwork(t, "169.254.121.3/32")
+
+	if err := firewall.ConnectUser("ann", 2, ip, Bandwidth{Down: 1000000}); err != nil {
+		t.Fatalf("Error connecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --append FORWARD --in-interface tun0 --source 169.254.121.3/32 --jump user-ann",
+		"tc class replace dev tun0 parent 1: classid 1:1 htb rate 1000000bit",
+		"tc filter add dev tun0 parent 1: protocol ip prio 2 u32 match ip dst 169.254.121.3/32 flowid 1:1",
+	)
+}
+
+func TestShaperDualStack(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", true, executor)
+	limit := Bandwidth{Down: 20000000, Up: 8000000}
+	ip := parseNetwork(t, "169.254.121.2/32")
+	ip6 := parseNetwork(t, "fd00::1000/128")
+
+	if err := firewall.ConnectUser("joe", 1, ip, limit); err != nil {
+		t.Fatalf("Error connecting user: %s", err)
+	}
+
+	executor.take()
+
+	// The IPv6 address joins the class and police action of the session
+	if err := firewall.ConnectUser("joe", 1, ip6, limit); err != nil {
+		t.Fatalf("Error connecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"ip6tables --append FORWARD --in-interface tun0 --source fd00::1000/128 --jump user-joe",
+		"tc filter add dev tun0 parent 1: protocol ipv6 prio 3 u32 match ip6 dst fd00::1000/128 flowid 1:1",
+		"tc filter add dev tun0 parent ffff: protocol ipv6 prio 3 u32 match ip6 src fd00::1000/128 flowid :1 action police index 1",
+	)
+
+	if err := firewall.DisconnectUser("joe", ip); err != nil {
+		t.Fatalf("Error disconnecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"iptables --delete FORWARD --in-interface tun0 --source 169.254.121.2/32 --jump user-joe",
+		"tc filter del dev tun0 parent ffff: protocol ip prio 2",
+		"tc filter del dev tun0 parent 1: protocol ip prio 2",
+	)
+
+	if err := firewall.DisconnectUser("joe", ip6); err != nil {
+		t.Fatalf("Error disconnecting user: %s", err)
+	}
+
+	expectCommands(t, executor.take(),
+		"ip6tables --delete FORWARD --in-interface tun0 --source fd00::1000/128 --jump user-joe",
+		"tc filter del dev tun0 parent ffff: protocol ipv6 prio 3",
+		"tc filter del dev tun0 parent 1: protocol ipv6 prio 3",
+		"tc actions del action police index 1",
+		"tc class del dev tun0 classid 1:1",
+	)
+}
+
+func TestShaperLimitChange(t *testing.T) {
+	executor := &recordingExecutor{}
+	firewall := NewFirewall("tun0", "eth0", true, executor)
+	ip := parseNetwork(t, "169.254.121.2/32")
+	ip6 := parseNetwork(t, "fd00::1000/128")
+
+	firewall.ConnectUser("joe", 1, ip, Bandwidth{Down: 1000000})
+	firewall.ConnectUser("joe", 1, ip6, Bandwidth{Down: 1000000})
+	executor.take()
+
+	// Both addresses move to the new limit
+	if err := firewall.shaper.limit(1, newUserAddress(ip6), ip6.IP, Bandwidth{Up: 2000000}); err != nil {
+		t.Fatalf("Error changing limit: %s", err)
+	}
+
+	commands := executor.take()
+	sort.Strings(commands)
+
+	expectCommands(t, commands,
+		"tc actions replace action police rate 2000000bit burst 25000 drop index 1",
+		"tc class del dev tun0 classid 1:1",
+		"tc filter add dev tun0 parent ffff: protocol ip prio 2 u32 match ip src 169.254.121.2/32 flowid :1 action police index 1",
+		"tc filter add dev tun0 parent ffff: protocol ipv6 prio 3 u32 match ip6 src fd00::1000/128 flowid :1 action police index 1",
+		"tc filter del dev tun0 parent 1: protocol ip prio 2",
+		"tc filter del dev tun0 parent 1: protocol ipv6 prio 3",
+	)
+}
@@ -0,0 +1,270 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/amadigan/openvpn-aws/internal/log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var accessLogger = log.New("access")
+
+// accessHistorySize is the number of changes kept by the access log, older changes are discarded
+const accessHistorySize = 1000
+
+const (
+	GRANTED = "granted"
+	REVOKED = "revoked"
+	CHANGED = "changed"
+)
+
+// AccessChange describes how the access of a user changed when the configuration was reloaded
+type AccessChange struct {
+	Time     time.Time
+	User     string
+	Type     string   // GRANTED, REVOKED or CHANGED
+	Added    []string // Routes added
+	Removed  []string // Routes removed
+	Denied   []string // Deny rules added
+	Allowed  []string // Deny rules removed
+	Settings []string // Other settings that changed, as "name old -> new"
+}
+
+func (change AccessChange) String() string {
+	parts := []string{fmt.Sprintf("User %s %s", change.User, change.Type)}
+
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{
+		{"routes added", change.Added},
+		{"routes removed", change.Removed},
+		{"denies added", change.Denied},
+		{"denies removed", change.Allowed},
+		{"settings", change.Settings},
+	} {
+		if len(list.entries) != 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", list.name, strings.Join(list.entries, ", ")))
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// accessLog tracks the effective access of every user between reloads, and keeps a bounded history of the changes
+type accessLog struct {
+	lock    sync.Mutex
+	configs map[string]*config.UserConfig // nil until the first reload
+	history []AccessChange                // Ring buffer, next is the oldest entry once it is full
+	next    int
+}
+
+// record compares the access of every user with the previous reload, logging and keeping each change. The first call
+// only records the initial access.
+func (a *accessLog) record(users map[string]*vpnUser, now time.Time) []AccessChange {
+	configs := make(map[string]*config.UserConfig, len(users))
+
+	for user, info := range users {
+		if info.config != nil {
+			configs[user] = info.config
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	previous := a.configs
+	a.configs = configs
+
+	if previous == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(configs))
+
+	for user := range configs {
+		names = append(names, user)
+	}
+
+	for user := range previous {
+		if _, exists := configs[user]; !exists {
+			names = append(names, user)
+		}
+	}
+
+	sort.Strings(names)
+
+	var changes []AccessChange
+
+	for _, user := range names {
+		change := diffAccess(user, previous[user], configs[user])
+
+		if change == nil {
+			continue
+		}
+
+		change.Time = now
+		accessLogger.Info(change.String())
+		changes = append(changes, *change)
+
+		if len(a.history) < accessHistorySize {
+			a.history = append(a.history, *change)
+		} else {
+			a.history[a.next] = *change
+			a.next = (a.next + 1) % accessHistorySize
+		}
+	}
+
+	return changes
+}
+
+// changes returns the recorded changes, oldest first
+func (a *accessLog) changes() []AccessChange {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rv := make([]AccessChange, 0, len(a.history))
+
+	return append(append(rv, a.history[a.next:]...), a.history[:a.next]...)
+}
+
+// diffAccess compares the access of a user before and after a reload, where nil means no access. It returns nil if nothing
+// changed.
+func diffAccess(user string, oldConf, newConf *config.UserConfig) *AccessChange {
+	change := &AccessChange{User: user, Type: CHANGED}
+
+	if oldConf == nil && newConf == nil {
+		return nil
+	} else if oldConf == nil {
+		change.Type = GRANTED
+		oldConf = &config.UserConfig{}
+	} else if newConf == nil {
+		change.Type = REVOKED
+		newConf = &config.UserConfig{}
+	}
+
+	change.Added, change.Removed = diffRoutes(oldConf.Routes, newConf.Routes)
+	change.Denied, change.Allowed = diffRoutes(oldConf.Denies, newConf.Denies)
+
+	if change.Type != REVOKED {
+		oldSettings := accessSettings(oldConf)
+
+		for i, setting := range accessSettings(newConf) {
+			if change.Type == GRANTED && setting[1] != "" {
+				change.Settings = append(change.Settings, setting[0]+" "+setting[1])
+			} else if change.Type == CHANGED && setting[1] != oldSettings[i][1] {
+				change.Settings = append(change.Settings, fmt.Sprintf("%s %s -> %s", setting[0], settingValue(oldSettings[i][1]), settingValue(setting[1])))
+			}
+		}
+	}
+
+	if change.Type == CHANGED && len(change.Added)+len(change.Removed)+len(change.Denied)+len(change.Allowed)+len(change.Settings) == 0 {
+		return nil
+	}
+
+	return change
+}
+
+// diffRoutes returns the routes only in newRoutes and the routes only in oldRoutes
+func diffRoutes(oldRoutes, newRoutes []config.UserRoute) (added, removed []string) {
+	oldSet := make(map[string]bool, len(oldRoutes))
+	newSet := make(map[string]bool, len(newRoutes))
+
+	for _, route := range oldRoutes {
+		oldSet[route.String()] = true
+	}
+
+	for _, route := range newRoutes {
+		newSet[route.String()] = true
+
+		if !oldSet[route.String()] {
+			added = append(added, route.String())
+		}
+	}
+
+	for _, route := range oldRoutes {
+		if !newSet[route.String()] {
+			removed = append(removed, route.String())
+		}
+	}
+
+	return added, removed
+}
+
+func settingValue(value string) string {
+	if value == "" {
+		return "none"
+	}
+
+	return value
+}
+
+// accessSettings returns the name and value of each setting of a user other than routes, an empty value is not set
+func accessSettings(conf *config.UserConfig) [][2]string {
+	var ip, pool, bandwidth, servers, tunnel, timeout, reauth string
+
+	if conf.IP != nil {
+		ip = conf.IP.String()
+	}
+
+	if conf.IPPool != nil {
+		pool = conf.IPPool.String()
+	}
+
+	if conf.Bandwidth.Down != 0 || conf.Bandwidth.Up != 0 {
+		bandwidth = fmt.Sprintf("%dbit/s down %dbit/s up", conf.Bandwidth.Down, conf.Bandwidth.Up)
+	}
+
+	for _, server := range conf.DNSServers {
+		servers = strings.TrimPrefix(servers+" "+server.String(), " ")
+	}
+
+	if conf.FullTunnel {
+		tunnel = "full"
+	}
+
+	if conf.SessionTimeout != 0 {
+		timeout = conf.SessionTimeout.String()
+	}
+
+	if conf.ReauthInterval != 0 {
+		reauth = conf.ReauthInterval.String()
+	}
+
+	var connections string
+
+	if conf.MaxConnections != 0 {
+		connections = fmt.Sprintf("%d %s", conf.MaxConnections, conf.ConnectionLimit)
+	}
+
+	dns := "on"
+
+	if conf.DNSSetting == config.OFF {
+		dns = "off"
+	}
+
+	var blockOutsideDNS string
+
+	if conf.BlockOutsideDNS {
+		blockOutsideDNS = "on"
+	}
+
+	return [][2]string{
+		{"dns", dns},
+		{"nat", conf.NATSetting.String()},
+		{"max-connections", connections},
+		{"ip", ip},
+		{"ip-pool", pool},
+		{"bandwidth", bandwidth},
+		{"dns-server", servers},
+		{"dns-domain", conf.DNSDomain},
+		{"dns-search", strings.Join(conf.DNSSearch, " ")},
+		{"block-outside-dns", blockOutsideDNS},
+		{"tunnel", tunnel},
+		{"session-timeout", timeout},
+		{"reauth-interval", reauth},
+	}
+}
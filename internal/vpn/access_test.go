@@ -0,0 +1,116 @@
+package vpn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/amadigan/openvpn-aws/internal/log"
+)
+
+func userRoutes(t *testing.T, cidrs ...string) []config.UserRoute {
+	routes := make([]config.UserRoute, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", cidr, err)
+		}
+
+		routes = append(routes, config.UserRoute{Network: *network})
+	}
+
+	return routes
+}
+
+func TestDiffAccess(t *testing.T) {
+	base := &config.UserConfig{Routes: userRoutes(t, "10.1.0.0/16", "10.2.0.0/16")}
+
+	for _, test := range []struct {
+		name     string
+		oldConf  *config.UserConfig
+		newConf  *config.UserConfig
+		expected string
+	}{
+		{"no access", nil, nil, ""},
+		{"unchanged", base, &config.UserConfig{Routes: userRoutes(t, "10.1.0.0/16", "10.2.0.0/16")}, ""},
+		{"granted", nil, base, "User joe granted; routes added: 10.1.0.0/16, 10.2.0.0/16; settings: dns on"},
+		{"revoked", base, nil, "User joe revoked; routes removed: 10.1.0.0/16, 10.2.0.0/16"},
+		{
+			"routes",
+			base,
+			&config.UserConfig{Routes: userRoutes(t, "10.2.0.0/16", "10.3.0.0/16"), Denies: userRoutes(t, "10.2.1.0/24")},
+			"User joe changed; routes added: 10.3.0.0/16; routes removed: 10.1.0.0/16; denies added: 10.2.1.0/24",
+		},
+		{
+			"settings",
+			base,
+			&config.UserConfig{Routes: base.Routes, DNSSetting: config.OFF, SessionTimeout: 2 * time.Hour},
+			"User joe changed; settings: dns on -> off, session-timeout none -> 2h0m0s",
+		},
+	} {
+		change := diffAccess("joe", test.oldConf, test.newConf)
+
+		if test.expected == "" {
+			if change != nil {
+				t.Errorf("%s: expected no change, got %s", test.name, change)
+			}
+		} else if change == nil {
+			t.Errorf("%s: expected %s, got no change", test.name, test.expected)
+		} else if change.String() != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, change)
+		}
+	}
+}
+
+func TestAccessHistory(t *testing.T) {
+	// Every reload logs a change, which is only noise here
+	level := log.LogLevel
+	log.LogLevel = log.WARN
+	defer func() { log.LogLevel = level }()
+
+	var access accessLog
+	start := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	granted := map[string]*vpnUser{"joe": {config: &config.UserConfig{Routes: userRoutes(t, "10.1.0.0/16")}}}
+
+	if changes := access.record(map[string]*vpnUser{}, start); changes != nil {
+		t.Errorf("Expected the first reload to only record access, got %v", changes)
+	}
+
+	// Each reload grants or revokes the access of joe, overflowing the history
+	reloads := accessHistorySize + 5
+
+	for i := 1; i <= reloads; i++ {
+		users := map[string]*vpnUser{}
+
+		if i%2 == 1 {
+			users = granted
+		}
+
+		if changes := access.record(users, start.Add(time.Duration(i)*time.Minute)); len(changes) != 1 {
+			t.Fatalf("Expected one change at reload %d, got %v", i, changes)
+		}
+	}
+
+	history := access.changes()
+
+	if len(history) != accessHistorySize {
+		t.Fatalf("Expected %d changes, got %d", accessHistorySize, len(history))
+	}
+
+	// The oldest changes were discarded, the rest are in order
+	for i, change := range history {
+		reload := reloads - accessHistorySize + 1 + i
+		expectedType := REVOKED
+
+		if reload%2 == 1 {
+			expectedType = GRANTED
+		}
+
+		if expected := start.Add(time.Duration(reload) * time.Minute); !change.Time.Equal(expected) || change.Type != expectedType {
+			t.Fatalf("Expected change %d to be %s at %s, got %s at %s", i, expectedType, expected, change.Type, change.Time)
+		}
+	}
+}
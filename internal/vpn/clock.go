@@ -0,0 +1,27 @@
+package vpn
+
+import (
+	"time"
+)
+
+// Clock provides the current time used to evaluate access schedules, and the timers that check sessions and reload the
+// configuration
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call started by Clock.AfterFunc
+type Timer interface {
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
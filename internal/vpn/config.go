@@ -1,9 +1,11 @@
 package vpn
 
 import (
+	"errors"
 	"fmt"
 	"github.com/amadigan/openvpn-aws/internal/ca"
 	"github.com/amadigan/openvpn-aws/internal/config"
+	"net"
 	"path/filepath"
 	"sync"
 	"time"
@@ -11,9 +13,9 @@ import (
 
 type userManager struct {
 	backend            config.ConfigurationBackend
+	clock              Clock
 	certificateManager *ca.CertificateManager
 	confFile           *config.ConfigFile
-	confTag            string
 	netinfo            *config.NetworkInfo
 	users              map[string]*userKeys
 	userGroups         map[string][]string
@@ -27,10 +29,10 @@ type userKeys struct {
 
 type vpnUser struct {
 	keys   map[string]bool
-	config *config.UserConfig
+	config *config.UserConfig // nil if the user currently has no access
 }
 
-func initUserManager(backend config.ConfigurationBackend, root string) (*userManager, error) {
+func initUserManager(backend config.ConfigurationBackend, root string, clock Clock) (*userManager, error) {
 	certManager, err := ca.CreateCertificateManager(filepath.Join(root, "capath"))
 
 	if err != nil {
@@ -39,37 +41,60 @@ func initUserManager(backend config.ConfigurationBackend, root string) (*userMan
 
 	return &userManager{
 		backend:            backend,
+		clock:              clock,
 		certificateManager: certManager,
 		users:              make(map[string]*userKeys),
 	}, nil
 }
 
 func (c *userManager) update() (map[string]*vpnUser, *time.Duration, error) {
-	file, tag, err := c.backend.FetchFile("vpn.conf", c.confTag)
+	c.lock.RLock()
+	confFile := c.confFile
+	c.lock.RUnlock()
 
-	if err != nil || (file == nil && tag == "") {
+	modified, err := confFile.Modified(c.backend)
+
+	if isThrottled(err) {
+		logger.Warnf("Keeping previous configuration, unable to check for changes: %s", err)
+	} else if err != nil {
 		return nil, nil, err
 	}
 
-	var confFile *config.ConfigFile
+	if modified {
+		newConfFile, err := config.LoadConfig(c.backend, "vpn.conf")
 
-	if file != nil {
-		confFile, err = config.ParseConfig(file)
-		file.Close()
-		if err != nil {
+		if isThrottled(err) {
+			logger.Warnf("Keeping previous configuration: %s", err)
+		} else if err != nil {
 			return nil, nil, err
+		} else {
+			confFile = newConfFile
 		}
-	} else {
-		confFile = c.confFile
 	}
 
-	userConfs, err := c.buildUserConfigs(confFile, tag)
+	userConfs, err := c.buildUserConfigs(confFile)
 
 	return userConfs, confFile.WatchTime, err
 }
 
-func (c *userManager) buildUserConfigs(confFile *config.ConfigFile, tag string) (map[string]*vpnUser, error) {
-	netinfo, err := c.backend.FetchNetworkInfo()
+func (c *userManager) buildUserConfigs(confFile *config.ConfigFile) (map[string]*vpnUser, error) {
+	config.BeginReload(c.backend)
+	defer config.EndReload(c.backend)
+
+	// Only the lookups of the reload count against the request budget of the backend
+	backend := config.ReloadBackend(c.backend)
+	netinfo, err := backend.FetchNetworkInfo()
+
+	if isThrottled(err) {
+		c.lock.RLock()
+		previous := c.netinfo
+		c.lock.RUnlock()
+
+		if previous != nil {
+			logger.Warnf("Keeping previous network info: %s", err)
+			netinfo = previous
+		}
+	}
 
 	if netinfo == nil {
 		logger.Errorf("Failed to fetch network info: %s", err)
@@ -78,16 +103,18 @@ func (c *userManager) buildUserConfigs(confFile *config.ConfigFile, tag string)
 
 	c.lock.Lock()
 	c.confFile = confFile
-	c.confTag = tag
 	c.netinfo = netinfo
 	c.lock.Unlock()
 
 	userGroups := make(map[string][]string)
 
 	for groupName := range confFile.Groups {
-		users, err := c.backend.FetchGroup(groupName)
+		users, err := backend.FetchGroup(groupName)
 
-		if err != nil {
+		if isThrottled(err) {
+			logger.Warnf("Keeping previous members of group %s: %s", groupName, err)
+			users = c.previousMembers(groupName)
+		} else if err != nil {
 			return nil, err
 		}
 
@@ -104,16 +131,21 @@ func (c *userManager) buildUserConfigs(confFile *config.ConfigFile, tag string)
 		}
 	}
 
-	configs, err := c.updateKeys(userGroups)
+	configs, err := c.updateKeys(backend, userGroups)
 
 	if err != nil {
 		return nil, err
 	}
 
+	now := c.clock.Now()
+
 	for user, info := range configs {
-		userConf, err := confFile.GetUserConfig(user, userGroups[user], netinfo)
+		userConf, err := confFile.GetUserConfig(user, userGroups[user], netinfo, now)
 
-		if err != nil {
+		if errors.Is(err, config.ErrOutsideSchedule) {
+			logger.Debugf("%s", err)
+			continue
+		} else if err != nil {
 			return nil, err
 		}
 
@@ -127,13 +159,89 @@ func (c *userManager) buildUserConfigs(confFile *config.ConfigFile, tag string)
 	return configs, nil
 }
 
-func (c *userManager) updateKeys(userGroups map[string][]string) (map[string]*vpnUser, error) {
+// isThrottled returns true if a request to the backend was not made because of rate limits, so the previous result
+// is kept until the next reload
+func isThrottled(err error) bool {
+	return errors.Is(err, config.ErrThrottled)
+}
+
+// previousMembers returns the members of a group as of the last reload
+func (c *userManager) previousMembers(groupName string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var users []string
+
+	for user, groups := range c.userGroups {
+		for _, group := range groups {
+			if group == groupName {
+				users = append(users, user)
+				break
+			}
+		}
+	}
+
+	return users
+}
+
+// previousKeys returns the key ids of a user as of the last reload
+func (c *userManager) previousKeys(user string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	userEntry := c.users[user]
+
+	if userEntry == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(userEntry.keyById))
+
+	for keyId := range userEntry.keyById {
+		keys = append(keys, keyId)
+	}
+
+	return keys
+}
+
+// privateNetworks returns the private networks of the last network info, see config.NetworkInfo.PrivateNetworks
+func (c *userManager) privateNetworks() []net.IPNet {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.netinfo == nil {
+		return (&config.NetworkInfo{}).PrivateNetworks()
+	}
+
+	return c.netinfo.PrivateNetworks()
+}
+
+// nextScheduleChange returns the next time after now at which an access schedule opens or closes, or the zero time
+func (c *userManager) nextScheduleChange(now time.Time) time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.confFile.NextScheduleChange(now)
+}
+
+// poolAddress returns a free address in pool that is not assigned to a user, or nil if there is none
+func (c *userManager) poolAddress(pool net.IPNet, inUse func(ip net.IP) bool) net.IP {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.confFile.PoolAddress(pool, inUse)
+}
+
+func (c *userManager) updateKeys(backend config.ConfigurationBackend, userGroups map[string][]string) (map[string]*vpnUser, error) {
 	configs := make(map[string]*vpnUser, len(userGroups))
 
 	for user, _ := range userGroups {
-		keys, err := c.backend.FetchKeys(user)
+		keys, err := backend.FetchKeys(user)
 
-		if err != nil {
+		if isThrottled(err) {
+			logger.Warnf("Keeping previous keys of user %s: %s", user, err)
+			keys = c.previousKeys(user)
+		} else if err != nil {
 			return nil, err
 		}
 
@@ -168,9 +276,15 @@ func (c *userManager) updateKeys(userGroups map[string][]string) (map[string]*vp
 			c.lock.RUnlock()
 
 			for keyId, _ := range newKeys {
-				key, err := c.backend.FetchKey(user, keyId)
-
-				if err != nil {
+				key, err := backend.FetchKey(user, keyId)
+
+				if isThrottled(err) {
+					// The key is new, so it is fetched again on the next reload
+					logger.Warnf("Skipping key %s of user %s until the next reload: %s", keyId, user, err)
+					delete(newKeys, keyId)
+					delete(keyIds, keyId)
+					continue
+				} else if err != nil {
 					return nil, err
 				}
 
@@ -252,8 +366,14 @@ func (c *userManager) authenticateUser(user, keyHash string) (config *config.Use
 		return nil, keyId, fmt.Errorf("User %s not found", user)
 	}
 
+	// Connecting users are looked up outside of the reload view, so the request budget of a reload does not apply
 	userKeys, err := c.backend.FetchKeys(user)
 
+	if isThrottled(err) {
+		logger.Warnf("Using known keys of user %s: %s", user, err)
+		userKeys = c.previousKeys(user)
+	}
+
 	if userKeys == nil && err == nil {
 		return nil, keyId, fmt.Errorf("User %s does not exist", user)
 	}
@@ -290,6 +410,6 @@ func (c *userManager) authenticateUser(user, keyHash string) (config *config.Use
 	}
 
 	logger.Debugf("Groups for user %s: %v", user, groups)
-	config, err = c.confFile.GetUserConfig(user, groups, c.netinfo)
+	config, err = c.confFile.GetUserConfig(user, groups, c.netinfo, c.clock.Now())
 	return config, keyId, err
 }
@@ -21,13 +21,19 @@ type VPNManager struct {
 	Server          *OpenVPN
 	Firewall        *fw.Firewall
 	backend         config.ConfigurationBackend
+	clock           Clock
 	users           *userManager
+	access          accessLog
 	dnsproxy        *dns.DNSProxy
 	lock            sync.RWMutex
 	clients         map[uint64]*clientConnection
-	userConnections map[string]*clientConnection
+	userConnections map[string][]*clientConnection // Oldest first
 	tunnelIP        net.IP
+	tunnelIP6       net.IP // nil if the tunnel is IPv4 only
+	tunnelNetwork   net.IPNet
+	tunnelNetwork6  *net.IPNet
 	tunnelDevice    string
+	staticAddresses bool // The OpenVPN pool leaves the upper half of the tunnel network for static addresses
 	timer           time.Timer
 	timerChannel    time.Timer
 }
@@ -36,29 +42,26 @@ type clientConnection struct {
 	user     string
 	clientId uint64
 	address  *net.IPNet
+	address6 *net.IPNet // IPv6 address of the client, nil if it has none
 	key      string
 	conf     *config.UserConfig
+	static   net.IP // Address pushed to the client, nil if assigned by OpenVPN
+	keyHash  string
+	started  time.Time
+	authTime time.Time // Time of the last authentication
+	timer    Timer     // Checks the session timeout and reauthentication interval
 }
 
 func BootVPN(conf config.ConfigurationBackend, root string) (rv *VPNManager, err error) {
 	metric := log.StartMetric()
 	vpn := &VPNManager{
 		clients:         make(map[uint64]*clientConnection),
-		userConnections: make(map[string]*clientConnection),
+		userConnections: make(map[string][]*clientConnection),
 		backend:         conf,
+		clock:           systemClock{},
 	}
 
-	file, tag, err := conf.FetchFile("vpn.conf", "")
-
-	if file == nil {
-		if err == nil {
-			err = errors.New("Unable to load vpn configuration")
-		}
-		return nil, err
-	}
-
-	configFile, err := config.ParseConfig(file)
-	file.Close()
+	configFile, err := config.LoadConfig(conf, "vpn.conf")
 
 	if err != nil {
 		return nil, err
@@ -70,25 +73,24 @@ func BootVPN(conf config.ConfigurationBackend, root string) (rv *VPNManager, err
 		return nil, err
 	}
 
-	vpn.users, err = initUserManager(conf, root)
+	vpn.users, err = initUserManager(conf, root, vpn.clock)
 
 	if err != nil {
 		return nil, err
 	}
 
-	userConfigs, err := vpn.users.buildUserConfigs(configFile, tag)
+	userConfigs, err := vpn.users.buildUserConfigs(configFile)
 
 	if err != nil {
 		return nil, err
 	}
 
-	network := configFile.Network
+	vpn.tunnelNetwork = configFile.TunnelNetwork()
+	vpn.tunnelNetwork6 = configFile.Network6
+	settings := configFile.ServerOptions()
+	vpn.staticAddresses = settings.StaticAddresses
 
-	if network == nil {
-		network = &net.IPNet{IP: net.IPv4(169, 254, 120, 0), Mask: net.CIDRMask(24, 32)}
-	}
-
-	vpn.Server, err = StartOpenVPN(filepath.Join(root, "socket"), filepath.Join(root, "openvpn.conf"), cert, key, *network)
+	vpn.Server, err = StartOpenVPN(filepath.Join(root, "socket"), filepath.Join(root, "openvpn.conf"), settings, cert, key, vpn.tunnelNetwork, vpn.tunnelNetwork6)
 
 	if err != nil {
 		return nil, err
@@ -109,20 +111,35 @@ func BootVPN(conf config.ConfigurationBackend, root string) (rv *VPNManager, err
 			if iface != nil {
 				vpn.tunnelIP = event.IPv4
 				vpn.tunnelDevice = iface.Name
+
+				if vpn.tunnelNetwork6 != nil {
+					vpn.tunnelIP6 = event.IPv6
+				}
+
 				break
 			}
 		}
 	}
 
-	logger.Infof("Tunnel: %s on %s", vpn.tunnelIP, vpn.tunnelDevice)
+	if vpn.tunnelIP6 != nil {
+		logger.Infof("Tunnel: %s and %s on %s", vpn.tunnelIP, vpn.tunnelIP6, vpn.tunnelDevice)
+	} else {
+		logger.Infof("Tunnel: %s on %s", vpn.tunnelIP, vpn.tunnelDevice)
+	}
 
-	vpn.Firewall, err = fw.InitFirewall(vpn.tunnelDevice)
+	vpn.Firewall, err = fw.InitFirewall(vpn.tunnelDevice, vpn.tunnelIP6 != nil)
 
 	if err != nil {
 		return nil, err
 	}
 
-	vpn.dnsproxy, err = dns.StartProxy(vpn.tunnelIP.String())
+	proxyAddresses := []string{vpn.tunnelIP.String()}
+
+	if vpn.tunnelIP6 != nil {
+		proxyAddresses = append(proxyAddresses, vpn.tunnelIP6.String())
+	}
+
+	vpn.dnsproxy, err = dns.StartProxy(proxyAddresses...)
 
 	if err != nil {
 		return nil, err
@@ -130,6 +147,8 @@ func BootVPN(conf config.ConfigurationBackend, root string) (rv *VPNManager, err
 
 	logger.Debugf("Total users found: %d", len(userConfigs))
 
+	vpn.access.record(userConfigs, vpn.clock.Now())
+
 	for userName, userConf := range userConfigs {
 		err = vpn.updateFirewall(userName, userConf.config)
 
@@ -159,7 +178,7 @@ func BootVPN(conf config.ConfigurationBackend, root string) (rv *VPNManager, err
 		timerDuration = &duration
 	}
 
-	time.AfterFunc(*timerDuration, vpn.updateConfig)
+	vpn.scheduleUpdate(*timerDuration)
 
 	return vpn, nil
 }
@@ -234,47 +253,34 @@ func (m *VPNManager) updateConfig() {
 		timerDuration = &duration
 	}
 
-	if users != nil && err != nil {
+	if users != nil && err == nil {
+		m.access.record(users, m.clock.Now())
+
 		for user, info := range users {
 			m.updateFirewall(user, info.config)
 
 			m.lock.RLock()
-			userConn := m.userConnections[user]
-			killConn := false
-
-			if userConn != nil {
-				if !info.keys[userConn.key] {
-					killConn = true
-				} else if (userConn.conf.DNSSetting == config.OFF) != (info.config.DNSSetting == config.OFF) {
-					killConn = true
+			var killConns []*clientConnection
+			var remaining []*clientConnection
+
+			for _, conn := range m.userConnections[user] {
+				if info.config == nil || !info.keys[conn.key] || configChanged(conn.conf, info.config) {
+					killConns = append(killConns, conn)
 				} else {
-					if len(userConn.conf.Routes) != len(info.config.Routes) {
-						killConn = true
-					} else {
-						for i, route := range userConn.conf.Routes {
-							otherNet := info.config.Routes[i].Network
-							if !otherNet.IP.Equal(route.Network.IP) {
-								killConn = true
-								break
-							}
-
-							mask, _ := route.Network.Mask.Size()
-							otherMask, _ := otherNet.Mask.Size()
-
-							if mask != otherMask {
-								killConn = true
-								break
-							}
-						}
-					}
+					remaining = append(remaining, conn)
 				}
 			}
 
+			if info.config != nil && len(remaining) > info.config.MaxConnections {
+				killConns = append(killConns, remaining[:len(remaining)-info.config.MaxConnections]...)
+				remaining = remaining[len(remaining)-info.config.MaxConnections:]
+			}
+
 			m.lock.RUnlock()
 
-			if killConn {
-				m.DisconnectUser(user)
-			}
+			m.updateSessionLimits(remaining, info.config)
+
+			m.disconnectClients(killConns, "")
 		}
 	}
 
@@ -282,28 +288,161 @@ func (m *VPNManager) updateConfig() {
 		logger.Warnf("Warning: Failed to update configuration, %s", err)
 	}
 
-	time.AfterFunc(*timerDuration, m.updateConfig)
+	m.scheduleUpdate(*timerDuration)
 	metric.Stop()
 
 	logger.Infof("Configuration updated in %s", metric)
 }
 
+// dnsOptions renders the DNS settings of a user as push commands, the tunnel's DNS proxy is used unless other servers are
+// configured or DNS is off. The proxy's IPv6 address is only pushed when tunnelIP6 is not nil.
+func dnsOptions(conf *config.UserConfig, tunnelIP, tunnelIP6 net.IP) string {
+	var rv string
+
+	servers := conf.DNSServers
+
+	if len(servers) == 0 && conf.DNSSetting != config.OFF {
+		servers = []net.IP{tunnelIP}
+
+		if tunnelIP6 != nil {
+			servers = append(servers, tunnelIP6)
+		}
+	}
+
+	for _, server := range servers {
+		if server != nil && server.To4() == nil {
+			rv += fmt.Sprintf("push \"dhcp-option DNS6 %s\"\n", server)
+		} else {
+			rv += fmt.Sprintf("push \"dhcp-option DNS %s\"\n", server)
+		}
+	}
+
+	if conf.DNSDomain != "" {
+		rv += fmt.Sprintf("push \"dhcp-option DOMAIN %s\"\n", conf.DNSDomain)
+	}
+
+	for _, domain := range conf.DNSSearch {
+		rv += fmt.Sprintf("push \"dhcp-option DOMAIN-SEARCH %s\"\n", domain)
+	}
+
+	if conf.BlockOutsideDNS {
+		rv += "push \"block-outside-dns\"\n"
+	}
+
+	return rv
+}
+
+// configChanged checks whether a connection using oldConf must be restarted to apply newConf
+func configChanged(oldConf, newConf *config.UserConfig) bool {
+	if (oldConf.DNSSetting == config.OFF) != (newConf.DNSSetting == config.OFF) {
+		return true
+	}
+
+	if !oldConf.IP.Equal(newConf.IP) || (oldConf.IPPool == nil) != (newConf.IPPool == nil) {
+		return true
+	}
+
+	if oldConf.IPPool != nil && oldConf.IPPool.String() != newConf.IPPool.String() {
+		return true
+	}
+
+	if oldConf.Bandwidth != newConf.Bandwidth || oldConf.FullTunnel != newConf.FullTunnel {
+		return true
+	}
+
+	// Any change to the pushed DNS options requires a new session
+	if dnsOptions(oldConf, nil, nil) != dnsOptions(newConf, nil, nil) {
+		return true
+	}
+
+	if len(oldConf.Routes) != len(newConf.Routes) {
+		return true
+	}
+
+	for i, route := range oldConf.Routes {
+		otherNet := newConf.Routes[i].Network
+		if !otherNet.IP.Equal(route.Network.IP) {
+			return true
+		}
+
+		mask, _ := route.Network.Mask.Size()
+		otherMask, _ := otherNet.Mask.Size()
+
+		if mask != otherMask {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scheduleUpdate runs updateConfig after duration, or sooner if an access schedule opens or closes first
+func (m *VPNManager) scheduleUpdate(duration time.Duration) {
+	now := m.clock.Now()
+	next := m.users.nextScheduleChange(now)
+
+	if !next.IsZero() && next.Sub(now) < duration {
+		duration = next.Sub(now)
+	}
+
+	m.clock.AfterFunc(duration, m.updateConfig)
+}
+
 func (m *VPNManager) updateFirewall(user string, conf *config.UserConfig) error {
-	rules := make([]fw.FirewallRule, 0, len(conf.Routes))
+	if conf == nil {
+		return m.Firewall.UpdateUser(user, []fw.FirewallRule{})
+	}
+
+	rules := make([]fw.FirewallRule, 0, len(conf.Denies)+len(conf.Routes))
+
+	for _, route := range conf.Denies {
+		rules = appendFirewallRules(rules, route, true)
+	}
 
 	for _, route := range conf.Routes {
-		if len(route.Ports) == 0 {
-			rules = append(rules, fw.FirewallRule{Network: route.Network})
-		} else {
-			for _, port := range route.Ports {
-				rules = append(rules, fw.FirewallRule{Network: route.Network, Port: port})
-			}
+		rules = appendFirewallRules(rules, route, false)
+	}
+
+	if conf.FullTunnel {
+		// Only the routes of the user reach private networks, the rest of the traffic leaves through the server's default
+		// route, where it is masqueraded
+		for _, network := range m.users.privateNetworks() {
+			rules = append(rules, fw.FirewallRule{Network: network, Drop: true})
+		}
+
+		rules = append(rules, fw.FirewallRule{Network: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}})
+
+		if m.tunnelIP6 != nil {
+			rules = append(rules, fw.FirewallRule{Network: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}})
 		}
 	}
 
 	return m.Firewall.UpdateUser(user, rules)
 }
 
+func appendFirewallRules(rules []fw.FirewallRule, route config.UserRoute, deny bool) []fw.FirewallRule {
+	if len(route.Ports) == 0 {
+		return append(rules, fw.FirewallRule{Network: route.Network, Deny: deny})
+	}
+
+	var rule *fw.FirewallRule
+
+	for _, port := range route.Ports {
+		protocol := port.Protocol.String()
+
+		if rule == nil || rule.Protocol != protocol {
+			rules = append(rules, fw.FirewallRule{Network: route.Network, Protocol: protocol, Deny: deny})
+			rule = &rules[len(rules)-1]
+		}
+
+		if port.From != 0 {
+			rule.Ports = append(rule.Ports, fw.PortRange{From: port.From, To: port.To})
+		}
+	}
+
+	return rules
+}
+
 func (m *VPNManager) handleEvents() {
 	for {
 		select {
@@ -363,49 +502,116 @@ func (m *VPNManager) authorizeClient(clientId, keyId uint64, env map[string]stri
 		return m.Server.ExecCommand(fmt.Sprintf("client-deny %d %d \"%s\"", clientId, keyId, err), true)
 	}
 
-	command := fmt.Sprintf("client-auth %d %d\n", clientId, keyId)
+	now := m.clock.Now()
+	connection := &clientConnection{user: userName, clientId: clientId, key: keyAlias, conf: conf, keyHash: keyHash, started: now, authTime: now}
+	var oldConnections []*clientConnection
 
-	if conf.DNSSetting != config.OFF {
-		command += fmt.Sprintf("push \"dhcp-option DNS %s\"\n", m.tunnelIP)
-	}
+	m.lock.Lock()
 
-	rootMask := net.IPv4(255, 255, 255, 255)
+	if reauth {
+		if current := m.clients[clientId]; current != nil {
+			connection.address = current.address
+			connection.address6 = current.address6
+			connection.static = current.static
+			connection.started = current.started
 
-	for _, route := range conf.Routes {
-		command += fmt.Sprintf("push \"route %s %s\"\n", route.Network.IP, rootMask.Mask(route.Network.Mask))
-	}
+			if current.timer != nil {
+				current.timer.Stop()
+			}
+		}
+	} else {
+		m.removeConnection(clientId)
 
-	command += "END"
+		// A new session with the same key replaces the old one, it does not count against the limit
+		var others []*clientConnection
 
-	m.lock.Lock()
-	var oldConnection *clientConnection
+		for _, existing := range m.userConnections[userName] {
+			if existing.key == keyAlias {
+				oldConnections = append(oldConnections, existing)
+			} else {
+				others = append(others, existing)
+			}
+		}
 
-	if !reauth {
-		oldConnection = m.clients[clientId]
+		if excess := len(others) - conf.MaxConnections + 1; excess > 0 {
+			if conf.ConnectionLimit == config.REJECT {
+				m.lock.Unlock()
 
-		if oldConnection != nil {
-			delete(m.clients, clientId)
-			oldUserConnection := m.userConnections[oldConnection.user]
-			if oldUserConnection != nil && oldUserConnection.clientId == clientId {
-				delete(m.userConnections, oldConnection.user)
+				errString := fmt.Sprintf("Denying user %s, limit of %d connections reached", userName, conf.MaxConnections)
+				logger.Warn(errString)
+				return m.Server.ExecCommand(fmt.Sprintf("client-deny %d %d \"%s\"", clientId, keyId, errString), true)
 			}
+
+			oldConnections = append(oldConnections, others[:excess]...)
 		}
 
-		oldConnection = m.userConnections[userName]
+		if (conf.IP != nil || conf.IPPool != nil) && !m.staticAddresses {
+			// OpenVPN hands out the whole network, so a static address could be in use by another client
+			logger.Warnf("Ignoring static address of user %s, ip and ip-pool take effect when the server is restarted", userName)
+		} else if conf.IP != nil {
+			connection.static = conf.IP
+		} else if conf.IPPool != nil {
+			connection.static = m.users.poolAddress(*conf.IPPool, func(ip net.IP) bool {
+				return m.addressInUse(ip, oldConnections)
+			})
+
+			if connection.static == nil {
+				m.lock.Unlock()
+
+				errString := fmt.Sprintf("Denying user %s, no free address in pool %s", userName, conf.IPPool.String())
+				logger.Warn(errString)
+				return m.Server.ExecCommand(fmt.Sprintf("client-deny %d %d \"%s\"", clientId, keyId, errString), true)
+			}
+		}
 	}
 
-	connection := &clientConnection{user: userName, clientId: clientId, key: keyAlias, conf: conf}
-
-	m.clients[clientId] = connection
-	m.userConnections[userName] = connection
+	m.addConnection(connection)
+	m.scheduleSessionCheck(connection)
 
 	m.lock.Unlock()
 
-	if oldConnection != nil {
+	for _, oldConnection := range oldConnections {
 		logger.Infof("Killing old connection %d for user %s", oldConnection.clientId, userName)
-		m.Server.ExecCommand(fmt.Sprintf("client-kill %d", oldConnection.clientId), false)
 	}
 
+	m.disconnectClients(oldConnections, "")
+
+	command := fmt.Sprintf("client-auth %d %d\n", clientId, keyId)
+
+	rootMask := net.IPv4(255, 255, 255, 255)
+
+	if connection.static != nil {
+		command += fmt.Sprintf("ifconfig-push %s %s\n", connection.static, rootMask.Mask(m.tunnelNetwork.Mask))
+
+		if m.tunnelIP6 != nil {
+			ones, _ := m.tunnelNetwork6.Mask.Size()
+			static6 := config.StaticAddress6(m.tunnelNetwork, *m.tunnelNetwork6, connection.static)
+			command += fmt.Sprintf("ifconfig-ipv6-push %s/%d %s\n", static6, ones, m.tunnelIP6)
+		}
+	}
+
+	command += dnsOptions(conf, m.tunnelIP, m.tunnelIP6)
+
+	if conf.FullTunnel {
+		// def1 overrides the client's default route with two /1 routes, leaving its original default route in place
+		if m.tunnelIP6 != nil {
+			command += "push \"redirect-gateway def1 ipv6 bypass-dhcp\"\n"
+		} else {
+			command += "push \"redirect-gateway def1 bypass-dhcp\"\n"
+		}
+	}
+
+	for _, route := range conf.Routes {
+		if route.Network.IP.To4() != nil {
+			command += fmt.Sprintf("push \"route %s %s\"\n", route.Network.IP, rootMask.Mask(route.Network.Mask))
+		} else if m.tunnelIP6 != nil {
+			// IPv6 routes are only pushed to clients with an IPv6 tunnel address
+			command += fmt.Sprintf("push \"route-ipv6 %s\"\n", route.Network.String())
+		}
+	}
+
+	command += "END"
+
 	if log.LogLevel <= log.DEBUG {
 		logger.Debugf("Authorizing client %d for user %s with command %s", clientId, userName, command)
 	} else {
@@ -415,22 +621,233 @@ func (m *VPNManager) authorizeClient(clientId, keyId uint64, env map[string]stri
 	return m.Server.ExecCommand(command, true)
 }
 
-func (m *VPNManager) DisconnectUser(user string) error {
+// addressInUse checks whether a connection other than those in replaced holds ip, m.lock must be held
+func (m *VPNManager) addressInUse(ip net.IP, replaced []*clientConnection) bool {
+	for _, connection := range m.clients {
+		if !connection.static.Equal(ip) && (connection.address == nil || !connection.address.IP.Equal(ip)) {
+			continue
+		}
+
+		inUse := true
+
+		for _, old := range replaced {
+			if old == connection {
+				inUse = false
+				break
+			}
+		}
+
+		if inUse {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addConnection records a connection, replacing any connection with the same client id, m.lock must be held
+func (m *VPNManager) addConnection(connection *clientConnection) {
+	m.clients[connection.clientId] = connection
+	connections := m.userConnections[connection.user]
+
+	for i, existing := range connections {
+		if existing.clientId == connection.clientId {
+			connections[i] = connection
+			return
+		}
+	}
+
+	m.userConnections[connection.user] = append(connections, connection)
+}
+
+// removeConnection forgets the connection with the given client id and returns it, m.lock must be held
+func (m *VPNManager) removeConnection(clientId uint64) *clientConnection {
+	connection := m.clients[clientId]
+
+	if connection == nil {
+		return nil
+	}
+
+	delete(m.clients, clientId)
+
+	if connection.timer != nil {
+		connection.timer.Stop()
+	}
+
+	connections := m.userConnections[connection.user]
+
+	for i, existing := range connections {
+		if existing.clientId == clientId {
+			connections = append(connections[:i:i], connections[i+1:]...)
+			break
+		}
+	}
+
+	if len(connections) == 0 {
+		delete(m.userConnections, connection.user)
+	} else {
+		m.userConnections[connection.user] = connections
+	}
+
+	return connection
+}
+
+// disconnectClients kills each connection and removes it from the firewall. The message is sent to the clients, the default
+// message asks them to reconnect.
+func (m *VPNManager) disconnectClients(connections []*clientConnection, message string) error {
+	if len(connections) == 0 {
+		return nil
+	}
+
 	m.lock.Lock()
-	connection := m.userConnections[user]
 
-	if connection != nil {
-		delete(m.userConnections, user)
-		delete(m.clients, connection.clientId)
+	for _, connection := range connections {
+		m.removeConnection(connection.clientId)
 	}
 
 	m.lock.Unlock()
 
-	if connection != nil {
-		return m.Server.ExecCommand(fmt.Sprintf("client-kill %d", connection.clientId), false)
+	var rv error
+
+	for _, connection := range connections {
+		command := fmt.Sprintf("client-kill %d", connection.clientId)
+
+		if message != "" {
+			command += fmt.Sprintf(" \"%s\"", message)
+		}
+
+		err := m.Server.ExecCommand(command, false)
+
+		if err != nil {
+			rv = err
+		}
+
+		if connection.address != nil {
+			m.Firewall.DisconnectUser(connection.user, *connection.address)
+		}
+
+		if connection.address6 != nil {
+			m.Firewall.DisconnectUser(connection.user, *connection.address6)
+		}
 	}
 
-	return nil
+	return rv
+}
+
+// scheduleSessionCheck arranges for checkSession to run when the session times out or must be reauthenticated, m.lock must
+// be held
+func (m *VPNManager) scheduleSessionCheck(connection *clientConnection) {
+	var next time.Time
+
+	if connection.conf.SessionTimeout != 0 {
+		next = connection.started.Add(connection.conf.SessionTimeout)
+	}
+
+	if connection.conf.ReauthInterval != 0 {
+		reauth := connection.authTime.Add(connection.conf.ReauthInterval)
+
+		if next.IsZero() || reauth.Before(next) {
+			next = reauth
+		}
+	}
+
+	if next.IsZero() {
+		return
+	}
+
+	clientId := connection.clientId
+	connection.timer = m.clock.AfterFunc(next.Sub(m.clock.Now()), func() { m.checkSession(clientId) })
+}
+
+// updateSessionLimits applies changes to the session timeout and reauthentication interval to running sessions
+func (m *VPNManager) updateSessionLimits(connections []*clientConnection, conf *config.UserConfig) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, connection := range connections {
+		if m.clients[connection.clientId] != connection {
+			continue
+		}
+
+		if connection.conf.SessionTimeout != conf.SessionTimeout || connection.conf.ReauthInterval != conf.ReauthInterval {
+			if connection.timer != nil {
+				connection.timer.Stop()
+				connection.timer = nil
+			}
+
+			connection.conf = conf
+			m.scheduleSessionCheck(connection)
+		}
+	}
+}
+
+// checkSession disconnects a session that has timed out, and reauthenticates a session whose reauthentication interval has
+// passed, disconnecting it if the user's key or access has been removed
+func (m *VPNManager) checkSession(clientId uint64) {
+	m.lock.RLock()
+	connection := m.clients[clientId]
+	m.lock.RUnlock()
+
+	if connection == nil {
+		return
+	}
+
+	now := m.clock.Now()
+	conf := connection.conf
+
+	if conf.SessionTimeout != 0 && !now.Before(connection.started.Add(conf.SessionTimeout)) {
+		reason := fmt.Sprintf("session timeout of %s reached", conf.SessionTimeout)
+		logger.Infof("Disconnecting client %d for user %s, %s", clientId, connection.user, reason)
+		m.disconnectClients([]*clientConnection{connection}, "HALT,"+reason)
+		return
+	}
+
+	if conf.ReauthInterval != 0 && !now.Before(connection.authTime.Add(conf.ReauthInterval)) {
+		newConf, _, err := m.users.authenticateUser(connection.user, connection.keyHash)
+
+		if err != nil {
+			reason := "reauthentication failed"
+			logger.Infof("Disconnecting client %d for user %s, %s: %s", clientId, connection.user, reason, err)
+			m.disconnectClients([]*clientConnection{connection}, "HALT,"+reason)
+			return
+		}
+
+		if configChanged(conf, newConf) {
+			reason := "configuration changed"
+			logger.Infof("Disconnecting client %d for user %s, %s", clientId, connection.user, reason)
+			m.disconnectClients([]*clientConnection{connection}, "RESTART,"+reason)
+			return
+		}
+
+		logger.Infof("Reauthenticated client %d for user %s", clientId, connection.user)
+	}
+
+	m.lock.Lock()
+
+	if m.clients[clientId] == connection {
+		if conf.ReauthInterval != 0 && !now.Before(connection.authTime.Add(conf.ReauthInterval)) {
+			connection.authTime = now
+		}
+
+		m.scheduleSessionCheck(connection)
+	}
+
+	m.lock.Unlock()
+}
+
+// AccessHistory returns the changes to the access of users since the server started, oldest first. Only the most recent
+// changes are kept.
+func (m *VPNManager) AccessHistory() []AccessChange {
+	return m.access.changes()
+}
+
+// DisconnectUser kills every session of the user
+func (m *VPNManager) DisconnectUser(user string) error {
+	m.lock.RLock()
+	connections := m.userConnections[user]
+	m.lock.RUnlock()
+
+	return m.disconnectClients(connections, "")
 }
 
 func (m *VPNManager) processClientEvent(e *VPNClientEvent) {
@@ -445,29 +862,33 @@ func (m *VPNManager) processClientEvent(e *VPNClientEvent) {
 	} else if e.Type == "ADDRESS" {
 		m.lock.Lock()
 		conn := m.clients[e.ClientId]
-		conn.address = &e.Address
-		m.lock.Unlock()
-		m.Firewall.ConnectUser(conn.user, e.Address)
-	} else if e.Type == "DISCONNECT" {
-		m.lock.Lock()
-		conn := m.clients[e.ClientId]
 
 		if conn != nil {
-			delete(m.clients, e.ClientId)
-
-			userConn := m.userConnections[conn.user]
-
-			if userConn.clientId == e.ClientId {
-				delete(m.userConnections, conn.user)
+			if e.Address.IP.To4() != nil {
+				conn.address = &e.Address
+			} else {
+				conn.address6 = &e.Address
 			}
 		}
 
 		m.lock.Unlock()
 
+		if conn != nil {
+			m.Firewall.ConnectUser(conn.user, e.ClientId, e.Address, fw.Bandwidth{Down: conn.conf.Bandwidth.Down, Up: conn.conf.Bandwidth.Up})
+		}
+	} else if e.Type == "DISCONNECT" {
+		m.lock.Lock()
+		conn := m.removeConnection(e.ClientId)
+		m.lock.Unlock()
+
 		if conn != nil && conn.address != nil {
 			m.Firewall.DisconnectUser(conn.user, *conn.address)
 		}
 
+		if conn != nil && conn.address6 != nil {
+			m.Firewall.DisconnectUser(conn.user, *conn.address6)
+		}
+
 	}
 }
 
@@ -476,7 +897,7 @@ func (m *VPNManager) Shutdown() {
 	err := m.backend.UnregisterDNS()
 
 	if err != nil {
-		logger.Warnf("Failed to unregister DNS: %w", err)
+		logger.Warnf("Failed to unregister DNS: %s", err)
 	}
 
 	m.Server.Shutdown()
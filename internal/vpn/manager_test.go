@@ -0,0 +1,822 @@
+package vpn
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"github.com/amadigan/openvpn-aws/internal/fw"
+)
+
+// fakeClock is a Clock that only moves when set, running the timers that are due as it moves
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	f     func()
+}
+
+func newFakeClock(t *testing.T, now string) *fakeClock {
+	parsed, err := time.Parse(time.RFC3339, now)
+
+	if err != nil {
+		t.Fatalf("Error parsing time %s: %s", now, err)
+	}
+
+	return &fakeClock{now: parsed}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	timer := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+
+	return timer
+}
+
+// Set moves the clock to now, running each timer due by then at the time it was due, in order
+func (c *fakeClock) Set(now time.Time) {
+	for {
+		c.lock.Lock()
+
+		next := -1
+
+		for i, timer := range c.timers {
+			if !timer.when.After(now) && (next < 0 || timer.when.Before(c.timers[next].when)) {
+				next = i
+			}
+		}
+
+		if next < 0 {
+			c.now = now
+			c.lock.Unlock()
+			return
+		}
+
+		timer := c.timers[next]
+		c.timers = append(c.timers[:next], c.timers[next+1:]...)
+
+		if timer.when.After(c.now) {
+			c.now = timer.when
+		}
+
+		c.lock.Unlock()
+
+		// Timers may start other timers, so they run without the lock
+		timer.f()
+	}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// nullExecutor accepts every firewall command without running it
+type nullExecutor struct{}
+
+func (nullExecutor) Run(name string, args ...string) ([]byte, error) {
+	return nil, nil
+}
+
+// recordingExecutor records the firewall commands instead of running them
+type recordingExecutor struct {
+	lock     sync.Mutex
+	commands []string
+}
+
+func (e *recordingExecutor) Run(name string, args ...string) ([]byte, error) {
+	e.lock.Lock()
+	e.commands = append(e.commands, name+" "+strings.Join(args, " "))
+	e.lock.Unlock()
+
+	return nil, nil
+}
+
+// testManager is a VPNManager whose management commands are recorded instead of sent to OpenVPN
+type testManager struct {
+	*VPNManager
+	backend  *config.MemoryConfig
+	root     string
+	lock     sync.Mutex
+	commands []string
+	nextId   uint64
+}
+
+func newTestManager(t *testing.T, clock Clock, vpnConf string, users ...string) *testManager {
+	root, err := ioutil.TempDir("", "manager")
+
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+
+	backend := config.NewMemoryConfig()
+	backend.PutFile("vpn.conf", []byte(vpnConf))
+
+	for _, user := range users {
+		backend.AddUser(user)
+		backend.AddKey(user, user+"-key", publicKey(t))
+	}
+
+	m := &testManager{backend: backend, root: root}
+	m.VPNManager = &VPNManager{
+		Server:          &OpenVPN{cmdChannel: make(chan vpnCommand), respChannel: make(chan error)},
+		Firewall:        fw.NewFirewall("tun0", "eth0", false, nullExecutor{}),
+		backend:         backend,
+		clock:           clock,
+		clients:         make(map[uint64]*clientConnection),
+		userConnections: make(map[string][]*clientConnection),
+		tunnelIP:        net.IPv4(169, 254, 121, 1),
+	}
+
+	go func() {
+		for command := range m.Server.cmdChannel {
+			if command.command != "" {
+				m.lock.Lock()
+				m.commands = append(m.commands, command.command)
+				m.lock.Unlock()
+			}
+
+			if command.expectResponse {
+				m.Server.respChannel <- nil
+			}
+		}
+	}()
+
+	confFile, err := config.LoadConfig(backend, "vpn.conf")
+
+	if err != nil {
+		t.Fatalf("Error loading vpn.conf: %s", err)
+	}
+
+	m.tunnelNetwork = confFile.TunnelNetwork()
+	m.users, err = initUserManager(backend, root, clock)
+
+	if err != nil {
+		t.Fatalf("Error creating user manager: %s", err)
+	}
+
+	if _, err = m.users.buildUserConfigs(confFile); err != nil {
+		t.Fatalf("Error loading users: %s", err)
+	}
+
+	return m
+}
+
+func (m *testManager) Close() {
+	close(m.Server.cmdChannel)
+	os.RemoveAll(m.root)
+}
+
+// takeCommands returns the commands sent since the last call
+func (m *testManager) takeCommands() []string {
+	// Commands are handled in order, so every command sent before an empty one has been recorded once it is answered
+	m.Server.ExecCommand("", true)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	rv := m.commands
+	m.commands = nil
+
+	return rv
+}
+
+// connect authorizes a new session of user with its key, returning the client id
+func (m *testManager) connect(t *testing.T, user string) uint64 {
+	return m.connectKey(t, user, user+"-key")
+}
+
+// connectKey authorizes a new session of user with the key keyId, returning the client id
+func (m *testManager) connectKey(t *testing.T, user, keyId string) uint64 {
+	m.nextId++
+
+	if err := m.authorizeClient(m.nextId, 0, m.clientEnv(user, keyId), false); err != nil {
+		t.Fatalf("Error authorizing %s: %s", user, err)
+	}
+
+	return m.nextId
+}
+
+func (m *testManager) clientEnv(user, keyId string) map[string]string {
+	m.users.lock.RLock()
+	defer m.users.lock.RUnlock()
+
+	var keyHash string
+
+	if keys := m.users.users[user]; keys != nil {
+		keyHash = keys.keyById[keyId]
+	}
+
+	return map[string]string{"X509_1_CN": user, "X509_1_OU": keyHash}
+}
+
+func publicKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func parseNetwork(t *testing.T, cidr string) net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", cidr, err)
+	}
+
+	return *network
+}
+
+func hasCommand(commands []string, prefix string) bool {
+	for _, command := range commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+const scheduledConf = `global
+  net 169.254.121.0/24
+
+user joe
+  schedule mon-fri 09:00-17:00
+`
+
+func TestAuthorizeClientSchedule(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z") // Monday
+	m := newTestManager(t, clock, scheduledConf, "joe")
+	defer m.Close()
+
+	m.connect(t, "joe")
+
+	if commands := m.takeCommands(); !hasCommand(commands, "client-auth 1 0") {
+		t.Errorf("Expected joe to be authorized within the schedule, got %q", commands)
+	}
+
+	clock.Advance(8 * time.Hour)
+	m.connect(t, "joe")
+
+	commands := m.takeCommands()
+
+	if !hasCommand(commands, "client-deny 2 0") || !strings.Contains(commands[0], "outside of their access schedule") {
+		t.Errorf("Expected joe to be denied outside the schedule, got %q", commands)
+	}
+}
+
+func TestUpdateConfigSchedule(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T16:00:00Z")
+	m := newTestManager(t, clock, scheduledConf, "joe")
+	defer m.Close()
+
+	clientId := m.connect(t, "joe")
+	m.takeCommands()
+
+	m.updateConfig()
+
+	if commands := m.takeCommands(); hasCommand(commands, "client-kill") {
+		t.Errorf("Expected joe to stay connected within the schedule, got %q", commands)
+	}
+
+	// The reload scheduled for the end of the schedule disconnects joe
+	clock.Advance(time.Hour)
+
+	if commands := m.takeCommands(); !hasCommand(commands, fmt.Sprintf("client-kill %d", clientId)) {
+		t.Errorf("Expected joe to be disconnected when the schedule closes, got %q", commands)
+	}
+
+	if m.clients[clientId] != nil {
+		t.Errorf("Expected the session of joe to be removed")
+	}
+}
+
+const staticConf = `global
+  net 169.254.121.0/24
+
+user joe
+  ip 169.254.121.130
+`
+
+func TestAuthorizeClientStaticAddress(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, staticConf, "joe")
+	defer m.Close()
+
+	m.staticAddresses = true
+	m.connect(t, "joe")
+
+	if commands := m.takeCommands(); !strings.Contains(commands[0], "ifconfig-push 169.254.121.130 255.255.255.0") {
+		t.Errorf("Expected the static address to be pushed, got %q", commands)
+	}
+
+	// Without the upper half reserved, OpenVPN may have handed the address to another client
+	m.staticAddresses = false
+	m.connect(t, "joe")
+
+	if commands := m.takeCommands(); strings.Contains(strings.Join(commands, "\n"), "ifconfig-push") {
+		t.Errorf("Expected the static address to be ignored, got %q", commands)
+	}
+}
+
+const ipv6Conf = `global
+  net 169.254.121.0/24
+  net6 fd00:4f56:5041::/64
+
+user joe
+  ip 169.254.121.130
+  route 10.1.0.0/16
+  route 2600:1f18:2a1:c700::/64
+`
+
+func TestAuthorizeClientIPv6(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, ipv6Conf, "joe")
+	defer m.Close()
+
+	m.staticAddresses = true
+	m.connect(t, "joe")
+
+	// Without an IPv6 tunnel address, IPv6 routes are not pushed
+	commands := m.takeCommands()
+
+	if command := strings.Join(commands, "\n"); strings.Contains(command, "ipv6") || !strings.Contains(command, "push \"route 10.1.0.0 255.255.0.0\"") {
+		t.Errorf("Expected only IPv4 routes to be pushed, got %q", commands)
+	}
+
+	_, m.tunnelNetwork6, _ = net.ParseCIDR("fd00:4f56:5041::/64")
+	m.tunnelIP6 = net.ParseIP("fd00:4f56:5041::1")
+	clientId := m.connect(t, "joe")
+
+	// The new session replaces the first one, which is killed before the new one is authorized
+	commands = m.takeCommands()
+	auth := commands[len(commands)-1]
+
+	if !strings.HasPrefix(auth, fmt.Sprintf("client-auth %d ", clientId)) {
+		t.Fatalf("Expected joe to be authorized, got %q", commands)
+	}
+
+	for _, line := range []string{
+		"ifconfig-push 169.254.121.130 255.255.255.0",
+		"ifconfig-ipv6-push fd00:4f56:5041:0:8000::82/64 fd00:4f56:5041::1",
+		"push \"route 10.1.0.0 255.255.0.0\"",
+		"push \"route-ipv6 2600:1f18:2a1:c700::/64\"",
+	} {
+		if !strings.Contains(auth, "\n"+line+"\n") {
+			t.Errorf("Expected %q to be sent, got %q", line, auth)
+		}
+	}
+}
+
+const sessionConf = `global
+  net 169.254.121.0/24
+
+user joe
+  session-timeout 2h
+
+user ann
+  reauth-interval 1h
+`
+
+func TestSessionTimeout(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, sessionConf, "joe")
+	defer m.Close()
+
+	clientId := m.connect(t, "joe")
+	m.takeCommands()
+
+	clock.Advance(2*time.Hour - time.Minute)
+
+	if commands := m.takeCommands(); len(commands) != 0 {
+		t.Errorf("Expected joe to stay connected before the session timeout, got %q", commands)
+	}
+
+	clock.Advance(time.Minute)
+
+	expected := fmt.Sprintf("client-kill %d \"HALT,session timeout of 2h0m0s reached\"", clientId)
+
+	if commands := m.takeCommands(); !hasCommand(commands, expected) {
+		t.Errorf("Expected joe to be disconnected at the session timeout, got %q", commands)
+	}
+
+	if m.clients[clientId] != nil {
+		t.Errorf("Expected the session of joe to be removed")
+	}
+}
+
+func TestSessionReauth(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, sessionConf, "ann")
+	defer m.Close()
+
+	clientId := m.connect(t, "ann")
+	m.takeCommands()
+
+	clock.Advance(time.Hour)
+
+	if commands := m.takeCommands(); len(commands) != 0 {
+		t.Errorf("Expected ann to be reauthenticated, got %q", commands)
+	}
+
+	if authTime := m.clients[clientId].authTime; !authTime.Equal(clock.Now()) {
+		t.Errorf("Expected ann to be reauthenticated at %s, last authenticated at %s", clock.Now(), authTime)
+	}
+
+	// Removing the key takes effect at the next reauthentication, without a reload
+	m.backend.RemoveKey("ann", "ann-key")
+	clock.Advance(time.Hour - time.Minute)
+
+	if commands := m.takeCommands(); len(commands) != 0 {
+		t.Errorf("Expected ann to stay connected until the next reauthentication, got %q", commands)
+	}
+
+	clock.Advance(time.Minute)
+
+	expected := fmt.Sprintf("client-kill %d \"HALT,reauthentication failed\"", clientId)
+
+	if commands := m.takeCommands(); !hasCommand(commands, expected) {
+		t.Errorf("Expected ann to be disconnected when reauthentication fails, got %q", commands)
+	}
+}
+
+const limitConf = `global
+  net 169.254.121.0/24
+
+user joe
+  max-connections 2 evict
+
+user ann
+  max-connections 1 reject
+`
+
+// addKeys gives user the keys laptop and phone besides its own, loading them with a reload
+func (m *testManager) addKeys(t *testing.T, user string) {
+	m.backend.AddKey(user, "laptop", publicKey(t))
+	m.backend.AddKey(user, "phone", publicKey(t))
+
+	if _, _, err := m.users.update(); err != nil {
+		t.Fatalf("Error reloading users: %s", err)
+	}
+}
+
+func TestMaxConnectionsEvict(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, limitConf, "joe")
+	defer m.Close()
+
+	m.addKeys(t, "joe")
+
+	first := m.connect(t, "joe")
+	clock.Advance(time.Minute)
+	second := m.connectKey(t, "joe", "laptop")
+	clock.Advance(time.Minute)
+
+	if commands := m.takeCommands(); hasCommand(commands, "client-kill") {
+		t.Errorf("Expected two sessions to be allowed, got %q", commands)
+	}
+
+	third := m.connectKey(t, "joe", "phone")
+	commands := m.takeCommands()
+
+	if !hasCommand(commands, fmt.Sprintf("client-kill %d", first)) {
+		t.Errorf("Expected the oldest session to be evicted, got %q", commands)
+	}
+
+	if hasCommand(commands, fmt.Sprintf("client-kill %d", second)) {
+		t.Errorf("Expected only the oldest session to be evicted, got %q", commands)
+	}
+
+	if !hasCommand(commands, fmt.Sprintf("client-auth %d ", third)) {
+		t.Errorf("Expected the new session to be authorized, got %q", commands)
+	}
+
+	if m.clients[first] != nil || m.clients[second] == nil || m.clients[third] == nil {
+		t.Errorf("Expected the sessions of joe to be %d and %d", second, third)
+	}
+
+	// Reconnecting with the same key replaces the session without evicting another
+	fourth := m.connectKey(t, "joe", "laptop")
+	commands = m.takeCommands()
+
+	if !hasCommand(commands, fmt.Sprintf("client-kill %d", second)) || hasCommand(commands, fmt.Sprintf("client-kill %d", third)) {
+		t.Errorf("Expected only the session with the same key to be replaced, got %q", commands)
+	}
+
+	if !hasCommand(commands, fmt.Sprintf("client-auth %d ", fourth)) {
+		t.Errorf("Expected the new session to be authorized, got %q", commands)
+	}
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, limitConf, "ann")
+	defer m.Close()
+
+	m.addKeys(t, "ann")
+
+	first := m.connect(t, "ann")
+	m.takeCommands()
+
+	second := m.connectKey(t, "ann", "laptop")
+	commands := m.takeCommands()
+
+	expected := fmt.Sprintf("client-deny %d 0 \"Denying user ann, limit of 1 connections reached\"", second)
+
+	if !hasCommand(commands, expected) {
+		t.Errorf("Expected the new session to be denied, got %q", commands)
+	}
+
+	if hasCommand(commands, "client-kill") || m.clients[first] == nil || m.clients[second] != nil {
+		t.Errorf("Expected the existing session to be kept, got %q", commands)
+	}
+
+	// Reconnecting with the same key is not limited
+	third := m.connect(t, "ann")
+
+	if commands := m.takeCommands(); !hasCommand(commands, fmt.Sprintf("client-auth %d ", third)) {
+		t.Errorf("Expected the session with the same key to be replaced, got %q", commands)
+	}
+}
+
+const dnsConf = `global
+  net 169.254.121.0/24
+  dns on
+  dns-domain corp.internal
+  dns-search corp.internal
+
+group data
+  dns-server 10.20.0.2 fd00:20::2
+  dns-search data.corp.internal
+
+group windows
+  block-outside-dns on
+
+user ann
+  dns off
+
+user bob
+  dns on
+`
+
+func TestAuthorizeClientDNSOptions(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, dnsConf, "joe", "ann", "bob")
+	defer m.Close()
+
+	m.backend.AddToGroup("data", "joe")
+	m.backend.AddToGroup("windows", "joe")
+
+	if _, _, err := m.users.update(); err != nil {
+		t.Fatalf("Error reloading users: %s", err)
+	}
+
+	m.tunnelIP6 = net.ParseIP("fd00:121::1")
+
+	for _, test := range []struct {
+		user     string
+		expected []string
+	}{
+		{"joe", []string{
+			"push \"dhcp-option DNS 10.20.0.2\"",
+			"push \"dhcp-option DNS6 fd00:20::2\"",
+			"push \"dhcp-option DOMAIN corp.internal\"",
+			"push \"dhcp-option DOMAIN-SEARCH corp.internal\"",
+			"push \"dhcp-option DOMAIN-SEARCH data.corp.internal\"",
+			"push \"block-outside-dns\"",
+		}},
+		{"bob", []string{
+			"push \"dhcp-option DNS 169.254.121.1\"",
+			"push \"dhcp-option DNS6 fd00:121::1\"",
+			"push \"dhcp-option DOMAIN corp.internal\"",
+			"push \"dhcp-option DOMAIN-SEARCH corp.internal\"",
+		}},
+		{"ann", []string{
+			"push \"dhcp-option DOMAIN corp.internal\"",
+			"push \"dhcp-option DOMAIN-SEARCH corp.internal\"",
+		}},
+	} {
+		m.connect(t, test.user)
+		commands := m.takeCommands()
+
+		if len(commands) != 1 {
+			t.Errorf("Expected %s to be authorized, got %q", test.user, commands)
+			continue
+		}
+
+		var options []string
+
+		for _, line := range strings.Split(commands[0], "\n") {
+			if strings.Contains(line, "dhcp-option") || strings.Contains(line, "block-outside-dns") {
+				options = append(options, line)
+			}
+		}
+
+		if strings.Join(options, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("DNS options of %s = %q, expected %q", test.user, options, test.expected)
+		}
+	}
+}
+
+const fullTunnelConf = `global
+  net 169.254.121.0/24
+
+user joe
+  tunnel full
+  subnet-0a1
+`
+
+func TestUpdateFirewallFullTunnel(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, fullTunnelConf, "joe")
+	defer m.Close()
+
+	m.backend.SetNetworkInfo(config.NetworkInfo{
+		VPC: []net.IPNet{parseNetwork(t, "10.180.0.0/16")},
+		Subnets: map[string]net.IPNet{
+			"subnet-0a1": parseNetwork(t, "10.180.1.0/24"),
+			"subnet-0b2": parseNetwork(t, "10.180.2.0/24"),
+		},
+		NAT: []net.IPNet{parseNetwork(t, "100.64.0.0/16")},
+	})
+
+	users, _, err := m.users.update()
+
+	if err != nil {
+		t.Fatalf("Error reloading users: %s", err)
+	}
+
+	// Without an IPv6 tunnel, IPv6 traffic is not accepted even when the firewall supports it
+	executor := &recordingExecutor{}
+	m.Firewall = fw.NewFirewall("tun0", "eth0", true, executor)
+
+	if err = m.updateFirewall("joe", users["joe"].config); err != nil {
+		t.Fatalf("Error updating firewall: %s", err)
+	}
+
+	// The routes of joe stay ahead of the private networks, which are dropped ahead of internet traffic
+	var rules []string
+
+	for _, command := range executor.commands {
+		if fields := strings.Fields(command); len(fields) > 1 && fields[1] == "--append" {
+			rules = append(rules, fmt.Sprintf("%s %s %s", fields[0], fields[4], fields[len(fields)-1]))
+		}
+	}
+
+	expected := []string{
+		"iptables 10.180.1.0/24 ACCEPT",
+		"iptables 100.64.0.0/16 ACCEPT",
+		"iptables 10.180.0.0/16 DROP",
+		"iptables 10.180.1.0/24 DROP",
+		"iptables 10.180.2.0/24 DROP",
+		"iptables 100.64.0.0/16 DROP",
+		"iptables 10.0.0.0/8 DROP",
+		"iptables 172.16.0.0/12 DROP",
+		"iptables 192.168.0.0/16 DROP",
+		"iptables 169.254.0.0/16 DROP",
+		"ip6tables fc00::/7 DROP",
+		"iptables 0.0.0.0/0 ACCEPT",
+	}
+
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected rules:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+}
+
+func TestUpdateThrottled(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, staticConf, "joe")
+	defer m.Close()
+
+	throttled := fmt.Errorf("%w: Rate exceeded", config.ErrThrottled)
+	m.backend.Fail("FetchFile", throttled)
+	m.backend.Fail("FetchNetworkInfo", throttled)
+
+	users, _, err := m.users.update()
+
+	if err != nil {
+		t.Fatalf("Expected the previous configuration and network info to be kept, got %s", err)
+	}
+
+	if users["joe"] == nil || users["joe"].config == nil {
+		t.Errorf("Expected joe to keep access, got %v", users["joe"])
+	}
+
+	// Other failures still fail the reload
+	m.backend.Fail("FetchNetworkInfo", errors.New("connection refused"))
+
+	if _, _, err = m.users.update(); err == nil {
+		t.Errorf("Expected the reload to fail without network info")
+	}
+}
+
+func TestAuthorizeClientDuringReload(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-19T10:00:00Z")
+	m := newTestManager(t, clock, sessionConf, "joe", "ann")
+	defer m.Close()
+
+	m.backend.SetBudget(1)
+
+	// A reload in progress spends its budget
+	config.BeginReload(m.backend)
+	defer config.EndReload(m.backend)
+
+	reload := config.ReloadBackend(m.backend)
+
+	if _, err := reload.FetchKeys("ann"); err != nil {
+		t.Fatalf("Error fetching keys: %s", err)
+	}
+
+	if _, err := reload.FetchKeys("ann"); !errors.Is(err, config.ErrThrottled) {
+		t.Fatalf("Expected the budget of the reload to be spent, got %v", err)
+	}
+
+	// The keys of a connecting user are still fetched, so a removed key is refused instead of using the known keys
+	m.backend.RemoveKey("joe", "joe-key")
+	clientId := m.connect(t, "joe")
+
+	expected := fmt.Sprintf("client-deny %d 0 \"Key joe-key does not exist for user joe\"", clientId)
+
+	if commands := m.takeCommands(); !hasCommand(commands, expected) {
+		t.Errorf("Expected joe to be denied, got %q", commands)
+	}
+
+	if clientId = m.connect(t, "ann"); !hasCommand(m.takeCommands(), fmt.Sprintf("client-auth %d ", clientId)) {
+		t.Errorf("Expected ann to be authorized during the reload")
+	}
+}
+
+func TestBuildUserConfigsOutsideSchedule(t *testing.T) {
+	clock := newFakeClock(t, "2026-10-24T10:00:00Z") // Saturday
+	m := newTestManager(t, clock, scheduledConf+"\nuser ann\n", "joe", "ann")
+	defer m.Close()
+
+	confFile, err := config.LoadConfig(m.backend, "vpn.conf")
+
+	if err != nil {
+		t.Fatalf("Error loading vpn.conf: %s", err)
+	}
+
+	// joe is skipped without failing the reload for ann
+	users, err := m.users.buildUserConfigs(confFile)
+
+	if err != nil {
+		t.Fatalf("Error loading users: %s", err)
+	}
+
+	if users["joe"] == nil || users["joe"].config != nil {
+		t.Errorf("Expected joe to have no access outside the schedule")
+	}
+
+	if users["ann"] == nil || users["ann"].config == nil {
+		t.Errorf("Expected ann to have access")
+	}
+}
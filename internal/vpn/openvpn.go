@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"github.com/amadigan/openvpn-aws/internal/config"
 	"github.com/amadigan/openvpn-aws/internal/log"
 	"golang.org/x/sys/unix"
 	"io"
@@ -49,7 +50,7 @@ type vpnCommand struct {
 	expectResponse bool
 }
 
-func StartOpenVPN(socketPath, config string, cert, key []byte, network net.IPNet) (*OpenVPN, error) {
+func StartOpenVPN(socketPath, configPath string, settings config.ServerSettings, cert, key []byte, network net.IPNet, network6 *net.IPNet) (*OpenVPN, error) {
 	_, err := os.Stat("/dev/net/tun")
 
 	if err != nil {
@@ -81,30 +82,17 @@ func StartOpenVPN(socketPath, config string, cert, key []byte, network net.IPNet
 		break
 	}
 
-	confFile, err := os.OpenFile(config, os.O_APPEND|os.O_WRONLY, 0644)
+	executable, err := os.Executable()
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer confFile.Close()
+	err = config.WriteFileAtomic(configPath, serverConfig(socketPath, configPath, executable, settings, verbosity, cert, key, network, network6))
 
-	confWriter := bufio.NewWriter(confFile)
-
-	confWriter.WriteString(fmt.Sprintf("\nverb %d\n", verbosity))
-
-	confWriter.WriteString(fmt.Sprintf("\nserver %s %s\n", network.IP.String(), net.IPv4(255, 255, 255, 255).Mask(network.Mask).String()))
-
-	confWriter.WriteString("\n<cert>\n")
-	confWriter.Write(cert)
-	confWriter.WriteString("\n</cert>\n")
-
-	confWriter.WriteString("\n<key>\n")
-	confWriter.Write(key)
-	confWriter.WriteString("\n</key>\n")
-
-	confWriter.Flush()
-	confFile.Close()
+	if err != nil {
+		return nil, err
+	}
 
 	addr, err := net.ResolveUnixAddr("unix", socketPath)
 
@@ -125,7 +113,7 @@ func StartOpenVPN(socketPath, config string, cert, key []byte, network net.IPNet
 	vpnman.StateChannel = make(chan *VPNStateEvent)
 	vpnman.ClientChannel = make(chan *VPNClientEvent)
 
-	cmd := exec.Command("openvpn", "--config", config)
+	cmd := exec.Command("openvpn", "--config", configPath)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -328,12 +316,25 @@ func parseClientEvent(line string, reader *bufio.Reader) (*VPNClientEvent, error
 		if slash != -1 {
 			address.IP = net.ParseIP(addrString[:slash])
 
-			maskIp := net.ParseIP(addrString[slash+1:])
-
-			address.Mask = net.IPv4Mask(maskIp[0], maskIp[1], maskIp[2], maskIp[3])
+			if maskIp := net.ParseIP(addrString[slash+1:]).To4(); maskIp != nil {
+				address.Mask = net.IPv4Mask(maskIp[0], maskIp[1], maskIp[2], maskIp[3])
+			} else if ones, err := strconv.Atoi(addrString[slash+1:]); err == nil && address.IP != nil {
+				address.Mask = net.CIDRMask(ones, len(address.IP)*8)
+			}
 		} else {
 			address.IP = net.ParseIP(addrString)
-			address.Mask = net.CIDRMask(32, 32)
+		}
+
+		if address.IP == nil {
+			return nil, fmt.Errorf("Unable to parse client address %s", addrString)
+		}
+
+		if ip4 := address.IP.To4(); ip4 != nil {
+			address.IP = ip4
+		}
+
+		if address.Mask == nil {
+			address.Mask = net.CIDRMask(len(address.IP)*8, len(address.IP)*8)
 		}
 
 		event.Address = address
@@ -0,0 +1,88 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/amadigan/openvpn-aws/internal/config"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// serverConfig returns the complete OpenVPN configuration of the server
+func serverConfig(socketPath, configPath, executable string, settings config.ServerSettings, verbosity int, cert, key []byte, network net.IPNet, network6 *net.IPNet) []byte {
+	var conf bytes.Buffer
+
+	fmt.Fprintf(&conf, "port %d\n", settings.Port)
+	fmt.Fprintf(&conf, "proto %s\n", settings.Proto)
+	conf.WriteString("local 0.0.0.0\n")
+	conf.WriteString("topology subnet\n")
+	conf.WriteString("dev tun\n")
+
+	if settings.MTU != 0 {
+		fmt.Fprintf(&conf, "tun-mtu %d\n", settings.MTU)
+	}
+
+	if settings.Proto == "udp" {
+		conf.WriteString("mtu-disc yes\n")
+		conf.WriteString("explicit-exit-notify 2\n")
+	}
+
+	conf.WriteString("\n")
+	fmt.Fprintf(&conf, "capath %s\n", filepath.Join(filepath.Dir(configPath), "capath"))
+	conf.WriteString("dh none\n")
+	conf.WriteString("ecdh-curve secp384r1\n")
+	conf.WriteString("tls-cipher TLS-ECDHE-ECDSA-WITH-AES-256-GCM-SHA384\n")
+	conf.WriteString("tls-version-min 1.2\n")
+	fmt.Fprintf(&conf, "data-ciphers %s\n", strings.Join(settings.DataCiphers, ":"))
+
+	// Clients older than OpenVPN 2.4 do not negotiate the cipher and use the first one allowed
+	fmt.Fprintf(&conf, "data-ciphers-fallback %s\n", settings.DataCiphers[0])
+	conf.WriteString("auth SHA384\n")
+
+	if settings.Compress != "off" {
+		fmt.Fprintf(&conf, "compress %s\n", settings.Compress)
+	}
+
+	conf.WriteString("\n")
+	fmt.Fprintf(&conf, "keepalive %d %d\n", settings.KeepaliveInterval, settings.KeepaliveTimeout)
+	conf.WriteString("stale-routes-check 3600\n")
+
+	conf.WriteString("\n")
+	fmt.Fprintf(&conf, "management %s unix\n", socketPath)
+	conf.WriteString("management-client\n")
+	conf.WriteString("management-hold\n")
+	conf.WriteString("management-client-auth\n")
+	conf.WriteString("auth-user-pass-optional\n")
+
+	conf.WriteString("\n")
+	conf.WriteString("script-security 2\n")
+	conf.WriteString("tls-export-cert /tmp\n")
+	fmt.Fprintf(&conf, "tls-verify \"%s verify\"\n", executable)
+
+	conf.WriteString("\n")
+	fmt.Fprintf(&conf, "verb %d\n", verbosity)
+	conf.WriteString("mute 3\n")
+
+	netmask := net.IPv4(255, 255, 255, 255).Mask(network.Mask).String()
+	poolStart, poolEnd := config.DynamicRange(network, settings.StaticAddresses)
+
+	// With static addresses, the upper half of the network is left out of the pool
+	fmt.Fprintf(&conf, "\nserver %s %s nopool\n", network.IP.String(), netmask)
+	fmt.Fprintf(&conf, "ifconfig-pool %s %s %s\n", poolStart, poolEnd, netmask)
+
+	if network6 != nil {
+		// Clients from the IPv4 pool get an IPv6 address from the start of the network, static addresses use the upper half
+		fmt.Fprintf(&conf, "server-ipv6 %s\n", network6.String())
+	}
+
+	conf.WriteString("\n<cert>\n")
+	conf.Write(cert)
+	conf.WriteString("\n</cert>\n")
+
+	conf.WriteString("\n<key>\n")
+	conf.Write(key)
+	conf.WriteString("\n</key>\n")
+
+	return conf.Bytes()
+}
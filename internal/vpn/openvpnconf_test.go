@@ -0,0 +1,111 @@
+package vpn
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/amadigan/openvpn-aws/internal/config"
+)
+
+const defaultServerConfig = `port 1194
+proto udp
+local 0.0.0.0
+topology subnet
+dev tun
+mtu-disc yes
+explicit-exit-notify 2
+
+capath /vpn/capath
+dh none
+ecdh-curve secp384r1
+tls-cipher TLS-ECDHE-ECDSA-WITH-AES-256-GCM-SHA384
+tls-version-min 1.2
+data-ciphers AES-256-GCM
+data-ciphers-fallback AES-256-GCM
+auth SHA384
+compress lz4
+
+keepalive 10 60
+stale-routes-check 3600
+
+management /vpn/openvpn.sock unix
+management-client
+management-hold
+management-client-auth
+auth-user-pass-optional
+
+script-security 2
+tls-export-cert /tmp
+tls-verify "/vpn/openvpn-aws verify"
+
+verb 3
+mute 3
+
+server 169.254.121.0 255.255.255.0 nopool
+ifconfig-pool 169.254.121.2 169.254.121.254 255.255.255.0
+
+<cert>
+CERT
+</cert>
+
+<key>
+KEY
+</key>
+`
+
+func generateServerConfig(t *testing.T, vpnConf string, network6 *net.IPNet) string {
+	confFile, err := config.ParseConfig(strings.NewReader(vpnConf))
+
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	return string(serverConfig("/vpn/openvpn.sock", "/vpn/openvpn.conf", "/vpn/openvpn-aws", confFile.ServerOptions(), 3,
+		[]byte("CERT"), []byte("KEY"), confFile.TunnelNetwork(), network6))
+}
+
+func TestServerConfigDefaults(t *testing.T) {
+	if conf := generateServerConfig(t, "global\n  net 169.254.121.0/24\n", nil); conf != defaultServerConfig {
+		t.Errorf("Expected server config:\n%s\ngot:\n%s", defaultServerConfig, conf)
+	}
+}
+
+func TestServerConfigOptions(t *testing.T) {
+	_, network6, _ := net.ParseCIDR("fd00:4f56:5041::/64")
+
+	conf := generateServerConfig(t, `global
+  net 169.254.121.0/24
+  port 443
+  proto tcp
+  data-ciphers CHACHA20-POLY1305:AES-256-GCM
+  keepalive 20 120
+  mtu 1400
+  compress off
+
+user joe
+  ip 169.254.121.130
+`, network6)
+
+	for _, line := range []string{
+		"port 443",
+		"proto tcp",
+		"tun-mtu 1400",
+		"data-ciphers CHACHA20-POLY1305:AES-256-GCM",
+		"data-ciphers-fallback CHACHA20-POLY1305",
+		"keepalive 20 120",
+		"ifconfig-pool 169.254.121.2 169.254.121.127 255.255.255.0",
+		"server-ipv6 fd00:4f56:5041::/64",
+	} {
+		if !strings.Contains(conf, "\n"+line+"\n") && !strings.HasPrefix(conf, line+"\n") {
+			t.Errorf("Expected %q in server config:\n%s", line, conf)
+		}
+	}
+
+	// UDP only options and disabled compression are left out
+	for _, option := range []string{"mtu-disc", "explicit-exit-notify", "compress"} {
+		if strings.Contains(conf, "\n"+option+" ") {
+			t.Errorf("Expected no %s in server config:\n%s", option, conf)
+		}
+	}
+}